@@ -0,0 +1,362 @@
+// Package anomaly finds counter data that looks wrong, such as from a
+// malfunctioning counter.
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/danp/counterbase/directory"
+	"github.com/danp/counterbase/query"
+)
+
+// A Rule names a kind of anomaly.
+type Rule string
+
+const (
+	// RuleZeroRun flags long runs of zero counts.
+	RuleZeroRun Rule = "zero_run"
+	// RuleWeekdayMedian flags days far from the median of the same weekday
+	// in prior weeks.
+	RuleWeekdayMedian Rule = "weekday_median"
+	// RuleDirectionImbalance flags days where one direction has almost
+	// none of a counter's total.
+	RuleDirectionImbalance Rule = "direction_imbalance"
+)
+
+// Rules configures the checks. A zero value for a setting disables its rule.
+type Rules struct {
+	// ZeroRunHours is the length of a run of zeros to flag.
+	ZeroRunHours int `json:"zero_run_hours"`
+
+	// MedianWeeks is how many prior weeks to take the same-weekday median
+	// over. Days more than MedianFactor times above or below the median
+	// are flagged, as long as the median is at least MinMedian and at
+	// least half of the prior weeks have data.
+	MedianWeeks  int     `json:"median_weeks"`
+	MedianFactor float64 `json:"median_factor"`
+	MinMedian    float64 `json:"min_median"`
+
+	// ImbalanceShare is the share of a counter's daily total below which
+	// a direction is flagged, as long as the total is at least ImbalanceMin.
+	ImbalanceShare float64 `json:"imbalance_share"`
+	ImbalanceMin   float64 `json:"imbalance_min"`
+}
+
+// DefaultRules are reasonable Rules for hourly cycling counters.
+var DefaultRules = Rules{
+	ZeroRunHours:   12,
+	MedianWeeks:    8,
+	MedianFactor:   3,
+	MinMedian:      20,
+	ImbalanceShare: 0.05,
+	ImbalanceMin:   50,
+}
+
+// A Status is the review state of a Finding.
+type Status string
+
+const (
+	StatusOpen      Status = "open"
+	StatusDismissed Status = "dismissed"
+	// StatusConfirmed findings are real problems, to be recorded as bad
+	// data ranges.
+	StatusConfirmed Status = "confirmed"
+)
+
+func (s Status) Valid() bool {
+	switch s {
+	case StatusOpen, StatusDismissed, StatusConfirmed:
+		return true
+	}
+	return false
+}
+
+// A Finding is an anomaly found in a counter's data.
+type Finding struct {
+	// ID and Status are set once a Finding is stored.
+	ID     int64  `json:"id,omitempty"`
+	Status Status `json:"status,omitempty"`
+
+	CounterID string `json:"counter_id"`
+	// DirectionID is blank if the finding is for the counter as a whole.
+	DirectionID string `json:"direction_id,omitempty"`
+	Rule        Rule   `json:"rule"`
+
+	// Start and End are the anomalous period, End being exclusive.
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	Message string `json:"message"`
+}
+
+// BadDataRange returns f as a bad data range for the counter's directory
+// entry, covering the dates of f in loc.
+func (f Finding) BadDataRange(loc *time.Location) directory.BadDataRange {
+	date := func(t time.Time) directory.ServiceDate {
+		y, m, d := t.In(loc).Date()
+		return directory.SD(time.Date(y, m, d, 0, 0, 0, 0, time.UTC))
+	}
+	return directory.BadDataRange{
+		Start: date(f.Start),
+		End:   date(f.End.Add(-time.Nanosecond)),
+		Note:  f.Message,
+	}
+}
+
+// A Request asks for the selected counters to be checked over a time range.
+type Request struct {
+	Selector   query.Selector
+	Start, End time.Time
+}
+
+// A Checker checks counter data for anomalies.
+type Checker struct {
+	Engine *query.Engine
+	Rules  Rules
+}
+
+// Check returns the anomalies found for req, by counter in directory order.
+// Data within counters' bad data ranges is ignored.
+func (c *Checker) Check(ctx context.Context, req Request) ([]Finding, error) {
+	if req.Start.IsZero() || req.End.IsZero() || !req.End.After(req.Start) {
+		return nil, fmt.Errorf("need start before end")
+	}
+
+	counters, err := c.Engine.SelectCounters(ctx, req.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Finding
+	for _, ctr := range counters {
+		fs, err := c.checkCounter(ctx, ctr, req.Start, req.End)
+		if err != nil {
+			return nil, fmt.Errorf("checking %q: %w", ctr.ID, err)
+		}
+		out = append(out, fs...)
+	}
+	return out, nil
+}
+
+func (c *Checker) checkCounter(ctx context.Context, ctr directory.Counter, start, end time.Time) ([]Finding, error) {
+	loc, err := ctr.TimeZone()
+	if err != nil {
+		return nil, err
+	}
+
+	// Daily rules only look at whole days from first to last, and weekday
+	// medians need earlier data.
+	first := query.ResolutionDay.Bucket(start, loc)
+	if !first.Equal(start) {
+		first = first.AddDate(0, 0, 1)
+	}
+	last := query.ResolutionDay.Bucket(end, loc)
+	histStart := start
+	if c.Rules.MedianWeeks > 0 {
+		histStart = first.AddDate(0, 0, -7*c.Rules.MedianWeeks)
+	}
+
+	dirs := []string{""}
+	if len(ctr.Directions) > 0 {
+		dirs = dirs[:0]
+		for _, d := range ctr.Directions {
+			dirs = append(dirs, d.ID)
+		}
+	}
+
+	var out []Finding
+	days := make(map[string][]query.Point)
+	for _, d := range dirs {
+		s, err := c.Engine.Series(ctx, query.Request{CounterID: ctr.ID, DirectionID: d, Start: histStart, End: end})
+		if err != nil {
+			return nil, err
+		}
+
+		var pts []query.Point
+		for _, p := range s.Points {
+			if !ctr.IsBadData(p.Time, loc) && (len(ctr.ServiceRanges) == 0 || ctr.InService(p.Time, loc)) {
+				pts = append(pts, p)
+			}
+		}
+
+		var recent []query.Point
+		for _, p := range pts {
+			if !p.Time.Before(start) {
+				recent = append(recent, p)
+			}
+		}
+
+		out = append(out, c.zeroRuns(ctr.ID, d, recent)...)
+
+		days[d] = query.Aggregate(pts, loc, query.ResolutionDay)
+		out = append(out, c.weekdayMedian(ctr.ID, d, days[d], first, last)...)
+	}
+
+	if len(dirs) > 1 {
+		out = append(out, c.imbalance(ctr.ID, dirs, days, first, last)...)
+	}
+
+	return out, nil
+}
+
+// zeroRuns flags runs of zeros lasting at least Rules.ZeroRunHours. A run
+// covers the stored periods of its points, ending at the next non-zero
+// point or at a gap in the data. Points stored for periods as long as
+// ZeroRunHours, such as days with DefaultRules, aren't checked, since any
+// one zero would be flagged.
+func (c *Checker) zeroRuns(counterID, directionID string, pts []query.Point) []Finding {
+	if c.Rules.ZeroRunHours <= 0 {
+		return nil
+	}
+	min := time.Duration(c.Rules.ZeroRunHours) * time.Hour
+
+	var out []Finding
+	var runStart, runEnd time.Time
+	flag := func() {
+		if !runStart.IsZero() && runEnd.Sub(runStart) >= min {
+			out = append(out, Finding{
+				CounterID:   counterID,
+				DirectionID: directionID,
+				Rule:        RuleZeroRun,
+				Start:       runStart,
+				End:         runEnd,
+				Message:     fmt.Sprintf("zero counts for %s", runEnd.Sub(runStart)),
+			})
+		}
+		runStart, runEnd = time.Time{}, time.Time{}
+	}
+
+	for _, p := range pts {
+		end := periodEnd(p)
+		if p.Value != 0 || end.Sub(p.Time) >= min {
+			flag()
+			continue
+		}
+		if !runStart.IsZero() && p.Time.After(runEnd) {
+			flag()
+		}
+		if runStart.IsZero() {
+			runStart = p.Time
+		}
+		if end.After(runEnd) {
+			runEnd = end
+		}
+	}
+	flag()
+	return out
+}
+
+// periodEnd returns the end of the period p was stored for, taking points
+// of unknown resolution to be hourly.
+func periodEnd(p query.Point) time.Time {
+	if p.Resolution == "" {
+		return p.Time.Add(time.Hour)
+	}
+	return p.Resolution.Next(p.Time)
+}
+
+// weekdayMedian flags days from first until last whose totals are far from the
+// median total of the same weekday in the prior Rules.MedianWeeks weeks.
+func (c *Checker) weekdayMedian(counterID, directionID string, days []query.Point, first, last time.Time) []Finding {
+	if c.Rules.MedianWeeks <= 0 || c.Rules.MedianFactor <= 1 {
+		return nil
+	}
+
+	totals := make(map[int64]float64, len(days))
+	for _, d := range days {
+		totals[d.Time.Unix()] = d.Value
+	}
+
+	var out []Finding
+	for _, d := range days {
+		if d.Time.Before(first) || !d.Time.Before(last) {
+			continue
+		}
+
+		var prior []float64
+		for w := 1; w <= c.Rules.MedianWeeks; w++ {
+			if v, ok := totals[d.Time.AddDate(0, 0, -7*w).Unix()]; ok {
+				prior = append(prior, v)
+			}
+		}
+		if len(prior)*2 < c.Rules.MedianWeeks {
+			continue
+		}
+
+		med := query.Median(prior)
+		if med < c.Rules.MinMedian || med == 0 {
+			continue
+		}
+
+		ratio := d.Value / med
+		if ratio > c.Rules.MedianFactor || ratio < 1/c.Rules.MedianFactor {
+			out = append(out, Finding{
+				CounterID:   counterID,
+				DirectionID: directionID,
+				Rule:        RuleWeekdayMedian,
+				Start:       d.Time,
+				End:         d.Time.AddDate(0, 0, 1),
+				Message:     fmt.Sprintf("total %g is %.2fx the %s median of %g", d.Value, ratio, d.Time.Weekday(), med),
+			})
+		}
+	}
+	return out
+}
+
+// imbalance flags days from first until last where a direction has less than
+// Rules.ImbalanceShare of the counter's total.
+func (c *Checker) imbalance(counterID string, dirs []string, days map[string][]query.Point, first, last time.Time) []Finding {
+	if c.Rules.ImbalanceShare <= 0 {
+		return nil
+	}
+
+	byDay := make(map[int64]map[string]float64)
+	var keys []int64
+	for _, d := range dirs {
+		for _, p := range days[d] {
+			k := p.Time.Unix()
+			if byDay[k] == nil {
+				byDay[k] = make(map[string]float64)
+				keys = append(keys, k)
+			}
+			byDay[k][d] += p.Value
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	var out []Finding
+	for _, k := range keys {
+		day := time.Unix(k, 0).In(first.Location())
+		if day.Before(first) || !day.Before(last) {
+			continue
+		}
+
+		var total float64
+		for _, v := range byDay[k] {
+			total += v
+		}
+		if total < c.Rules.ImbalanceMin || total == 0 {
+			continue
+		}
+
+		// A direction without data for the day counts as silent.
+		for _, d := range dirs {
+			share := byDay[k][d] / total
+			if share >= c.Rules.ImbalanceShare {
+				continue
+			}
+			out = append(out, Finding{
+				CounterID:   counterID,
+				DirectionID: d,
+				Rule:        RuleDirectionImbalance,
+				Start:       day,
+				End:         day.AddDate(0, 0, 1),
+				Message:     fmt.Sprintf("%g of %g total (%.1f%%)", byDay[k][d], total, share*100),
+			})
+		}
+	}
+	return out
+}
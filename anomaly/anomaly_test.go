@@ -0,0 +1,177 @@
+package anomaly_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/danp/counterbase/anomaly"
+	"github.com/danp/counterbase/directory"
+	"github.com/danp/counterbase/internal/testutil"
+	"github.com/danp/counterbase/query"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestChecker(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hour := func(d, h int) time.Time { return time.Date(2021, 6, d, h, 0, 0, 0, loc) }
+
+	// Eight weeks of history then the checked week, 2021-06-07 to 2021-06-14.
+	// Each direction normally counts 10 an hour.
+	que := testutil.DataQuerier{"south-park": {}}
+	for _, dir := range []string{"nb", "sb"} {
+		for h := hour(7, 0).AddDate(0, 0, -56); h.Before(hour(14, 0)); h = h.Add(time.Hour) {
+			v := 10.0
+			switch {
+			case dir == "nb" && !h.Before(hour(8, 6)) && h.Before(hour(8, 20)):
+				// 14 hours of zeros.
+				v = 0
+			case dir == "nb" && !h.Before(hour(10, 0)) && h.Before(hour(11, 0)):
+				// A spike.
+				v = 50
+			case dir == "sb" && !h.Before(hour(12, 0)) && h.Before(hour(13, 0)):
+				// Silent but for one count.
+				v = 0
+				if h.Hour() == 0 {
+					v = 1
+				}
+			}
+			que["south-park"][dir] = append(que["south-park"][dir], query.Point{Time: h, Value: v})
+		}
+	}
+
+	dir := testutil.Directory{C: []directory.Counter{
+		{
+			ID:         "south-park",
+			Directions: []directory.Direction{{ID: "nb"}, {ID: "sb"}},
+			BadData: []directory.BadDataRange{
+				// Known, so the zero run on 2021-06-08 isn't flagged again.
+				{Start: directory.SD(time.Date(2021, 6, 8, 0, 0, 0, 0, time.UTC)), End: directory.SD(time.Date(2021, 6, 8, 0, 0, 0, 0, time.UTC))},
+			},
+		},
+	}}
+
+	ch := &anomaly.Checker{
+		Engine: &query.Engine{Querier: que, Directory: dir},
+		Rules:  anomaly.DefaultRules,
+	}
+
+	req := anomaly.Request{Start: hour(7, 0), End: hour(14, 0)}
+	got, err := ch.Check(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []anomaly.Finding{
+		{CounterID: "south-park", DirectionID: "nb", Rule: anomaly.RuleWeekdayMedian, Start: hour(10, 0), End: hour(11, 0)},
+		{CounterID: "south-park", DirectionID: "sb", Rule: anomaly.RuleZeroRun, Start: hour(12, 1), End: hour(13, 0)},
+		{CounterID: "south-park", DirectionID: "sb", Rule: anomaly.RuleWeekdayMedian, Start: hour(12, 0), End: hour(13, 0)},
+		{CounterID: "south-park", DirectionID: "sb", Rule: anomaly.RuleDirectionImbalance, Start: hour(12, 0), End: hour(13, 0)},
+	}
+	if d := cmp.Diff(want, got, cmpopts.IgnoreFields(anomaly.Finding{}, "Message")); d != "" {
+		t.Error(d)
+	}
+
+	// Without the bad data range the zero run is found.
+	dir.C[0].BadData = nil
+	got, err = ch.Check(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, f := range got {
+		if f.Rule == anomaly.RuleZeroRun && f.DirectionID == "nb" {
+			found = true
+			if !f.Start.Equal(hour(8, 6)) || !f.End.Equal(hour(8, 20)) {
+				t.Errorf("got zero run %v to %v, want %v to %v", f.Start, f.End, hour(8, 6), hour(8, 20))
+			}
+		}
+	}
+	if !found {
+		t.Error("zero run not found")
+	}
+}
+
+func TestCheckerZeroRuns(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hour := func(d, h int) time.Time { return time.Date(2021, 6, d, h, 0, 0, 0, loc) }
+
+	que := testutil.DataQuerier{"bridge": {}, "bus": {}}
+
+	// bridge reports hourly: 12 hours of zeros on the 1st, then on the 2nd
+	// 6 hours of zeros, a 5 hour gap and 6 more hours of zeros.
+	for h := hour(1, 0); h.Before(hour(3, 0)); h = h.Add(time.Hour) {
+		v := 10.0
+		switch {
+		case !h.Before(hour(1, 6)) && h.Before(hour(1, 18)):
+			v = 0
+		case !h.Before(hour(2, 11)) && h.Before(hour(2, 16)):
+			continue
+		case !h.Before(hour(2, 5)) && h.Before(hour(2, 22)):
+			v = 0
+		}
+		que["bridge"]["nb"] = append(que["bridge"]["nb"], query.Point{Time: h, Value: v, Resolution: query.ResolutionHour})
+	}
+
+	// bus reports daily, with zeros on holidays.
+	for d := 1; d <= 7; d++ {
+		v := 500.0
+		if d == 2 || d == 3 {
+			v = 0
+		}
+		que["bus"]["all"] = append(que["bus"]["all"], query.Point{Time: hour(d, 0), Value: v, Resolution: query.ResolutionDay})
+	}
+
+	dir := testutil.Directory{C: []directory.Counter{
+		{ID: "bridge", Zone: "America/Halifax", Directions: []directory.Direction{{ID: "nb"}}},
+		{ID: "bus", Zone: "America/Halifax", Directions: []directory.Direction{{ID: "all"}}},
+	}}
+
+	ch := &anomaly.Checker{
+		Engine: &query.Engine{Querier: que, Directory: dir},
+		Rules:  anomaly.Rules{ZeroRunHours: 12},
+	}
+
+	got, err := ch.Check(context.Background(), anomaly.Request{Start: hour(1, 0), End: hour(8, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []anomaly.Finding{
+		{CounterID: "bridge", DirectionID: "nb", Rule: anomaly.RuleZeroRun, Start: hour(1, 6), End: hour(1, 18)},
+	}
+	if d := cmp.Diff(want, got, cmpopts.IgnoreFields(anomaly.Finding{}, "Message")); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestFindingBadDataRange(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := anomaly.Finding{
+		Start:   time.Date(2021, 6, 8, 6, 0, 0, 0, loc),
+		End:     time.Date(2021, 6, 10, 0, 0, 0, 0, loc),
+		Message: "zero counts",
+	}
+
+	want := directory.BadDataRange{
+		Start: directory.SD(time.Date(2021, 6, 8, 0, 0, 0, 0, time.UTC)),
+		End:   directory.SD(time.Date(2021, 6, 9, 0, 0, 0, 0, time.UTC)),
+		Note:  "zero counts",
+	}
+	if d := cmp.Diff(want, f.BadDataRange(loc)); d != "" {
+		t.Error(d)
+	}
+}
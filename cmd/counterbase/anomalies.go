@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/danp/counterbase/anomaly"
+	"github.com/danp/counterbase/directory"
+	"github.com/danp/counterbase/query"
+	"github.com/danp/counterbase/source"
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+type anomaliesExec struct {
+	getStorage   func(ctx context.Context) (*dbStorage, error)
+	getDirectory func(ctx context.Context) (source.Directory, error)
+	getQuerier   func(ctx context.Context) (source.Querier, error)
+}
+
+func newAnomaliesCmd(gs func(ctx context.Context) (*dbStorage, error), gd func(ctx context.Context) (source.Directory, error), gq func(ctx context.Context) (source.Querier, error), addFlags func(*ffcli.Command) *ffcli.Command) *ffcli.Command {
+	ae := &anomaliesExec{
+		getStorage:   gs,
+		getDirectory: gd,
+		getQuerier:   gq,
+	}
+
+	return &ffcli.Command{
+		Name:       "anomalies",
+		ShortUsage: "counterbase anomalies <subcommand>",
+		ShortHelp:  "find and review anomalies in counter data",
+		FlagSet:    flag.NewFlagSet("counterbase anomalies", flag.ExitOnError),
+		Subcommands: []*ffcli.Command{
+			addFlags(ae.newCheckCmd()),
+			addFlags(ae.newListCmd()),
+			ae.newReviewCmd(),
+		},
+		Exec: func(context.Context, []string) error {
+			return flag.ErrHelp
+		},
+	}
+}
+
+func (a anomaliesExec) newCheckCmd() *ffcli.Command {
+	var (
+		fs       = flag.NewFlagSet("counterbase anomalies check", flag.ExitOnError)
+		counters commaSeparatedString
+		tags     commaSeparatedString
+		modes    commaSeparatedString
+		start    = fs.String("start", "", "start time, inclusive: YYYY-MM-DD in the counter's zone, RFC 3339, or Unix seconds, default 7 days before -end")
+		end      = fs.String("end", "", "end time, exclusive, default now")
+		rules    = fs.String("rules", "", "JSON file of rules to use instead of the defaults")
+	)
+	fs.Var(&counters, "counter", "comma-separated counter IDs")
+	fs.Var(&tags, "tag", "comma-separated tags, requires -directory-url")
+	fs.Var(&modes, "mode", "comma-separated modes, requires -directory-url")
+
+	return &ffcli.Command{
+		Name:       "check",
+		ShortUsage: "counterbase anomalies check [-counter <ids>] [-tag <tags>] [-mode <modes>] [flags]",
+		ShortHelp:  "check counter data and record findings",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			rs, err := loadRules(*rules)
+			if err != nil {
+				return err
+			}
+
+			eng, closeEngine, err := newEngine(ctx, a.getStorage, a.getDirectory, a.getQuerier)
+			if err != nil {
+				return err
+			}
+			defer closeEngine()
+
+			req := anomaly.Request{
+				Selector: query.Selector{
+					CounterIDs: counters.vals,
+					Tags:       tags.vals,
+					Modes:      modes.vals,
+				},
+			}
+
+			selected, err := eng.SelectCounters(ctx, req.Selector)
+			if err != nil {
+				return err
+			}
+			if len(selected) == 0 {
+				return fmt.Errorf("no counters selected")
+			}
+			loc, err := selected[0].TimeZone()
+			if err != nil {
+				return err
+			}
+
+			if req.End, err = query.ParseTime(*end, loc); err != nil {
+				return fmt.Errorf("bad -end: %w", err)
+			}
+			if req.End.IsZero() {
+				req.End = time.Now()
+			}
+			if req.Start, err = query.ParseTime(*start, loc); err != nil {
+				return fmt.Errorf("bad -start: %w", err)
+			}
+			if req.Start.IsZero() {
+				req.Start = req.End.AddDate(0, 0, -7)
+			}
+
+			st, err := a.getStorage(ctx)
+			if err != nil {
+				return err
+			}
+			defer st.Close()
+
+			return checkAnomalies(ctx, st, eng, rs, req)
+		},
+	}
+}
+
+// checkAnomalies runs the checker for req, records its findings in st and
+// prints them.
+func checkAnomalies(ctx context.Context, st *dbStorage, eng *query.Engine, rules anomaly.Rules, req anomaly.Request) error {
+	ch := &anomaly.Checker{Engine: eng, Rules: rules}
+	fs, err := ch.Check(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	fs, err = st.AddFindings(ctx, fs)
+	if err != nil {
+		return err
+	}
+
+	return printFindings(fs)
+}
+
+func (a anomaliesExec) newListCmd() *ffcli.Command {
+	var (
+		fs      = flag.NewFlagSet("counterbase anomalies list", flag.ExitOnError)
+		status  = fs.String("status", string(anomaly.StatusOpen), "list findings with this status: open, dismissed, or confirmed, or blank for all")
+		badData = fs.Bool("bad-data", false, "print findings as bad_data ranges for each counter's directory entry")
+	)
+
+	return &ffcli.Command{
+		Name:       "list",
+		ShortUsage: "counterbase anomalies list [flags]",
+		ShortHelp:  "list recorded findings",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if *status != "" && !anomaly.Status(*status).Valid() {
+				return fmt.Errorf("bad -status %q", *status)
+			}
+
+			st, err := a.getStorage(ctx)
+			if err != nil {
+				return err
+			}
+			defer st.Close()
+
+			fs, err := st.Findings(ctx, anomaly.Status(*status))
+			if err != nil {
+				return err
+			}
+
+			if !*badData {
+				return printFindings(fs)
+			}
+
+			zones, err := a.counterZones(ctx)
+			if err != nil {
+				return err
+			}
+
+			ranges := make(map[string][]directory.BadDataRange)
+			for _, f := range fs {
+				loc, ok := zones[f.CounterID]
+				if !ok {
+					if loc, err = (directory.Counter{}).TimeZone(); err != nil {
+						return err
+					}
+				}
+				ranges[f.CounterID] = append(ranges[f.CounterID], f.BadDataRange(loc))
+			}
+
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(ranges)
+		},
+	}
+}
+
+// counterZones returns the time zone of each counter in the directory, or
+// nothing if there's no -directory-url.
+func (a anomaliesExec) counterZones(ctx context.Context) (map[string]*time.Location, error) {
+	eng, closeEngine, err := newEngine(ctx, a.getStorage, a.getDirectory, a.getQuerier)
+	if err != nil {
+		return nil, err
+	}
+	defer closeEngine()
+
+	zones := make(map[string]*time.Location)
+	if eng.Directory == nil {
+		return zones, nil
+	}
+
+	counters, err := eng.Directory.Counters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range counters {
+		if zones[c.ID], err = c.TimeZone(); err != nil {
+			return nil, err
+		}
+	}
+	return zones, nil
+}
+
+func (a anomaliesExec) newReviewCmd() *ffcli.Command {
+	var (
+		fs     = flag.NewFlagSet("counterbase anomalies review", flag.ExitOnError)
+		status = fs.String("status", "", "new status: open, dismissed, or confirmed")
+	)
+
+	return &ffcli.Command{
+		Name:       "review",
+		ShortUsage: "counterbase anomalies review -status <status> <id> ...",
+		ShortHelp:  "set the status of recorded findings",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if !anomaly.Status(*status).Valid() {
+				return fmt.Errorf("bad -status %q", *status)
+			}
+			if len(args) == 0 {
+				return flag.ErrHelp
+			}
+
+			st, err := a.getStorage(ctx)
+			if err != nil {
+				return err
+			}
+			defer st.Close()
+
+			for _, arg := range args {
+				id, err := strconv.ParseInt(arg, 10, 64)
+				if err != nil {
+					return fmt.Errorf("bad id %q", arg)
+				}
+				if err := st.SetFindingStatus(ctx, id, anomaly.Status(*status)); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// loadRules returns anomaly.DefaultRules, overridden by any rules set in
+// the JSON file at path, if path isn't blank.
+func loadRules(path string) (anomaly.Rules, error) {
+	rs := anomaly.DefaultRules
+	if path == "" {
+		return rs, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return anomaly.Rules{}, err
+	}
+	if err := json.Unmarshal(b, &rs); err != nil {
+		return anomaly.Rules{}, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return rs, nil
+}
+
+func printFindings(fs []anomaly.Finding) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tCOUNTER\tDIRECTION\tRULE\tSTART\tEND\tMESSAGE")
+	for _, f := range fs {
+		id := "-"
+		if f.ID != 0 {
+			id = strconv.FormatInt(f.ID, 10)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", id, f.Status, f.CounterID, f.DirectionID, f.Rule, f.Start.Format(time.RFC3339), f.End.Format(time.RFC3339), f.Message)
+	}
+	return tw.Flush()
+}
@@ -2,37 +2,55 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/danp/counterbase/directory"
+	"github.com/danp/counterbase/metrics"
+	"github.com/danp/counterbase/query"
+	"github.com/danp/counterbase/source"
 	"github.com/danp/counterbase/submit"
 	"github.com/peterbourgon/ff/v3/ffcli"
 )
 
 type apiExec struct {
-	getStorage func(ctx context.Context) (*dbStorage, error)
-	addr       *string
+	getStorage   func(ctx context.Context) (*dbStorage, error)
+	getDirectory func(ctx context.Context) (source.Directory, error)
+	addr         *string
+	validation   *string
+	tokensFile   *string
+	tokensDB     *bool
 }
 
-func newAPICmd(gs func(ctx context.Context) (*dbStorage, error)) *ffcli.Command {
+func newAPICmd(gs func(ctx context.Context) (*dbStorage, error), gd func(ctx context.Context) (source.Directory, error)) *ffcli.Command {
 	var (
-		fs   = flag.NewFlagSet("counterbase api", flag.ExitOnError)
-		addr = fs.String("addr", "127.0.0.1:5000", "listen address for http server")
+		fs         = flag.NewFlagSet("counterbase api", flag.ExitOnError)
+		addr       = fs.String("addr", "127.0.0.1:5000", "listen address for http server")
+		validation = fs.String("validation", "", "check submitted data against the directory: warn or strict, requires -directory-url")
+		tokensFile = fs.String("tokens-file", "", "require submit bearer tokens listed in this JSON file")
+		tokensDB   = fs.Bool("tokens-db", false, "require submit bearer tokens stored in the database, see counterbase token")
 	)
 
 	ae := &apiExec{
-		getStorage: gs,
-		addr:       addr,
+		getStorage:   gs,
+		getDirectory: gd,
+		addr:         addr,
+		validation:   validation,
+		tokensFile:   tokensFile,
+		tokensDB:     tokensDB,
 	}
 
 	return &ffcli.Command{
 		Name:       "api",
 		ShortUsage: "counterbase api",
-		ShortHelp:  "run the submit api",
+		ShortHelp:  "run the submit and query api",
 		FlagSet:    fs,
 		Exec:       ae.exec,
 	}
@@ -48,13 +66,70 @@ func (a apiExec) exec(ctx context.Context, args []string) error {
 	}
 	defer st.Close()
 
+	var reg metrics.Registry
+	sm := newSubmitMetrics(&reg)
+	registerDatabaseSize(&reg, st)
+
 	sh := &submit.Handler{
-		Submitter: st,
+		Submitter:  meteredStorage{dbStorage: st, pointsWritten: sm.pointsWritten},
+		Validation: submit.ValidationMode(*a.validation),
+	}
+
+	if !sh.Validation.Valid() {
+		return fmt.Errorf("bad -validation %q", *a.validation)
+	}
+
+	var toks []submit.Token
+	switch {
+	case *a.tokensFile != "" && *a.tokensDB:
+		return fmt.Errorf("only one of -tokens-file and -tokens-db may be used")
+	case *a.tokensFile != "":
+		ft, err := submit.LoadTokenFile(*a.tokensFile)
+		if err != nil {
+			return fmt.Errorf("loading -tokens-file: %w", err)
+		}
+		sh.Tokens, toks = ft, ft
+	case *a.tokensDB:
+		sh.Tokens = st
+		if toks, err = st.Tokens(ctx); err != nil {
+			return fmt.Errorf("loading tokens: %w", err)
+		}
+	}
+
+	qe := &query.Engine{
+		Querier: st,
+	}
+
+	dir, err := a.getDirectory(ctx)
+	if err != nil {
+		if !errors.Is(err, errNoDirectoryURL) || sh.Validation != submit.ValidationOff {
+			return err
+		}
+		for _, tok := range toks {
+			if len(tok.Tags) > 0 {
+				return fmt.Errorf("token %q allows counters by tag, which needs -directory-url", tok.Name)
+			}
+		}
+		slog.WarnContext(ctx, "no -directory-url, tokens added with tags won't be able to submit and queries use the default zone", "zone", directory.DefaultZone)
+	} else {
+		sh.Directory = dir
+		qe.Directory = dir
+	}
+
+	qh := &query.Handler{
+		Engine: qe,
 	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/submit", sh)
+	mux.Handle("/submit", sm.instrument("/submit", sh))
+	mux.Handle("/submit/bulk", sm.instrument("/submit/bulk", http.HandlerFunc(sh.ServeBulk)))
+	mux.Handle("/query", qh)
+	mux.HandleFunc("/query/group", qh.ServeGroup)
+	mux.HandleFunc("/query/compare", qh.ServeCompare)
+	mux.HandleFunc("/query/records", qh.ServeRecords)
+	mux.HandleFunc("/query/coverage", qh.ServeCoverage)
 	mux.HandleFunc("/health", func(http.ResponseWriter, *http.Request) {})
+	mux.Handle("/metrics", &reg)
 
 	srv := &http.Server{
 		Handler: mux,
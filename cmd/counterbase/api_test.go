@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danp/counterbase/submit"
+)
+
+func TestAPITagTokensNeedDirectory(t *testing.T) {
+	// Without the check the api would serve until the timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	st := newTestStorage(t)
+
+	tok := submit.Token{Name: "partner", Hash: submit.HashToken("secret"), Tags: []string{"city"}}
+	if err := st.AddToken(ctx, tok); err != nil {
+		t.Fatal(err)
+	}
+
+	var dg directoryGetter
+	cmd := dg.addFlags(newAPICmd(func(context.Context) (*dbStorage, error) { return st, nil }, dg.get))
+	if err := cmd.ParseAndRun(ctx, []string{"-tokens-db", "-addr", "127.0.0.1:0"}); err == nil || !strings.Contains(err.Error(), "-directory-url") {
+		t.Errorf("got error %v, want one about needing -directory-url", err)
+	}
+}
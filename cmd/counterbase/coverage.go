@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/danp/counterbase/query"
+	"github.com/danp/counterbase/source"
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+type coverageExec struct {
+	getStorage   func(ctx context.Context) (*dbStorage, error)
+	getDirectory func(ctx context.Context) (source.Directory, error)
+	getQuerier   func(ctx context.Context) (source.Querier, error)
+
+	counters *commaSeparatedString
+	tags     *commaSeparatedString
+	modes    *commaSeparatedString
+	start    *string
+	end      *string
+	period   *string
+	json     *bool
+}
+
+func newCoverageCmd(gs func(ctx context.Context) (*dbStorage, error), gd func(ctx context.Context) (source.Directory, error), gq func(ctx context.Context) (source.Querier, error)) *ffcli.Command {
+	var (
+		fs       = flag.NewFlagSet("counterbase coverage", flag.ExitOnError)
+		counters commaSeparatedString
+		tags     commaSeparatedString
+		modes    commaSeparatedString
+		start    = fs.String("start", "", "start time, inclusive: YYYY-MM-DD in the counter's zone, RFC 3339, or Unix seconds")
+		end      = fs.String("end", "", "end time, exclusive: YYYY-MM-DD in the counter's zone, RFC 3339, or Unix seconds")
+		period   = fs.String("period", "", "report each day, week, month, or year rather than the whole range")
+		jsonOut  = fs.Bool("json", false, "output JSON rather than a table")
+	)
+	fs.Var(&counters, "counter", "comma-separated counter IDs")
+	fs.Var(&tags, "tag", "comma-separated tags, requires -directory-url")
+	fs.Var(&modes, "mode", "comma-separated modes, requires -directory-url")
+
+	ce := &coverageExec{
+		getStorage:   gs,
+		getDirectory: gd,
+		getQuerier:   gq,
+		counters:     &counters,
+		tags:         &tags,
+		modes:        &modes,
+		start:        start,
+		end:          end,
+		period:       period,
+		json:         jsonOut,
+	}
+
+	return &ffcli.Command{
+		Name:       "coverage",
+		ShortUsage: "counterbase coverage -start <time> -end <time> [-counter <ids>] [-tag <tags>] [-mode <modes>] [flags]",
+		ShortHelp:  "report data completeness",
+		FlagSet:    fs,
+		Exec:       ce.exec,
+	}
+}
+
+func (c coverageExec) exec(ctx context.Context, args []string) error {
+	eng, closeEngine, err := newEngine(ctx, c.getStorage, c.getDirectory, c.getQuerier)
+	if err != nil {
+		return err
+	}
+	defer closeEngine()
+
+	req := query.CoverageRequest{
+		Selector: query.Selector{
+			CounterIDs: c.counters.vals,
+			Tags:       c.tags.vals,
+			Modes:      c.modes.vals,
+		},
+		Period: query.Resolution(*c.period),
+	}
+
+	counters, err := eng.SelectCounters(ctx, req.Selector)
+	if err != nil {
+		return err
+	}
+	if len(counters) == 0 {
+		return fmt.Errorf("no counters selected")
+	}
+
+	loc, err := counters[0].TimeZone()
+	if err != nil {
+		return err
+	}
+	if req.Start, err = query.ParseTime(*c.start, loc); err != nil {
+		return fmt.Errorf("bad -start: %w", err)
+	}
+	if req.End, err = query.ParseTime(*c.end, loc); err != nil {
+		return fmt.Errorf("bad -end: %w", err)
+	}
+
+	cov, err := eng.Coverage(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	if *c.json {
+		return json.NewEncoder(os.Stdout).Encode(cov)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "COUNTER\tDIRECTION\tINTERVAL\tSTART\tEND\tEXPECTED\tPRESENT\tZERO\tCOMPLETE")
+	for _, cv := range cov {
+		for _, p := range cv.Periods {
+			pct := "-"
+			if p.PercentComplete != nil {
+				pct = fmt.Sprintf("%.1f%%", *p.PercentComplete)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n", cv.CounterID, cv.DirectionID, cv.Interval, p.Start.Format("2006-01-02 15:04"), p.End.Format("2006-01-02 15:04"), p.Expected, p.Present, p.Zero, pct)
+		}
+	}
+	return tw.Flush()
+}
@@ -2,11 +2,22 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/danp/counterbase/anomaly"
+	"github.com/danp/counterbase/metrics"
+	"github.com/danp/counterbase/query"
 	"github.com/danp/counterbase/source"
 	"github.com/danp/counterbase/submit"
 	"github.com/peterbourgon/ff/v3/ffcli"
@@ -17,13 +28,45 @@ type crawlerExec struct {
 	getSubmitter             func(ctx context.Context) (submit.Submitter, error)
 	getQuery                 func(ctx context.Context) (source.Querier, error)
 	ecoCounterPrivateDomains *commaSeparatedString
+	checkAnomalies           *bool
+	anomalyRules             *string
+	anomalyDays              *int
+	interval                 *time.Duration
+	metricsAddr              *string
+	dryRun                   *bool
+	dryRunFile               *string
+	counters                 *commaSeparatedString
+	tags                     *commaSeparatedString
+	modes                    *commaSeparatedString
+	schemes                  *commaSeparatedString
+	includeInactive          *bool
+	execDir                  *string
+	execTimeout              *time.Duration
 }
 
 func newCrawlerCmd(gd func(ctx context.Context) (source.Directory, error), gs func(ctx context.Context) (submit.Submitter, error), gq func(ctx context.Context) (source.Querier, error)) *ffcli.Command {
 	var (
 		fs                       = flag.NewFlagSet("counterbase crawler", flag.ExitOnError)
 		ecoCounterPrivateDomains commaSeparatedString
+		counters                 commaSeparatedString
+		tags                     commaSeparatedString
+		modes                    commaSeparatedString
+		schemes                  commaSeparatedString
+		includeInactive          = fs.Bool("include-inactive", false, "also crawl counters that are no longer in service")
+		execDir                  = fs.String("exec-dir", "", "directory of programs that exec sources may run")
+		execTimeout              = fs.Duration("exec-timeout", source.DefaultExecTimeout, "how long exec source programs may run")
+		checkAnomalies           = fs.Bool("check-anomalies", false, "check active counters for anomalies after crawling, recording findings in the local database, requires a sqlite: -submit-url")
+		anomalyRules             = fs.String("anomaly-rules", "", "JSON file of anomaly rules to use instead of the defaults")
+		anomalyDays              = fs.Int("anomaly-days", 7, "days of data to check for anomalies")
+		interval                 = fs.Duration("interval", 0, "if set, keep running until interrupted, crawling this often and reloading the directory before each crawl")
+		metricsAddr              = fs.String("metrics-addr", "", "with -interval, serve /metrics on this listen address while running")
+		dryRun                   = fs.Bool("dry-run", false, "get data but print what would be submitted instead of submitting it")
+		dryRunFile               = fs.String("dry-run-file", "", "with -dry-run, also write the requests that would be submitted to this file as JSON lines")
 	)
+	fs.Var(&counters, "counter", "comma-separated counter IDs to crawl, default all")
+	fs.Var(&tags, "tag", "comma-separated tags, crawl only counters with any of them")
+	fs.Var(&modes, "mode", "comma-separated modes, crawl only counters with any of them")
+	fs.Var(&schemes, "scheme", "comma-separated source URL schemes, crawl only directions using them")
 	fs.Var(&ecoCounterPrivateDomains, "eco-counter-private-domains", "comma-separated domains to expect for ecocounter://private sources, must have ECO_VISIO_<DOMAIN>_{USERNAME,PASSWORD,USER_ID,DOMAIN_ID} set")
 
 	ce := &crawlerExec{
@@ -31,37 +74,101 @@ func newCrawlerCmd(gd func(ctx context.Context) (source.Directory, error), gs fu
 		getSubmitter:             gs,
 		getQuery:                 gq,
 		ecoCounterPrivateDomains: &ecoCounterPrivateDomains,
+		checkAnomalies:           checkAnomalies,
+		anomalyRules:             anomalyRules,
+		anomalyDays:              anomalyDays,
+		interval:                 interval,
+		metricsAddr:              metricsAddr,
+		dryRun:                   dryRun,
+		dryRunFile:               dryRunFile,
+		counters:                 &counters,
+		tags:                     &tags,
+		modes:                    &modes,
+		schemes:                  &schemes,
+		includeInactive:          includeInactive,
+		execDir:                  execDir,
+		execTimeout:              execTimeout,
 	}
 
 	return &ffcli.Command{
 		Name:       "crawler",
-		ShortUsage: "counterbase crawler",
+		ShortUsage: "counterbase crawler [-counter <ids>] [-tag <tags>] [-mode <modes>] [-scheme <schemes>] [flags]",
 		ShortHelp:  "run the source crawler",
 		FlagSet:    fs,
 		Exec:       ce.exec,
 	}
 }
 
-func (c crawlerExec) exec(ctx context.Context, args []string) error {
+func (c crawlerExec) exec(ctx context.Context, args []string) (err error) {
+	if *c.dryRunFile != "" && !*c.dryRun {
+		return fmt.Errorf("-dry-run-file requires -dry-run")
+	}
+	if *c.dryRun && *c.checkAnomalies {
+		return fmt.Errorf("-check-anomalies records findings, so can't be used with -dry-run")
+	}
+	if *c.metricsAddr != "" && *c.interval <= 0 {
+		return fmt.Errorf("-metrics-addr requires -interval, since a single crawl exits before it can be scraped")
+	}
+
+	if *c.interval > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+	}
+
 	dir, err := c.getDirectory(ctx)
 	if err != nil {
 		return err
 	}
 
-	sub, err := c.getSubmitter(ctx)
-	if err != nil {
+	var sub submit.Submitter
+	if *c.dryRun {
+		ds := &dryRunSubmitter{w: os.Stdout}
+		if *c.dryRunFile != "" {
+			f, cerr := os.Create(*c.dryRunFile)
+			if cerr != nil {
+				return cerr
+			}
+			defer func() {
+				if cerr := f.Close(); cerr != nil {
+					err = errors.Join(err, fmt.Errorf("closing -dry-run-file: %w", cerr))
+				}
+			}()
+			ds.enc = json.NewEncoder(f)
+		}
+		sub = ds
+	} else if sub, err = c.getSubmitter(ctx); err != nil {
 		return err
 	}
+	if _, ok := sub.(*dbStorage); *c.checkAnomalies && !ok {
+		return fmt.Errorf("-check-anomalies records findings in the local database, so needs a sqlite: -submit-url")
+	}
 
 	qu, err := c.getQuery(ctx)
 	if err != nil {
 		return err
 	}
 
+	var reg metrics.Registry
 	crawler := &source.Crawler{
 		Directory: dir,
 		Querier:   qu,
 		Submitter: sub,
+		Selector: query.Selector{
+			CounterIDs: c.counters.vals,
+			Tags:       c.tags.vals,
+			Modes:      c.modes.vals,
+		},
+		Schemes:         c.schemes.vals,
+		IncludeInactive: *c.includeInactive,
+		Metrics:         source.NewCrawlerMetrics(&reg),
+	}
+	if st, ok := sub.(*dbStorage); ok {
+		registerDatabaseSize(&reg, st)
+	}
+	if *c.metricsAddr != "" {
+		stop := serveMetrics(ctx, *c.metricsAddr, &reg)
+		defer stop()
 	}
 
 	var eg source.EcoCounter
@@ -71,7 +178,148 @@ func (c crawlerExec) exec(ctx context.Context, args []string) error {
 	var ht source.HalifaxTransit
 	crawler.AddGetter("hfxtransit", &ht)
 
-	return crawler.Run(ctx)
+	crawler.AddGetter("csvhttp", &source.HTTPTable{Format: "csv"})
+	crawler.AddGetter("jsonhttp", &source.HTTPTable{Format: "json"})
+
+	fg := &source.File{}
+	if st, ok := sub.(*dbStorage); ok {
+		// Files are recorded with the data read from them. Otherwise, such
+		// as for dry runs or a remote -submit-url, every file is read each
+		// time and only points after the latest stored are submitted.
+		fg.Log = st
+	}
+	crawler.AddGetter("file", fg)
+
+	crawler.AddGetter("exec", &source.Exec{Dir: *c.execDir, Timeout: *c.execTimeout})
+
+	if *c.interval <= 0 {
+		return c.crawl(ctx, crawler)
+	}
+	c.crawlEvery(ctx, crawler, *c.interval)
+	return nil
+}
+
+// crawl runs crawler once, then checks for anomalies if asked to.
+func (c crawlerExec) crawl(ctx context.Context, crawler *source.Crawler) error {
+	runErr := crawler.Run(ctx)
+	if !*c.checkAnomalies {
+		return runErr
+	}
+
+	// Check even if some gets failed, since failures are a common sign
+	// of counter trouble.
+	if err := c.runAnomalyCheck(ctx, crawler); err != nil {
+		return errors.Join(runErr, fmt.Errorf("checking anomalies: %w", err))
+	}
+	return runErr
+}
+
+// crawlEvery crawls straight away and then every interval until ctx is
+// done. Failed crawls are logged rather than stopping it. The directory is
+// reloaded before each crawl after the first, keeping the last one loaded
+// if that fails.
+func (c crawlerExec) crawlEvery(ctx context.Context, crawler *source.Crawler, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := c.crawl(ctx, crawler); err != nil {
+			slog.ErrorContext(ctx, "crawl failed", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if dir, err := c.getDirectory(ctx); err != nil {
+			slog.ErrorContext(ctx, "reloading directory, keeping the last one", "err", err)
+		} else {
+			crawler.Directory = dir
+		}
+	}
+}
+
+// dryRunSubmitter prints a summary of each Request instead of storing it,
+// and writes the Request to enc if set.
+type dryRunSubmitter struct {
+	w   io.Writer
+	enc *json.Encoder
+}
+
+func (d *dryRunSubmitter) Submit(ctx context.Context, req submit.Request) (submit.Result, error) {
+	if len(req.Points) == 0 {
+		fmt.Fprintf(d.w, "%s %s: no points\n", req.ID, req.DirectionID)
+	} else {
+		first, last := req.Points[0].Time, req.Points[0].Time
+		var sum float64
+		for _, pt := range req.Points {
+			first, last = min(first, pt.Time), max(last, pt.Time)
+			sum += pt.Value
+		}
+		fmt.Fprintf(d.w, "%s %s: %d points from %s to %s, sum %v\n", req.ID, req.DirectionID, len(req.Points),
+			time.Unix(first, 0).Format(time.RFC3339), time.Unix(last, 0).Format(time.RFC3339), sum)
+	}
+
+	if d.enc != nil {
+		if err := d.enc.Encode(req); err != nil {
+			return submit.Result{}, err
+		}
+	}
+
+	// Nothing was written.
+	return submit.Result{}, nil
+}
+
+// serveMetrics serves reg at /metrics on addr in the background. Calling
+// the returned func stops the server.
+func serveMetrics(ctx context.Context, addr string, reg *metrics.Registry) func() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", reg)
+	srv := &http.Server{
+		Handler: mux,
+		Addr:    addr,
+	}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("serving metrics", "addr", addr, "err", err)
+		}
+	}()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}
+}
+
+// runAnomalyCheck checks the counters crawler crawls.
+func (c crawlerExec) runAnomalyCheck(ctx context.Context, crawler *source.Crawler) error {
+	rules, err := loadRules(*c.anomalyRules)
+	if err != nil {
+		return err
+	}
+
+	counters, err := crawler.Directory.Counters(ctx)
+	if err != nil {
+		return err
+	}
+
+	end := time.Now()
+	req := anomaly.Request{Start: end.AddDate(0, 0, -*c.anomalyDays), End: end}
+	for _, ctr := range counters {
+		if (crawler.IncludeInactive || ctr.IsActive()) && crawler.Selector.Match(ctr) {
+			req.Selector.CounterIDs = append(req.Selector.CounterIDs, ctr.ID)
+		}
+	}
+	if len(req.Selector.CounterIDs) == 0 {
+		return nil
+	}
+
+	// exec made sure findings can be recorded with the submitted data.
+	st := crawler.Submitter.(*dbStorage)
+	return checkAnomalies(ctx, st, &query.Engine{Querier: crawler.Querier, Directory: crawler.Directory}, rules, req)
 }
 
 func (c crawlerExec) addEcoCounterPrivateDomains(eg *source.EcoCounter) {
@@ -84,7 +332,7 @@ func (c crawlerExec) addEcoCounterPrivateDomains(eg *source.EcoCounter) {
 
 		username, password, userID, domainID := os.Getenv(envUsername), os.Getenv(envPassword), os.Getenv(envUserID), os.Getenv(envDomainID)
 		if username == "" || password == "" || domainID == "" {
-			log.Printf("eco counter private domain %q missing env %s, %s, %s, or %s, skipping", d, envUsername, envPassword, envUserID, envDomainID)
+			slog.Warn("eco counter private domain missing env, skipping", "domain", d, "env", []string{envUsername, envPassword, envUserID, envDomainID})
 			continue
 		}
 
@@ -96,7 +344,7 @@ func (c crawlerExec) addEcoCounterPrivateDomains(eg *source.EcoCounter) {
 		dom.DomainID = domainID
 
 		if err := eg.AddPrivateDomain(dom); err != nil {
-			log.Printf("eco counter private domain %q not added: %s", dom.Name, err)
+			slog.Warn("eco counter private domain not added", "domain", dom.Name, "err", err)
 		}
 	}
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danp/counterbase/directory"
+	"github.com/danp/counterbase/internal/testutil"
+	"github.com/danp/counterbase/source"
+	"github.com/danp/counterbase/submit"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCrawlEvery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	counter := func(id string) directory.Counter {
+		return directory.Counter{
+			ID:            id,
+			ServiceRanges: []directory.ServiceRange{{Start: directory.SD(time.Now().Add(-5 * time.Hour))}},
+			Directions:    []directory.Direction{{ID: "nb", Source: directory.Source{URL: "test:" + id}}},
+		}
+	}
+
+	// The first reload fails, so the first directory is kept. The second
+	// adds a counter.
+	var reloads atomic.Int64
+	ce := crawlerExec{
+		getDirectory: func(ctx context.Context) (source.Directory, error) {
+			if reloads.Add(1) == 1 {
+				return nil, errors.New("directory unavailable")
+			}
+			return testutil.Directory{C: []directory.Counter{counter("a"), counter("b")}}, nil
+		},
+		checkAnomalies: new(bool),
+	}
+
+	sub := &recordingSubmitter{}
+	sub.fn = func(req submit.Request) {
+		if req.ID == "b" {
+			cancel()
+		}
+	}
+	crawler := &source.Crawler{
+		Directory: testutil.Directory{C: []directory.Counter{counter("a")}},
+		Querier:   testutil.DataQuerier{},
+		Submitter: sub,
+	}
+
+	// The first get fails, which shouldn't stop later crawls.
+	var gets atomic.Int64
+	crawler.AddGetter("test", getterFunc(func(ctx context.Context, req source.GetRequest) ([]submit.Point, error) {
+		if gets.Add(1) == 1 {
+			return nil, errors.New("source unavailable")
+		}
+		return []submit.Point{{Time: time.Now().Unix(), Resolution: submit.ResolutionHour, Value: 1}}, nil
+	}))
+
+	ce.crawlEvery(ctx, crawler, time.Millisecond)
+	if !errors.Is(context.Cause(ctx), context.Canceled) {
+		t.Fatalf("crawling stopped with %v, want it canceled after crawling b", context.Cause(ctx))
+	}
+
+	// a's get fails on the first crawl, a is crawled again with the
+	// directory kept after the failed reload, then a and b are crawled.
+	want := []string{"a", "a", "b"}
+	if d := cmp.Diff(want, sub.ids); d != "" {
+		t.Errorf("submitted counters mismatch (-want +got):\n%s", d)
+	}
+}
+
+type recordingSubmitter struct {
+	ids []string
+	fn  func(submit.Request)
+}
+
+func (s *recordingSubmitter) Submit(ctx context.Context, req submit.Request) (submit.Result, error) {
+	s.ids = append(s.ids, req.ID)
+	s.fn(req)
+	return submit.Result{Inserted: len(req.Points)}, nil
+}
+
+type getterFunc func(ctx context.Context, req source.GetRequest) ([]submit.Point, error)
+
+func (f getterFunc) Get(ctx context.Context, req source.GetRequest) ([]submit.Point, error) {
+	return f(ctx, req)
+}
+
+func TestDryRunSubmitter(t *testing.T) {
+	ctx := context.Background()
+
+	var out, file bytes.Buffer
+	ds := &dryRunSubmitter{w: &out, enc: json.NewEncoder(&file)}
+
+	reqs := []submit.Request{
+		{
+			ID:          "a",
+			DirectionID: "nb",
+			Points: []submit.Point{
+				{Time: 7200, Resolution: submit.ResolutionHour, Value: 2},
+				{Time: 3600, Resolution: submit.ResolutionHour, Value: 1.5},
+				{Time: 10800, Resolution: submit.ResolutionHour, Value: 4},
+			},
+		},
+		{ID: "b", DirectionID: "sb"},
+	}
+	for _, req := range reqs {
+		res, err := ds.Submit(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := cmp.Diff(submit.Result{}, res); d != "" {
+			t.Errorf("result mismatch (-want +got):\n%s", d)
+		}
+	}
+
+	ts := func(n int64) string { return time.Unix(n, 0).Format(time.RFC3339) }
+	want := "a nb: 3 points from " + ts(3600) + " to " + ts(10800) + ", sum 7.5\n" +
+		"b sb: no points\n"
+	if d := cmp.Diff(want, out.String()); d != "" {
+		t.Errorf("summary mismatch (-want +got):\n%s", d)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(file.String(), "\n"), "\n")
+	var got []submit.Request
+	for _, l := range lines {
+		var req submit.Request
+		if err := json.Unmarshal([]byte(l), &req); err != nil {
+			t.Fatalf("bad line %q: %v", l, err)
+		}
+		got = append(got, req)
+	}
+	if d := cmp.Diff(reqs, got); d != "" {
+		t.Errorf("written requests mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestDryRunSubmitterNoFile(t *testing.T) {
+	var out bytes.Buffer
+	ds := &dryRunSubmitter{w: &out}
+
+	if _, err := ds.Submit(context.Background(), submit.Request{ID: "a", DirectionID: "nb"}); err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff("a nb: no points\n", out.String()); d != "" {
+		t.Errorf("summary mismatch (-want +got):\n%s", d)
+	}
+}
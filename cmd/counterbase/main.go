@@ -4,15 +4,17 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/danp/counterbase/anomaly"
 	"github.com/danp/counterbase/directory"
 	"github.com/danp/counterbase/query"
 	"github.com/danp/counterbase/source"
@@ -24,6 +26,8 @@ import (
 func main() {
 	var (
 		rootFlagSet = flag.NewFlagSet("counterbase", flag.ExitOnError)
+		logFormat   = rootFlagSet.String("log-format", "text", "log output format: text or json")
+		logLevel    = rootFlagSet.String("log-level", "info", "minimum level to log: debug, info, warn, or error")
 	)
 
 	dbg := databaseGetter{
@@ -41,17 +45,25 @@ func main() {
 	qg := queryGetter{}
 
 	var (
-		apiCmd      = newAPICmd(stg.get)
-		crawlerCmd  = dg.addFlags(sg.addFlags(qg.addFlags(newCrawlerCmd(dg.get, sg.get, qg.get))))
-		discoverCmd = newDiscoverCmd()
+		anomaliesCmd = newAnomaliesCmd(stg.get, dg.get, qg.get, func(cmd *ffcli.Command) *ffcli.Command { return dg.addFlags(qg.addFlags(cmd)) })
+		apiCmd       = dg.addFlags(newAPICmd(stg.get, dg.get))
+		coverageCmd  = dg.addFlags(qg.addFlags(newCoverageCmd(stg.get, dg.get, qg.get)))
+		crawlerCmd   = dg.addFlags(sg.addFlags(qg.addFlags(newCrawlerCmd(dg.get, sg.get, qg.get))))
+		discoverCmd  = newDiscoverCmd()
+		queryCmd     = dg.addFlags(qg.addFlags(newQueryCmd(stg.get, dg.get, qg.get)))
+		tokenCmd     = newTokenCmd(stg.get)
 	)
 
 	root := &ffcli.Command{
 		ShortUsage: "counterbase [flags] <subcommand>",
 		Subcommands: []*ffcli.Command{
+			anomaliesCmd,
 			apiCmd,
+			coverageCmd,
 			crawlerCmd,
 			discoverCmd,
+			queryCmd,
+			tokenCmd,
 		},
 		FlagSet: rootFlagSet,
 		Exec: func(context.Context, []string) error {
@@ -59,7 +71,14 @@ func main() {
 		},
 	}
 
-	if err := root.ParseAndRun(context.Background(), os.Args[1:]); err != nil {
+	err := root.Parse(os.Args[1:])
+	if err == nil {
+		err = setupLogging(*logFormat, *logLevel)
+	}
+	if err == nil {
+		err = root.Run(context.Background())
+	}
+	if err != nil {
 		if err != flag.ErrHelp {
 			fmt.Fprintln(os.Stderr, err)
 		}
@@ -67,12 +86,42 @@ func main() {
 	}
 }
 
+// setupLogging sets the default slog logger, which the standard log
+// package also writes through, to write to stderr.
+func setupLogging(format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("bad -log-level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("bad -log-format %q", format)
+	}
+
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
 type commaSeparatedString struct {
 	vals []string
 }
 
+// Set sets the values to the comma-separated elements of s, ignoring empty
+// ones so a blank s gives no values.
 func (c *commaSeparatedString) Set(s string) error {
-	c.vals = strings.Split(s, ",")
+	c.vals = nil
+	for _, v := range strings.Split(s, ",") {
+		if v != "" {
+			c.vals = append(c.vals, v)
+		}
+	}
 	return nil
 }
 
@@ -102,23 +151,30 @@ func (s storageGetter) get(ctx context.Context) (*dbStorage, error) {
 	return st, st.init(ctx)
 }
 
+// errNoDirectoryURL is returned by directoryGetter.get when -directory-url
+// isn't set, for commands where the directory is optional.
+var errNoDirectoryURL = errors.New("need -directory-url")
+
+// Getters may add their flags to several commands. Only one command runs,
+// so its flags all set the same fields.
+
 type directoryGetter struct {
-	directoryURL *string
+	directoryURL string
 }
 
 func (g *directoryGetter) addFlags(cmd *ffcli.Command) *ffcli.Command {
-	g.directoryURL = cmd.FlagSet.String("directory-url", "", "directory URL")
+	cmd.FlagSet.StringVar(&g.directoryURL, "directory-url", "", "directory URL")
 	return cmd
 }
 
 func (g *directoryGetter) get(ctx context.Context) (source.Directory, error) {
 	var counters []directory.Counter
 
-	if g.directoryURL == nil || *g.directoryURL == "" {
-		return nil, fmt.Errorf("need -directory-url")
+	if g.directoryURL == "" {
+		return nil, errNoDirectoryURL
 	}
 
-	u, err := url.Parse(*g.directoryURL)
+	u, err := url.Parse(g.directoryURL)
 	if err != nil {
 		return nil, fmt.Errorf("parsing -directory-url: %w", err)
 	}
@@ -157,19 +213,21 @@ func (g *directoryGetter) get(ctx context.Context) (source.Directory, error) {
 		return nil, fmt.Errorf("-directory-url: unsupported scheme %q", u.Scheme)
 	}
 
-	log.Println("loaded", len(counters), "counters from", src)
+	slog.InfoContext(ctx, "loaded directory", "counters", len(counters), "source", src)
 
 	dir := fakeDirectory{C: counters}
 	return dir, nil
 }
 
 type submitGetter struct {
-	submitURL *string
-	stg       func(ctx context.Context) (*dbStorage, error)
+	submitURL   *string
+	submitToken *string
+	stg         func(ctx context.Context) (*dbStorage, error)
 }
 
 func (q *submitGetter) addFlags(cmd *ffcli.Command) *ffcli.Command {
 	q.submitURL = cmd.FlagSet.String("submit-url", "", "submit endpoint URL")
+	q.submitToken = cmd.FlagSet.String("submit-token", "", "bearer token for http(s) -submit-url")
 	return cmd
 }
 
@@ -186,7 +244,8 @@ func (q *submitGetter) get(ctx context.Context) (submit.Submitter, error) {
 	switch su.Scheme {
 	case "http", "https":
 		cl := &submit.Client{
-			URL: *q.submitURL,
+			URL:   *q.submitURL,
+			Token: *q.submitToken,
 		}
 		return cl, nil
 	case "sqlite":
@@ -196,24 +255,30 @@ func (q *submitGetter) get(ctx context.Context) (submit.Submitter, error) {
 	return nil, fmt.Errorf("bad -submit-url")
 }
 
+// errNoQueryURL is returned by queryGetter.get when -query-url isn't set.
+var errNoQueryURL = errors.New("need -query-url")
+
 type queryGetter struct {
-	queryURL *string
+	queryURL     string
+	queryTimeout time.Duration
 }
 
 func (q *queryGetter) addFlags(cmd *ffcli.Command) *ffcli.Command {
-	q.queryURL = cmd.FlagSet.String("query-url", "", "query endpoint URL")
+	cmd.FlagSet.StringVar(&q.queryURL, "query-url", "", "query endpoint URL")
+	cmd.FlagSet.DurationVar(&q.queryTimeout, "query-timeout", 30*time.Second, "timeout for each -query-url request")
 	return cmd
 }
 
 func (q *queryGetter) get(ctx context.Context) (source.Querier, error) {
-	if q.queryURL != nil && *q.queryURL != "" {
+	if q.queryURL != "" {
 		cl := &query.Client{
-			URL: *q.queryURL,
+			URL:        q.queryURL,
+			HTTPClient: &http.Client{Timeout: q.queryTimeout},
 		}
 		return cl, nil
 	}
 
-	return nil, fmt.Errorf("need -query-url")
+	return nil, errNoQueryURL
 }
 
 type fakeDirectory struct {
@@ -229,7 +294,7 @@ type dbStorage struct {
 }
 
 func (s dbStorage) init(ctx context.Context) error {
-	_, err := s.db.ExecContext(ctx, "create table if not exists counter_data (counter_id text not null, direction_id text not null, time integer not null, resolution integer not null, value numeric not null, primary key(counter_id, direction_id, time)); create view if not exists latest_counter_data as with latest_times as (select counter_id, direction_id, max(time) as time from counter_data group by 1, 2) select counter_data.* from counter_data, latest_times where counter_data.counter_id=latest_times.counter_id and counter_data.direction_id=latest_times.direction_id and counter_data.time=latest_times.time")
+	_, err := s.db.ExecContext(ctx, "create table if not exists api_tokens (hash text not null primary key, name text not null, counters text not null, tags text not null); create table if not exists ingested_files (source text not null, path text not null, size integer not null, mod_time integer not null, sha256 text not null, ingested_at integer not null, primary key(source, path)); create table if not exists anomaly_findings (id integer primary key, counter_id text not null, direction_id text not null, rule text not null, start integer not null, end integer not null, message text not null, status text not null, unique(counter_id, direction_id, rule, start)); create table if not exists counter_data (counter_id text not null, direction_id text not null, time integer not null, resolution integer not null, value numeric not null, primary key(counter_id, direction_id, time)); create view if not exists latest_counter_data as with latest_times as (select counter_id, direction_id, max(time) as time from counter_data group by 1, 2) select counter_data.* from counter_data, latest_times where counter_data.counter_id=latest_times.counter_id and counter_data.direction_id=latest_times.direction_id and counter_data.time=latest_times.time")
 	return err
 }
 
@@ -246,55 +311,267 @@ func (s dbStorage) Query(ctx context.Context, q string) ([]query.Point, error) {
 	}
 	defer rows.Close()
 
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
 	var pts []query.Point
 	for rows.Next() {
 		var p query.Point
-		var t int64
-		if err := rows.Scan(&t, &p.Value); err != nil {
+		var t, res int64
+		dest := []any{&t, &p.Value}
+		if len(cols) > 2 {
+			dest = append(dest, &res)
+		}
+		if err := rows.Scan(dest...); err != nil {
 			return nil, err
 		}
 		p.Time = time.Unix(t, 0)
+		p.Resolution = query.StoredResolution(res)
 		pts = append(pts, p)
 	}
 
 	return pts, rows.Err()
 }
 
-func (s dbStorage) Submit(ctx context.Context, req submit.Request) error {
+func (s dbStorage) Submit(ctx context.Context, req submit.Request) (submit.Result, error) {
+	res, err := s.SubmitBatch(ctx, []submit.Request{req})
+	if err != nil {
+		return submit.Result{}, err
+	}
+	return res[0], nil
+}
+
+// SubmitBatch stores reqs in a single transaction.
+func (s dbStorage) SubmitBatch(ctx context.Context, reqs []submit.Request) ([]submit.Result, error) {
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tx.Rollback()
 
+	results := make([]submit.Result, 0, len(reqs))
+	sums := make([]int, 0, len(reqs))
+	for _, req := range reqs {
+		res, sum, err := s.submitTx(ctx, tx, req)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+		sums = append(sums, sum)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	for i, req := range reqs {
+		res := results[i]
+		if pl := len(req.Points); pl > 0 {
+			slog.InfoContext(ctx, "submitted",
+				"counter_id", req.ID, "direction_id", req.DirectionID, "points", pl,
+				"inserted", res.Inserted, "updated", res.Updated, "unchanged", res.Unchanged, "rejected", res.Rejected,
+				"start", res.Start, "end", res.End, "sum", sums[i])
+		}
+	}
+
+	return results, nil
+}
+
+func (s dbStorage) submitTx(ctx context.Context, tx *sql.Tx, req submit.Request) (submit.Result, int, error) {
+	var res submit.Result
 	var sum int
-	var tmin, tmax int64
 	for _, pt := range req.Points {
+		existing := submit.Point{Time: pt.Time}
+		err := tx.QueryRowContext(ctx, "select resolution, value from counter_data where counter_id=? and direction_id=? and time=?",
+			req.ID, req.DirectionID, pt.Time,
+		).Scan(&existing.Resolution, &existing.Value)
+
+		outcome := submit.OutcomeInserted
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+		case err != nil:
+			return submit.Result{}, 0, fmt.Errorf("checking counter %q direction %q pt %v: %w", req.ID, req.DirectionID, pt, err)
+		default:
+			pt, outcome = req.Conflict.Apply(existing, pt)
+		}
+		res.Add(pt, outcome)
+
+		if outcome != submit.OutcomeInserted && outcome != submit.OutcomeUpdated {
+			continue
+		}
+
 		if _, err := tx.ExecContext(ctx, "replace into counter_data (counter_id, direction_id, time, resolution, value) values (?, ?, ?, ?, ?)",
 			req.ID, req.DirectionID, pt.Time, pt.Resolution, pt.Value,
 		); err != nil {
-			return fmt.Errorf("adding counter %q direction %q pt %v: %w", req.ID, req.DirectionID, pt, err)
+			return submit.Result{}, 0, fmt.Errorf("adding counter %q direction %q pt %v: %w", req.ID, req.DirectionID, pt, err)
 		}
 		sum += int(pt.Value)
-		if tmin == 0 || pt.Time < tmin {
-			tmin = pt.Time
+	}
+	return res, sum, nil
+}
+
+func (s dbStorage) LookupToken(ctx context.Context, hash string) (submit.Token, error) {
+	tok := submit.Token{Hash: hash}
+	var counters, tags string
+	err := s.db.QueryRowContext(ctx, "select name, counters, tags from api_tokens where hash=?", hash).Scan(&tok.Name, &counters, &tags)
+	if errors.Is(err, sql.ErrNoRows) {
+		return submit.Token{}, submit.ErrUnknownToken
+	}
+	if err != nil {
+		return submit.Token{}, err
+	}
+
+	if err := json.Unmarshal([]byte(counters), &tok.Counters); err != nil {
+		return submit.Token{}, fmt.Errorf("decoding counters for token %q: %w", tok.Name, err)
+	}
+	if err := json.Unmarshal([]byte(tags), &tok.Tags); err != nil {
+		return submit.Token{}, fmt.Errorf("decoding tags for token %q: %w", tok.Name, err)
+	}
+	return tok, nil
+}
+
+// Tokens returns all stored tokens.
+func (s dbStorage) Tokens(ctx context.Context) ([]submit.Token, error) {
+	rows, err := s.db.QueryContext(ctx, "select hash from api_tokens order by name")
+	if err != nil {
+		return nil, err
+	}
+	var hashes []string
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			rows.Close()
+			return nil, err
 		}
-		if pt.Time > tmax {
-			tmax = pt.Time
+		hashes = append(hashes, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var out []submit.Token
+	for _, h := range hashes {
+		tok, err := s.LookupToken(ctx, h)
+		if err != nil {
+			return nil, err
 		}
+		out = append(out, tok)
 	}
+	return out, nil
+}
 
-	if err := tx.Commit(); err != nil {
+func (s dbStorage) AddToken(ctx context.Context, tok submit.Token) error {
+	counters, err := json.Marshal(tok.Counters)
+	if err != nil {
 		return err
 	}
+	tags, err := json.Marshal(tok.Tags)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, "insert into api_tokens (hash, name, counters, tags) values (?, ?, ?, ?)", tok.Hash, tok.Name, string(counters), string(tags))
+	return err
+}
+
+// AddFindings records fs. Open findings already recorded with the same
+// counter, direction, rule and start are updated, such as when a run of
+// zeros gets longer. It returns fs with the ID and Status of each as
+// recorded.
+func (s dbStorage) AddFindings(ctx context.Context, fs []anomaly.Finding) ([]anomaly.Finding, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	out := make([]anomaly.Finding, 0, len(fs))
+	for _, f := range fs {
+		if _, err := tx.ExecContext(ctx, "insert into anomaly_findings (counter_id, direction_id, rule, start, end, message, status) values (?, ?, ?, ?, ?, ?, ?) on conflict (counter_id, direction_id, rule, start) do update set end=excluded.end, message=excluded.message where status=?",
+			f.CounterID, f.DirectionID, f.Rule, f.Start.Unix(), f.End.Unix(), f.Message, anomaly.StatusOpen, anomaly.StatusOpen,
+		); err != nil {
+			return nil, fmt.Errorf("adding finding for counter %q direction %q: %w", f.CounterID, f.DirectionID, err)
+		}
+
+		if err := tx.QueryRowContext(ctx, "select id, status from anomaly_findings where counter_id=? and direction_id=? and rule=? and start=?",
+			f.CounterID, f.DirectionID, f.Rule, f.Start.Unix(),
+		).Scan(&f.ID, &f.Status); err != nil {
+			return nil, fmt.Errorf("getting finding for counter %q direction %q: %w", f.CounterID, f.DirectionID, err)
+		}
+		out = append(out, f)
+	}
 
-	if pl := len(req.Points); pl > 0 {
-		log.Println(req.ID, req.DirectionID, "added", pl, "points for range", tmin, tmax, "with sum", sum)
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Findings returns recorded findings with the given status, or all
+// findings if status is blank, oldest first.
+func (s dbStorage) Findings(ctx context.Context, status anomaly.Status) ([]anomaly.Finding, error) {
+	rows, err := s.db.QueryContext(ctx, "select id, status, counter_id, direction_id, rule, start, end, message from anomaly_findings where ?='' or status=? order by start, id", status, status)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
+	var fs []anomaly.Finding
+	for rows.Next() {
+		var f anomaly.Finding
+		var start, end int64
+		if err := rows.Scan(&f.ID, &f.Status, &f.CounterID, &f.DirectionID, &f.Rule, &start, &end, &f.Message); err != nil {
+			return nil, err
+		}
+		f.Start, f.End = time.Unix(start, 0), time.Unix(end, 0)
+		fs = append(fs, f)
+	}
+	return fs, rows.Err()
+}
+
+func (s dbStorage) SetFindingStatus(ctx context.Context, id int64, status anomaly.Status) error {
+	res, err := s.db.ExecContext(ctx, "update anomaly_findings set status=? where id=?", status, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("no finding %d", id)
+	}
 	return nil
 }
 
+func (s dbStorage) IngestedFile(ctx context.Context, src, path string) (source.IngestedFile, bool, error) {
+	f := source.IngestedFile{Source: src, Path: path}
+	var modTime, ingestedAt int64
+	err := s.db.QueryRowContext(ctx, "select size, mod_time, sha256, ingested_at from ingested_files where source=? and path=?", src, path).Scan(&f.Size, &modTime, &f.SHA256, &ingestedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return source.IngestedFile{}, false, nil
+	}
+	if err != nil {
+		return source.IngestedFile{}, false, err
+	}
+	f.ModTime, f.IngestedAt = time.Unix(modTime, 0), time.Unix(ingestedAt, 0)
+	return f, true, nil
+}
+
+func (s dbStorage) AddIngestedFile(ctx context.Context, f source.IngestedFile) error {
+	_, err := s.db.ExecContext(ctx, "insert or replace into ingested_files (source, path, size, mod_time, sha256, ingested_at) values (?, ?, ?, ?, ?, ?)",
+		f.Source, f.Path, f.Size, f.ModTime.Unix(), f.SHA256, f.IngestedAt.Unix())
+	return err
+}
+
+// Size returns the size of the database in bytes.
+func (s dbStorage) Size(ctx context.Context) (int64, error) {
+	var n int64
+	err := s.db.QueryRowContext(ctx, "select page_count * page_size from pragma_page_count(), pragma_page_size()").Scan(&n)
+	return n, err
+}
+
 func (s dbStorage) Close() error {
 	return s.db.Close()
 }
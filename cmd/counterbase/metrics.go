@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/danp/counterbase/metrics"
+	"github.com/danp/counterbase/submit"
+)
+
+// submitMetrics are recorded by the api command for submit requests.
+type submitMetrics struct {
+	requests      *metrics.Counter
+	duration      *metrics.Histogram
+	pointsWritten *metrics.Counter
+}
+
+func newSubmitMetrics(r *metrics.Registry) *submitMetrics {
+	return &submitMetrics{
+		requests:      r.Counter("counterbase_submit_requests", "Submit requests handled, by path and status code.", "path", "code"),
+		duration:      r.Histogram("counterbase_submit_request_duration_seconds", "Time taken to handle submit requests, by path.", nil, "path"),
+		pointsWritten: r.Counter("counterbase_submit_points_written", "Points inserted or updated by submit requests."),
+	}
+}
+
+// instrument wraps h, recording requests to path in m.
+func (m *submitMetrics) instrument(path string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		m.duration.Observe(time.Since(start).Seconds(), path)
+		m.requests.Inc(path, strconv.Itoa(sw.status))
+	})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// meteredStorage counts points written through it. It keeps the
+// SubmitBatch of dbStorage so bulk submissions still use transactions.
+type meteredStorage struct {
+	*dbStorage
+	pointsWritten *metrics.Counter
+}
+
+func (s meteredStorage) Submit(ctx context.Context, req submit.Request) (submit.Result, error) {
+	res, err := s.dbStorage.Submit(ctx, req)
+	if err == nil {
+		s.pointsWritten.Add(float64(res.Written()))
+	}
+	return res, err
+}
+
+func (s meteredStorage) SubmitBatch(ctx context.Context, reqs []submit.Request) ([]submit.Result, error) {
+	results, err := s.dbStorage.SubmitBatch(ctx, reqs)
+	if err == nil {
+		for _, res := range results {
+			s.pointsWritten.Add(float64(res.Written()))
+		}
+	}
+	return results, err
+}
+
+// registerDatabaseSize adds a gauge of the size of st's database to r.
+func registerDatabaseSize(r *metrics.Registry, st *dbStorage) {
+	r.GaugeFunc("counterbase_database_size_bytes", "Size of the local database.", func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		n, err := st.Size(ctx)
+		if err != nil {
+			slog.Error("getting database size", "err", err)
+			return 0
+		}
+		return float64(n)
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/danp/counterbase/query"
+	"github.com/danp/counterbase/source"
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+type queryExec struct {
+	getStorage   func(ctx context.Context) (*dbStorage, error)
+	getDirectory func(ctx context.Context) (source.Directory, error)
+	getQuerier   func(ctx context.Context) (source.Querier, error)
+
+	counters    *commaSeparatedString
+	tags        *commaSeparatedString
+	modes       *commaSeparatedString
+	direction   *string
+	byDirection *bool
+	combine     *bool
+	start       *string
+	end         *string
+	resolution  *string
+	window      *int
+	windowFunc  *string
+	windowMin   *int
+	format      *string
+}
+
+func newQueryCmd(gs func(ctx context.Context) (*dbStorage, error), gd func(ctx context.Context) (source.Directory, error), gq func(ctx context.Context) (source.Querier, error)) *ffcli.Command {
+	var (
+		fs          = flag.NewFlagSet("counterbase query", flag.ExitOnError)
+		counters    commaSeparatedString
+		tags        commaSeparatedString
+		modes       commaSeparatedString
+		direction   = fs.String("direction", "", "direction ID, requires a single -counter")
+		byDirection = fs.Bool("by-direction", false, "output each direction separately")
+		combine     = fs.Bool("combine", false, "output the total of all selected counters")
+		start       = fs.String("start", "", "start time, inclusive: YYYY-MM-DD in the counter's zone, RFC 3339, or Unix seconds")
+		end         = fs.String("end", "", "end time, exclusive: YYYY-MM-DD in the counter's zone, RFC 3339, or Unix seconds")
+		resolution  = fs.String("resolution", "", "aggregate to minute, hour, day, week, month, or year, default as stored")
+		window      = fs.Int("window", 0, "rolling window size in periods of -resolution, such as 7 with day")
+		windowFunc  = fs.String("window-func", "mean", "rolling window function: sum, mean, or median")
+		windowMin   = fs.Int("window-min", 0, "periods with data needed in each window, default all of them")
+		format      = fs.String("format", "csv", "output format: csv, ndjson, or json")
+	)
+	fs.Var(&counters, "counter", "comma-separated counter IDs")
+	fs.Var(&tags, "tag", "comma-separated tags, requires -directory-url")
+	fs.Var(&modes, "mode", "comma-separated modes, requires -directory-url")
+
+	qe := &queryExec{
+		getStorage:   gs,
+		getDirectory: gd,
+		getQuerier:   gq,
+		counters:     &counters,
+		tags:         &tags,
+		modes:        &modes,
+		direction:    direction,
+		byDirection:  byDirection,
+		combine:      combine,
+		start:        start,
+		end:          end,
+		resolution:   resolution,
+		window:       window,
+		windowFunc:   windowFunc,
+		windowMin:    windowMin,
+		format:       format,
+	}
+
+	return &ffcli.Command{
+		Name:       "query",
+		ShortUsage: "counterbase query [-counter <ids>] [-tag <tags>] [-mode <modes>] [flags]",
+		ShortHelp:  "query counter data",
+		FlagSet:    fs,
+		Exec:       qe.exec,
+	}
+}
+
+func (q queryExec) exec(ctx context.Context, args []string) error {
+	f, err := query.ParseFormat(*q.format)
+	if err != nil {
+		return err
+	}
+
+	eng, closeEngine, err := newEngine(ctx, q.getStorage, q.getDirectory, q.getQuerier)
+	if err != nil {
+		return err
+	}
+	defer closeEngine()
+
+	req := query.GroupRequest{
+		Selector: query.Selector{
+			CounterIDs: q.counters.vals,
+			Tags:       q.tags.vals,
+			Modes:      q.modes.vals,
+		},
+		ByDirection: *q.byDirection,
+		Combine:     *q.combine,
+	}
+	if *q.window > 0 {
+		req.Window = query.Window{Size: *q.window, Func: query.WindowFunc(*q.windowFunc), MinPeriods: *q.windowMin}
+	}
+
+	if *q.resolution != "" {
+		if req.Resolution, err = query.ParseResolution(*q.resolution); err != nil {
+			return err
+		}
+	}
+
+	counters, err := eng.SelectCounters(ctx, req.Selector)
+	if err != nil {
+		return err
+	}
+	if len(counters) == 0 {
+		return fmt.Errorf("no counters selected")
+	}
+
+	loc, err := counters[0].TimeZone()
+	if err != nil {
+		return err
+	}
+	if req.Start, err = query.ParseTime(*q.start, loc); err != nil {
+		return fmt.Errorf("bad -start: %w", err)
+	}
+	if req.End, err = query.ParseTime(*q.end, loc); err != nil {
+		return fmt.Errorf("bad -end: %w", err)
+	}
+
+	rw := query.NewRowWriter(os.Stdout, f)
+
+	if *q.direction != "" {
+		if len(counters) != 1 || req.ByDirection || req.Combine {
+			return fmt.Errorf("-direction needs a single -counter and can't be used with -by-direction or -combine")
+		}
+
+		err := eng.StreamSeries(ctx, query.Request{
+			CounterID:   counters[0].ID,
+			DirectionID: *q.direction,
+			Start:       req.Start,
+			End:         req.End,
+			Resolution:  req.Resolution,
+			Window:      req.Window,
+		}, rw.WriteSeries)
+		if err != nil {
+			rw.Abort(err)
+			return err
+		}
+		return rw.Close()
+	}
+
+	if err := eng.EachSeries(ctx, req, rw.WriteSeries); err != nil {
+		rw.Abort(err)
+		return err
+	}
+	return rw.Close()
+}
+
+// newEngine returns a query.Engine using the directory if -directory-url is
+// set, and -query-url if set or the local database otherwise. The returned
+// func closes the database, if one was opened.
+func newEngine(ctx context.Context, gs func(ctx context.Context) (*dbStorage, error), gd func(ctx context.Context) (source.Directory, error), gq func(ctx context.Context) (source.Querier, error)) (*query.Engine, func() error, error) {
+	eng := &query.Engine{}
+
+	dir, err := gd(ctx)
+	if err != nil && !errors.Is(err, errNoDirectoryURL) {
+		return nil, nil, err
+	}
+	if err == nil {
+		eng.Directory = dir
+	}
+
+	qr, err := gq(ctx)
+	switch {
+	case errors.Is(err, errNoQueryURL):
+		st, err := gs(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		eng.Querier = st
+		return eng, st.Close, nil
+	case err != nil:
+		return nil, nil, err
+	}
+	eng.Querier = qr
+	return eng, func() error { return nil }, nil
+}
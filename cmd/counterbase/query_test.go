@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danp/counterbase/directory"
+	"github.com/danp/counterbase/submit"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestQueryLocalAndRemote(t *testing.T) {
+	ctx := context.Background()
+	dbFile := filepath.Join(t.TempDir(), "data.db")
+
+	st, err := storageGetter{getDB: databaseGetter{file: dbFile}.get}.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// More hourly rows than fit in a page, so both backends page.
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, loc)
+	var reqs []submit.Request
+	for _, cd := range []struct{ id, dir string }{{"a", "nb"}, {"a", "sb"}, {"b", "nb"}} {
+		req := submit.Request{ID: cd.id, DirectionID: cd.dir}
+		for h := 0; h < 24*30; h++ {
+			if cd.id == "b" && h/24 == 10 {
+				continue
+			}
+			tm := start.Add(time.Duration(h) * time.Hour)
+			req.Points = append(req.Points, submit.Point{Time: tm.Unix(), Resolution: submit.ResolutionHour, Value: float64(h%5 + len(cd.dir))})
+		}
+		reqs = append(reqs, req)
+	}
+	if _, err := st.SubmitBatch(ctx, reqs); err != nil {
+		t.Fatal(err)
+	}
+
+	counters := []directory.Counter{
+		{ID: "a", Mode: "cycling", Zone: "America/Halifax", Directions: []directory.Direction{{ID: "nb"}, {ID: "sb"}}},
+		{ID: "b", Mode: "cycling", Zone: "America/Halifax", Directions: []directory.Direction{{ID: "nb"}}},
+	}
+	dirFile := filepath.Join(t.TempDir(), "directory.json")
+	b, err := json.Marshal(counters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dirFile, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var remoteQueries atomic.Int64
+	ds := datasetteHandler(st.db)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteQueries.Add(1)
+		ds.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	cases := [][]string{
+		{"-counter", "a", "-direction", "sb", "-end", "2021-06-03"},
+		{"-counter", "a,b", "-resolution", "day"},
+		{"-mode", "cycling", "-by-direction", "-resolution", "week", "-format", "ndjson"},
+		{"-counter", "a,b", "-combine", "-resolution", "day", "-start", "2021-06-05", "-window", "3", "-window-func", "median", "-format", "json"},
+	}
+
+	for _, args := range cases {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			args = append([]string{"-directory-url", "file://" + dirFile}, args...)
+
+			local := runQueryCmd(t, dbFile, args)
+			before := remoteQueries.Load()
+			remote := runQueryCmd(t, dbFile, append([]string{"-query-url", srv.URL + "/data.json"}, args...))
+			if remoteQueries.Load() == before {
+				t.Fatal("no queries made to -query-url")
+			}
+
+			if n := strings.Count(local, "2021-06"); n < 4 {
+				t.Fatalf("got %d times in output, want more:\n%s", n, local)
+			}
+			if d := cmp.Diff(local, remote); d != "" {
+				t.Errorf("local and remote output differ (-local +remote):\n%s", d)
+			}
+		})
+	}
+}
+
+// runQueryCmd runs the query command with args, using dbFile as the local
+// database, and returns what it wrote to stdout.
+func runQueryCmd(t *testing.T, dbFile string, args []string) string {
+	t.Helper()
+
+	dg := directoryGetter{}
+	qg := queryGetter{}
+	stg := storageGetter{getDB: databaseGetter{file: dbFile}.get}
+	cmd := dg.addFlags(qg.addFlags(newQueryCmd(stg.get, dg.get, qg.get)))
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	stdout := os.Stdout
+	os.Stdout = out
+	err = cmd.ParseAndRun(context.Background(), args)
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// datasetteHandler answers sql queries against db as Datasette's JSON
+// endpoint does.
+func datasetteHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.QueryContext(r.Context(), r.URL.Query().Get("sql"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		cols, err := rows.Columns()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		res := struct {
+			Columns   []string `json:"columns"`
+			Rows      [][]any  `json:"rows"`
+			Truncated bool     `json:"truncated"`
+		}{Columns: cols, Rows: [][]any{}}
+		for rows.Next() {
+			vals := make([]any, len(cols))
+			dest := make([]any, len(cols))
+			for i := range vals {
+				dest[i] = &vals[i]
+			}
+			if err := rows.Scan(dest...); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res.Rows = append(res.Rows, vals)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(res)
+	})
+}
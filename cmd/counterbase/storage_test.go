@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danp/counterbase/anomaly"
+	"github.com/danp/counterbase/source"
+	"github.com/danp/counterbase/submit"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStorageSubmit(t *testing.T) {
+	ctx := context.Background()
+	st := newTestStorage(t)
+
+	// Each policy gets its own counter, holding 5 at times 100, 200 and
+	// 300. The submission raises the value at 100, lowers it at 200, repeats
+	// it at 300 and adds a point at 400.
+	incoming := []submit.Point{
+		{Time: 100, Resolution: submit.ResolutionHour, Value: 7},
+		{Time: 200, Resolution: submit.ResolutionHour, Value: 3},
+		{Time: 300, Resolution: submit.ResolutionHour, Value: 5},
+		{Time: 400, Resolution: submit.ResolutionHour, Value: 1},
+	}
+
+	cases := []struct {
+		policy submit.ConflictPolicy
+		want   submit.Result
+		stored map[int64]float64
+	}{
+		{
+			policy: "",
+			want:   submit.Result{Inserted: 1, Updated: 2, Unchanged: 1, Start: 100, End: 400},
+			stored: map[int64]float64{100: 7, 200: 3, 300: 5, 400: 1},
+		},
+		{
+			policy: submit.ConflictReplace,
+			want:   submit.Result{Inserted: 1, Updated: 2, Unchanged: 1, Start: 100, End: 400},
+			stored: map[int64]float64{100: 7, 200: 3, 300: 5, 400: 1},
+		},
+		{
+			policy: submit.ConflictKeep,
+			want:   submit.Result{Inserted: 1, Unchanged: 3, Start: 400, End: 400},
+			stored: map[int64]float64{100: 5, 200: 5, 300: 5, 400: 1},
+		},
+		{
+			policy: submit.ConflictMax,
+			want:   submit.Result{Inserted: 1, Updated: 1, Unchanged: 2, Start: 100, End: 400},
+			stored: map[int64]float64{100: 7, 200: 5, 300: 5, 400: 1},
+		},
+		{
+			policy: submit.ConflictReject,
+			want:   submit.Result{Inserted: 1, Unchanged: 1, Rejected: 2, Start: 400, End: 400},
+			stored: map[int64]float64{100: 5, 200: 5, 300: 5, 400: 1},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			id := "ctr-" + string(tc.policy)
+
+			res, err := st.Submit(ctx, submit.Request{
+				ID:          id,
+				DirectionID: "one",
+				Points: []submit.Point{
+					{Time: 100, Resolution: submit.ResolutionHour, Value: 5},
+					{Time: 200, Resolution: submit.ResolutionHour, Value: 5},
+					{Time: 300, Resolution: submit.ResolutionHour, Value: 5},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(submit.Result{Inserted: 3, Start: 100, End: 300}, res); d != "" {
+				t.Fatalf("initial submit result mismatch (-want +got):\n%s", d)
+			}
+
+			res, err = st.Submit(ctx, submit.Request{
+				ID:          id,
+				DirectionID: "one",
+				Conflict:    tc.policy,
+				Points:      incoming,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, res); d != "" {
+				t.Errorf("result mismatch (-want +got):\n%s", d)
+			}
+			if d := cmp.Diff(tc.stored, storedValues(t, st, id, "one")); d != "" {
+				t.Errorf("stored values mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestStorageSubmitBatch(t *testing.T) {
+	ctx := context.Background()
+	st := newTestStorage(t)
+
+	reqs := []submit.Request{
+		{ID: "ctr", DirectionID: "one", Points: []submit.Point{{Time: 100, Resolution: submit.ResolutionHour, Value: 1}}},
+		{ID: "ctr", DirectionID: "two", Points: []submit.Point{{Time: 100, Resolution: submit.ResolutionHour, Value: 2}, {Time: 200, Resolution: submit.ResolutionHour, Value: 3}}},
+		{ID: "ctr", DirectionID: "one", Conflict: submit.ConflictReject, Points: []submit.Point{{Time: 100, Resolution: submit.ResolutionHour, Value: 4}}},
+	}
+
+	results, err := st.SubmitBatch(ctx, reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []submit.Result{
+		{Inserted: 1, Start: 100, End: 100},
+		{Inserted: 2, Start: 100, End: 200},
+		{Rejected: 1},
+	}
+	if d := cmp.Diff(want, results); d != "" {
+		t.Errorf("results mismatch (-want +got):\n%s", d)
+	}
+
+	if d := cmp.Diff(map[int64]float64{100: 1}, storedValues(t, st, "ctr", "one")); d != "" {
+		t.Errorf("direction one mismatch (-want +got):\n%s", d)
+	}
+	if d := cmp.Diff(map[int64]float64{100: 2, 200: 3}, storedValues(t, st, "ctr", "two")); d != "" {
+		t.Errorf("direction two mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestStorageTokens(t *testing.T) {
+	ctx := context.Background()
+	st := newTestStorage(t)
+
+	tok := submit.Token{Name: "partner", Hash: submit.HashToken("secret"), Counters: []string{"a", "b"}, Tags: []string{"city"}}
+	if err := st.AddToken(ctx, tok); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.AddToken(ctx, tok); err == nil {
+		t.Error("got no error adding a token twice")
+	}
+
+	got, err := st.LookupToken(ctx, tok.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(tok, got); d != "" {
+		t.Errorf("token mismatch (-want +got):\n%s", d)
+	}
+
+	if _, err := st.LookupToken(ctx, submit.HashToken("other")); !errors.Is(err, submit.ErrUnknownToken) {
+		t.Errorf("got error %v looking up unknown token, want %v", err, submit.ErrUnknownToken)
+	}
+
+	other := submit.Token{Name: "city", Hash: submit.HashToken("other"), Counters: []string{"c"}}
+	if err := st.AddToken(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	all, err := st.Tokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff([]submit.Token{other, tok}, all); d != "" {
+		t.Errorf("tokens mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestStorageFindings(t *testing.T) {
+	ctx := context.Background()
+	st := newTestStorage(t)
+
+	day := func(d int) time.Time { return time.Date(2021, 6, d, 0, 0, 0, 0, time.UTC) }
+
+	zeros := anomaly.Finding{CounterID: "a", DirectionID: "one", Rule: anomaly.RuleZeroRun, Start: day(1), End: day(3), Message: "2 days of zeros"}
+	spike := anomaly.Finding{CounterID: "a", DirectionID: "two", Rule: anomaly.RuleWeekdayMedian, Start: day(2), End: day(3), Message: "spike"}
+
+	got, err := st.AddFindings(ctx, []anomaly.Finding{zeros, spike})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []anomaly.Finding{zeros, spike}
+	want[0].ID, want[0].Status = 1, anomaly.StatusOpen
+	want[1].ID, want[1].Status = 2, anomaly.StatusOpen
+	if d := cmp.Diff(want, got); d != "" {
+		t.Fatalf("added findings mismatch (-want +got):\n%s", d)
+	}
+
+	// The run of zeros gets longer.
+	zeros.End, zeros.Message = day(4), "3 days of zeros"
+	got, err = st.AddFindings(ctx, []anomaly.Finding{zeros})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []anomaly.Finding{zeros}
+	want[0].ID, want[0].Status = 1, anomaly.StatusOpen
+	if d := cmp.Diff(want, got); d != "" {
+		t.Fatalf("updated findings mismatch (-want +got):\n%s", d)
+	}
+
+	got, err = st.Findings(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []anomaly.Finding{zeros, spike}
+	want[0].ID, want[0].Status = 1, anomaly.StatusOpen
+	want[1].ID, want[1].Status = 2, anomaly.StatusOpen
+	if d := cmp.Diff(want, got); d != "" {
+		t.Fatalf("findings mismatch (-want +got):\n%s", d)
+	}
+
+	if err := st.SetFindingStatus(ctx, 1, anomaly.StatusDismissed); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetFindingStatus(ctx, 99, anomaly.StatusDismissed); err == nil {
+		t.Error("got no error setting status of unknown finding")
+	}
+
+	// Reviewed findings aren't changed by later checks.
+	longer := zeros
+	longer.End, longer.Message = day(5), "4 days of zeros"
+	got, err = st.AddFindings(ctx, []anomaly.Finding{longer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []anomaly.Finding{longer}
+	want[0].ID, want[0].Status = 1, anomaly.StatusDismissed
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("reviewed finding mismatch (-want +got):\n%s", d)
+	}
+
+	got, err = st.Findings(ctx, anomaly.StatusDismissed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []anomaly.Finding{zeros}
+	want[0].ID, want[0].Status = 1, anomaly.StatusDismissed
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("dismissed findings mismatch (-want +got):\n%s", d)
+	}
+
+	got, err = st.Findings(ctx, anomaly.StatusOpen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []anomaly.Finding{spike}
+	want[0].ID, want[0].Status = 2, anomaly.StatusOpen
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("open findings mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestStorageIngestedFiles(t *testing.T) {
+	ctx := context.Background()
+	st := newTestStorage(t)
+
+	if _, ok, err := st.IngestedFile(ctx, "src", "/a.csv"); err != nil || ok {
+		t.Fatalf("got ok %v, err %v for unknown file, want false, nil", ok, err)
+	}
+
+	f := source.IngestedFile{
+		Source:     "src",
+		Path:       "/a.csv",
+		Size:       10,
+		ModTime:    time.Unix(1000, 0),
+		SHA256:     "abc",
+		IngestedAt: time.Unix(2000, 0),
+	}
+	if err := st.AddIngestedFile(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Size, f.SHA256, f.IngestedAt = 20, "def", time.Unix(3000, 0)
+	if err := st.AddIngestedFile(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok, err := st.IngestedFile(ctx, "src", "/a.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("file not found")
+	}
+	if d := cmp.Diff(f, got); d != "" {
+		t.Errorf("file mismatch (-want +got):\n%s", d)
+	}
+
+	if _, ok, err := st.IngestedFile(ctx, "other", "/a.csv"); err != nil || ok {
+		t.Errorf("got ok %v, err %v for other source, want false, nil", ok, err)
+	}
+}
+
+func TestStorageSize(t *testing.T) {
+	st := newTestStorage(t)
+
+	n, err := st.Size(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n <= 0 {
+		t.Errorf("got size %d, want > 0", n)
+	}
+}
+
+func newTestStorage(t *testing.T) *dbStorage {
+	t.Helper()
+
+	dbg := databaseGetter{file: filepath.Join(t.TempDir(), "data.db")}
+	stg := storageGetter{getDB: dbg.get}
+
+	st, err := stg.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+func storedValues(t *testing.T, st *dbStorage, id, dirID string) map[int64]float64 {
+	t.Helper()
+
+	rows, err := st.db.Query("select time, value from counter_data where counter_id=? and direction_id=?", id, dirID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	vals := make(map[int64]float64)
+	for rows.Next() {
+		var tm int64
+		var v float64
+		if err := rows.Scan(&tm, &v); err != nil {
+			t.Fatal(err)
+		}
+		vals[tm] = v
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return vals
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/danp/counterbase/submit"
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+type tokenExec struct {
+	getStorage func(ctx context.Context) (*dbStorage, error)
+	name       *string
+	counters   *commaSeparatedString
+	tags       *commaSeparatedString
+	print      *bool
+}
+
+func newTokenCmd(gs func(ctx context.Context) (*dbStorage, error)) *ffcli.Command {
+	var (
+		fs       = flag.NewFlagSet("counterbase token", flag.ExitOnError)
+		name     = fs.String("name", "", "name of the client the token is for")
+		counters commaSeparatedString
+		tags     commaSeparatedString
+		print    = fs.Bool("print", false, "print the token's -tokens-file entry instead of storing it in the database")
+	)
+	fs.Var(&counters, "counters", "comma-separated counter IDs the token may submit for, * for all")
+	fs.Var(&tags, "tags", "comma-separated tags of counters the token may submit for")
+
+	te := &tokenExec{
+		getStorage: gs,
+		name:       name,
+		counters:   &counters,
+		tags:       &tags,
+		print:      print,
+	}
+
+	return &ffcli.Command{
+		Name:       "token",
+		ShortUsage: "counterbase token -name <name> [-counters <ids>] [-tags <tags>]",
+		ShortHelp:  "create a submit api token",
+		LongHelp:   "Tokens are only checked by the /submit endpoints of counterbase api. The /query endpoints are open to anyone who can reach the api.",
+		FlagSet:    fs,
+		Exec:       te.exec,
+	}
+}
+
+func (t tokenExec) exec(ctx context.Context, args []string) error {
+	if *t.name == "" {
+		return fmt.Errorf("need -name")
+	}
+	if len(t.counters.vals) == 0 && len(t.tags.vals) == 0 {
+		return fmt.Errorf("need -counters or -tags")
+	}
+
+	secret, err := submit.NewToken()
+	if err != nil {
+		return err
+	}
+
+	tok := submit.Token{
+		Name:     *t.name,
+		Hash:     submit.HashToken(secret),
+		Counters: t.counters.vals,
+		Tags:     t.tags.vals,
+	}
+
+	if *t.print {
+		if err := json.NewEncoder(os.Stderr).Encode(tok); err != nil {
+			return err
+		}
+	} else {
+		st, err := t.getStorage(ctx)
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+
+		if err := st.AddToken(ctx, tok); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println(secret)
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCommaSeparatedString(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a,,b,", []string{"a", "b"}},
+	} {
+		var c commaSeparatedString
+		if err := c.Set(tc.in); err != nil {
+			t.Fatal(err)
+		}
+		if d := cmp.Diff(tc.want, c.vals); d != "" {
+			t.Errorf("Set(%q) mismatch (-want +got):\n%s", tc.in, d)
+		}
+	}
+}
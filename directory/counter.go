@@ -14,12 +14,77 @@ type Counter struct {
 	Directions    []Direction    `json:"directions"`
 	Notes         []Note         `json:"notes,omitempty"`
 	Tags          []string       `json:"tags,omitempty"`
+	// Zone is the IANA time zone the counter is in, such as America/Halifax.
+	// If blank, DefaultZone is used.
+	Zone string `json:"zone,omitempty"`
+	// BadData lists periods where the counter's data is known to be wrong,
+	// such as during construction or malfunctions.
+	BadData []BadDataRange `json:"bad_data,omitempty"`
 }
 
+// DefaultZone is used for counters without a Zone.
+const DefaultZone = "America/Halifax"
+
 func (c Counter) IsActive() bool {
 	return len(c.ServiceRanges) > 0 && c.ServiceRanges[len(c.ServiceRanges)-1].End.IsZero()
 }
 
+// TimeZone returns the time zone of the counter.
+func (c Counter) TimeZone() (*time.Location, error) {
+	zone := c.Zone
+	if zone == "" {
+		zone = DefaultZone
+	}
+	return time.LoadLocation(zone)
+}
+
+// InService reports whether t falls within one of the counter's service
+// ranges. Service dates are inclusive and interpreted in loc.
+func (c Counter) InService(t time.Time, loc *time.Location) bool {
+	day := dateOf(t.In(loc))
+	for _, sr := range c.ServiceRanges {
+		if !sr.Start.IsZero() && day.Before(dateOf(sr.Start.Time)) {
+			continue
+		}
+		if !sr.End.IsZero() && day.After(dateOf(sr.End.Time)) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func dateOf(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// IsBadData reports whether t falls within one of the counter's bad data
+// ranges. Dates are inclusive and interpreted in loc.
+func (c Counter) IsBadData(t time.Time, loc *time.Location) bool {
+	day := dateOf(t.In(loc))
+	for _, br := range c.BadData {
+		if !br.Start.IsZero() && day.Before(dateOf(br.Start.Time)) {
+			continue
+		}
+		if !br.End.IsZero() && day.After(dateOf(br.End.Time)) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// Direction returns the direction with the given ID, if it exists.
+func (c Counter) Direction(id string) (Direction, bool) {
+	for _, d := range c.Directions {
+		if d.ID == id {
+			return d, true
+		}
+	}
+	return Direction{}, false
+}
+
 type ServiceDate struct {
 	time.Time
 }
@@ -52,6 +117,12 @@ type ServiceRange struct {
 	End   ServiceDate `json:"end,omitempty"`
 }
 
+type BadDataRange struct {
+	Start ServiceDate `json:"start,omitempty"`
+	End   ServiceDate `json:"end,omitempty"`
+	Note  string      `json:"note,omitempty"`
+}
+
 type Location struct {
 	Lon  float64 `json:"lon,omitempty"`
 	Lat  float64 `json:"lat,omitempty"`
@@ -62,6 +133,9 @@ type Direction struct {
 	ID     string `json:"id"`
 	Name   string `json:"name"`
 	Source Source `json:"source"`
+	// Resolution is the expected resolution of the direction's data:
+	// minute, hour, or day. If blank, any resolution is accepted.
+	Resolution string `json:"resolution,omitempty"`
 }
 
 type Note struct {
@@ -70,4 +144,7 @@ type Note struct {
 
 type Source struct {
 	URL string `json:"url"`
+	// Options configures the Getter for URL's scheme, such as which
+	// fields hold times and values for csvhttp and jsonhttp sources.
+	Options map[string]string `json:"options,omitempty"`
 }
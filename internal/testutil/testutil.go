@@ -0,0 +1,86 @@
+// Package testutil has fakes shared by tests of several packages.
+package testutil
+
+import (
+	"context"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/danp/counterbase/directory"
+	"github.com/danp/counterbase/query"
+)
+
+// Directory is a fixed list of counters.
+type Directory struct {
+	C []directory.Counter
+}
+
+func (d Directory) Counters(context.Context) ([]directory.Counter, error) {
+	return d.C, nil
+}
+
+// DataQuerier answers queries built by query.Engine using points by
+// counter and direction ID. Points at the same time and resolution are
+// summed, as they are in the database.
+type DataQuerier map[string]map[string][]query.Point
+
+var (
+	dataQueryCounterRE   = regexp.MustCompile(`counter_id='([^']*)'`)
+	dataQueryDirectionRE = regexp.MustCompile(`direction_id='([^']*)'`)
+	dataQueryStartRE     = regexp.MustCompile(` and time >= (\d+)`)
+	dataQueryEndRE       = regexp.MustCompile(` and time < (\d+)`)
+	dataQueryLimitRE     = regexp.MustCompile(`limit (\d+)$`)
+)
+
+func (d DataQuerier) Query(ctx context.Context, q string) ([]query.Point, error) {
+	var counter, direction string
+	var start, end int64 = math.MinInt64, math.MaxInt64
+	if m := dataQueryCounterRE.FindStringSubmatch(q); m != nil {
+		counter = m[1]
+	}
+	if m := dataQueryDirectionRE.FindStringSubmatch(q); m != nil {
+		direction = m[1]
+	}
+	if m := dataQueryStartRE.FindStringSubmatch(q); m != nil {
+		start, _ = strconv.ParseInt(m[1], 10, 64)
+	}
+	if m := dataQueryEndRE.FindStringSubmatch(q); m != nil {
+		end, _ = strconv.ParseInt(m[1], 10, 64)
+	}
+
+	type key struct {
+		t   int64
+		res query.Resolution
+	}
+	sums := make(map[key]float64)
+	for dir, pts := range d[counter] {
+		if direction != "" && dir != direction {
+			continue
+		}
+		for _, p := range pts {
+			if t := p.Time.Unix(); t >= start && t < end {
+				sums[key{t, p.Resolution}] += p.Value
+			}
+		}
+	}
+
+	var out []query.Point
+	for k, v := range sums {
+		out = append(out, query.Point{Time: time.Unix(k.t, 0), Value: v, Resolution: k.res})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Time.Equal(out[j].Time) {
+			return out[i].Time.Before(out[j].Time)
+		}
+		return out[i].Resolution.Finer(out[j].Resolution)
+	})
+	if m := dataQueryLimitRE.FindStringSubmatch(q); m != nil {
+		if n, _ := strconv.Atoi(m[1]); len(out) > n {
+			out = out[:n]
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,266 @@
+// Package metrics keeps counters, gauges and histograms and exposes them
+// in the OpenMetrics text format, as scraped by Prometheus.
+//
+// It covers only what the api and crawler commands record, so as not to
+// take on prometheus/client_golang and the protobuf, client_model and
+// procfs modules it brings with it for a handful of metrics. Output is
+// checked against the exposition format in metrics_test.go. If
+// counterbase needs more, such as summaries, exemplars or process metrics,
+// client_golang should replace it rather than it growing.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of Registry's responses.
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// DefaultBuckets are histogram buckets, in seconds, suited to HTTP request
+// latencies.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A Registry holds metric families. The zero value is ready to use.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64      // for histograms
+	fn      func() float64 // for gauge funcs
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64 // per bucket, for histograms
+	count       uint64
+}
+
+func (r *Registry) add(f *family) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, o := range r.families {
+		if o.name == f.name {
+			panic(fmt.Sprintf("metrics: %s registered twice", f.name))
+		}
+	}
+	f.series = make(map[string]*series)
+	r.families = append(r.families, f)
+	if len(f.labels) == 0 && f.fn == nil {
+		// Expose a single series from the start.
+		f.with(nil, func(*series) {})
+	}
+	return f
+}
+
+// A Counter is a total that only goes up, partitioned by label values.
+// Methods on a nil Counter do nothing.
+type Counter struct{ f *family }
+
+// Counter registers a counter. Its samples are exposed as name_total.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{r.add(&family{name: name, help: help, typ: "counter", labels: labels})}
+}
+
+// Add adds v, which must not be negative, to the series with labelValues.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if c == nil {
+		return
+	}
+	if v < 0 {
+		panic("metrics: counter decreased")
+	}
+	c.f.with(labelValues, func(s *series) { s.value += v })
+}
+
+// Inc adds 1 to the series with labelValues.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// A Gauge is a value that can go up and down, partitioned by label values.
+// Methods on a nil Gauge do nothing.
+type Gauge struct{ f *family }
+
+// Gauge registers a gauge.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.add(&family{name: name, help: help, typ: "gauge", labels: labels})}
+}
+
+// Set sets the series with labelValues to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	if g == nil {
+		return
+	}
+	g.f.with(labelValues, func(s *series) { s.value = v })
+}
+
+// GaugeFunc registers a gauge without labels whose value is found by
+// calling fn each time metrics are written.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.add(&family{name: name, help: help, typ: "gauge", fn: fn})
+}
+
+// A Histogram counts observations in buckets, partitioned by label values.
+// Methods on a nil Histogram do nothing.
+type Histogram struct{ f *family }
+
+// Histogram registers a histogram with the given bucket upper bounds,
+// which must be in increasing order. If buckets is nil, DefaultBuckets is
+// used.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: %s buckets not sorted", name))
+	}
+	return &Histogram{r.add(&family{name: name, help: help, typ: "histogram", labels: labels, buckets: buckets})}
+}
+
+// Observe records v in the series with labelValues.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	if h == nil {
+		return
+	}
+	h.f.with(labelValues, func(s *series) {
+		for i, b := range h.f.buckets {
+			if v <= b {
+				s.counts[i]++
+			}
+		}
+		s.count++
+		s.value += v
+	})
+}
+
+func (f *family) with(labelValues []string, fn func(*series)) {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s got %d label values, want %d", f.name, len(labelValues), len(f.labels)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{
+			labelValues: append([]string(nil), labelValues...),
+			counts:      make([]uint64, len(f.buckets)),
+		}
+		f.series[key] = s
+	}
+	fn(s)
+}
+
+// ServeHTTP writes all metrics.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteTo(w)
+}
+
+// WriteTo writes all metrics to w in the OpenMetrics text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+
+	var b strings.Builder
+	for _, f := range families {
+		f.write(&b)
+	}
+	b.WriteString("# EOF\n")
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (f *family) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.typ)
+	if f.help != "" {
+		fmt.Fprintf(b, "# HELP %s %s\n", f.name, escape(f.help))
+	}
+
+	if f.fn != nil {
+		fmt.Fprintf(b, "%s %s\n", f.name, formatFloat(f.fn()))
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ss := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		ss = append(ss, s)
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		return strings.Join(ss[i].labelValues, "\xff") < strings.Join(ss[j].labelValues, "\xff")
+	})
+
+	for _, s := range ss {
+		switch f.typ {
+		case "counter":
+			fmt.Fprintf(b, "%s_total%s %s\n", f.name, f.labelSet(s, "", ""), formatFloat(s.value))
+		case "gauge":
+			fmt.Fprintf(b, "%s%s %s\n", f.name, f.labelSet(s, "", ""), formatFloat(s.value))
+		case "histogram":
+			for i, le := range f.buckets {
+				fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, f.labelSet(s, "le", formatFloat(le)), s.counts[i])
+			}
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, f.labelSet(s, "le", "+Inf"), s.count)
+			fmt.Fprintf(b, "%s_count%s %d\n", f.name, f.labelSet(s, "", ""), s.count)
+			fmt.Fprintf(b, "%s_sum%s %s\n", f.name, f.labelSet(s, "", ""), formatFloat(s.value))
+		}
+	}
+}
+
+// labelSet formats the labels of s, followed by extra=extraValue if extra
+// isn't blank.
+func (f *family) labelSet(s *series, extra, extraValue string) string {
+	var parts []string
+	for i, l := range f.labels {
+		parts = append(parts, l+`="`+escape(s.labelValues[i])+`"`)
+	}
+	if extra != "" {
+		parts = append(parts, extra+`="`+escape(extraValue)+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
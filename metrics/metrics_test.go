@@ -0,0 +1,80 @@
+package metrics_test
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danp/counterbase/metrics"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRegistry(t *testing.T) {
+	var r metrics.Registry
+
+	reqs := r.Counter("requests", "Requests handled.", "path", "code")
+	reqs.Inc("/submit", "200")
+	reqs.Inc("/submit", "200")
+	reqs.Add(3, "/bulk", "400")
+
+	r.Counter("points_written", "Points written.")
+
+	last := r.Gauge("last_success_timestamp_seconds", `Last "good" crawl.`, "counter_id")
+	last.Set(1616727600, `a\b`)
+
+	dur := r.Histogram("duration_seconds", "Durations.", []float64{0.1, 1}, "path")
+	dur.Observe(0.05, "/submit")
+	dur.Observe(0.5, "/submit")
+	dur.Observe(2, "/submit")
+
+	r.GaugeFunc("database_size_bytes", "", func() float64 { return 4096 })
+
+	var nilCounter *metrics.Counter
+	nilCounter.Inc()
+
+	srv := httptest.NewServer(&r)
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != metrics.ContentType {
+		t.Errorf("got content type %q, want %q", ct, metrics.ContentType)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.Join([]string{
+		"# TYPE requests counter",
+		"# HELP requests Requests handled.",
+		`requests_total{path="/bulk",code="400"} 3`,
+		`requests_total{path="/submit",code="200"} 2`,
+		"# TYPE points_written counter",
+		"# HELP points_written Points written.",
+		"points_written_total 0",
+		"# TYPE last_success_timestamp_seconds gauge",
+		`# HELP last_success_timestamp_seconds Last \"good\" crawl.`,
+		`last_success_timestamp_seconds{counter_id="a\\b"} 1.6167276e+09`,
+		"# TYPE duration_seconds histogram",
+		"# HELP duration_seconds Durations.",
+		`duration_seconds_bucket{path="/submit",le="0.1"} 1`,
+		`duration_seconds_bucket{path="/submit",le="1"} 2`,
+		`duration_seconds_bucket{path="/submit",le="+Inf"} 3`,
+		`duration_seconds_count{path="/submit"} 3`,
+		`duration_seconds_sum{path="/submit"} 2.55`,
+		"# TYPE database_size_bytes gauge",
+		"database_size_bytes 4096",
+		"# EOF",
+		"",
+	}, "\n")
+	if d := cmp.Diff(want, string(b)); d != "" {
+		t.Error(d)
+	}
+}
@@ -0,0 +1,171 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A Resolution is a local calendar period points can be aggregated into.
+// It's also the resolution data was stored at, which may be minute, hour
+// or day.
+type Resolution string
+
+const (
+	ResolutionMinute Resolution = "minute"
+	ResolutionHour   Resolution = "hour"
+	ResolutionDay    Resolution = "day"
+	ResolutionWeek   Resolution = "week"
+	ResolutionMonth  Resolution = "month"
+	ResolutionYear   Resolution = "year"
+)
+
+func ParseResolution(s string) (Resolution, error) {
+	switch r := Resolution(s); r {
+	case ResolutionMinute, ResolutionHour, ResolutionDay, ResolutionWeek, ResolutionMonth, ResolutionYear:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown resolution %q", s)
+}
+
+// Bucket returns the start of the period containing t, in loc.
+// Weeks start on Monday, as ISO weeks do.
+func (r Resolution) Bucket(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	y, m, d := t.Date()
+
+	switch r {
+	case ResolutionMinute:
+		return t.Add(-time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	case ResolutionHour:
+		// Truncate rather than using time.Date so ambiguous hours around
+		// DST changes and zones with non-hour offsets are handled.
+		return t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	case ResolutionDay:
+		return time.Date(y, m, d, 0, 0, 0, 0, loc)
+	case ResolutionWeek:
+		return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, loc)
+	case ResolutionMonth:
+		return time.Date(y, m, 1, 0, 0, 0, 0, loc)
+	case ResolutionYear:
+		return time.Date(y, 1, 1, 0, 0, 0, 0, loc)
+	}
+	return t
+}
+
+// Next returns the start of the period after the one starting at b,
+// which should be a value returned by Bucket.
+func (r Resolution) Next(b time.Time) time.Time {
+	switch r {
+	case ResolutionMinute:
+		return b.Add(time.Minute)
+	case ResolutionHour:
+		return b.Add(time.Hour)
+	case ResolutionDay:
+		return b.AddDate(0, 0, 1)
+	case ResolutionWeek:
+		return b.AddDate(0, 0, 7)
+	case ResolutionMonth:
+		return b.AddDate(0, 1, 0)
+	case ResolutionYear:
+		return b.AddDate(1, 0, 0)
+	}
+	return b
+}
+
+// Finer reports whether r is a finer resolution than o.
+func (r Resolution) Finer(o Resolution) bool {
+	return r.rank() < o.rank()
+}
+
+func (r Resolution) rank() int {
+	switch r {
+	case ResolutionMinute:
+		return 1
+	case ResolutionHour:
+		return 2
+	case ResolutionDay:
+		return 3
+	case ResolutionWeek:
+		return 4
+	case ResolutionMonth:
+		return 5
+	case ResolutionYear:
+		return 6
+	}
+	return 0
+}
+
+// ErrTooFine is returned when data is asked for at a finer resolution than
+// it was stored at, such as hourly data from a counter that reports daily.
+var ErrTooFine = errors.New("resolution finer than stored data")
+
+// checkStored returns an error wrapping ErrTooFine if any of pts was
+// stored at a coarser resolution than r.
+func checkStored(pts []Point, r Resolution) error {
+	for _, p := range pts {
+		if p.Resolution != "" && r.Finer(p.Resolution) {
+			return fmt.Errorf("%w: %s requested but data at %s is stored by %s", ErrTooFine, r, p.Time.Format(time.RFC3339), p.Resolution)
+		}
+	}
+	return nil
+}
+
+// Aggregate sums pts into periods of resolution r in loc. pts must be
+// sorted by time. Each returned point's Time is the start of its period.
+// Periods without points are not included.
+func Aggregate(pts []Point, loc *time.Location, r Resolution) []Point {
+	return aggregateInto(nil, pts, loc, r)
+}
+
+// aggregateInto is Aggregate, adding to the periods in out.
+func aggregateInto(out, pts []Point, loc *time.Location, r Resolution) []Point {
+	for _, p := range pts {
+		b := r.Bucket(p.Time, loc)
+		if n := len(out); n > 0 && out[n-1].Time.Equal(b) {
+			out[n-1].Value += p.Value
+			continue
+		}
+		out = append(out, Point{Time: b, Value: p.Value})
+	}
+	return out
+}
+
+// aggregator aggregates the points of src into periods of res, returning
+// each period once it's complete.
+type aggregator struct {
+	src       pointStream
+	counterID string
+	loc       *time.Location
+	res       Resolution
+
+	// pending is the last period seen, which may continue in the next
+	// chunk.
+	pending []Point
+}
+
+func (a *aggregator) next(ctx context.Context) ([]Point, error) {
+	for {
+		pts, err := a.src.next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if pts == nil {
+			out := a.pending
+			a.pending = nil
+			return out, nil
+		}
+
+		if err := checkStored(pts, a.res); err != nil {
+			return nil, fmt.Errorf("counter %q: %w", a.counterID, err)
+		}
+
+		agg := aggregateInto(a.pending, pts, a.loc, a.res)
+		n := len(agg) - 1
+		a.pending = []Point{agg[n]}
+		if n > 0 {
+			return agg[:n], nil
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrTruncated is returned by Client.Query and QueryRows, along with the
+// rows that were returned, when Datasette truncated the results.
+var ErrTruncated = errors.New("results truncated")
+
+// Client runs SQL queries against a Datasette database JSON endpoint,
+// such as https://example.com/data.json.
+type Client struct {
+	URL string
+
+	// HTTPClient is used to make requests. Its Timeout or Transport can
+	// be set to control timeouts. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// An Error is returned when Datasette responds with an error status.
+type Error struct {
+	StatusCode int
+	// Title and Message come from Datasette's error JSON, if there was
+	// any. Otherwise Message is the start of the response body.
+	Title   string
+	Message string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("query: got status %d", e.StatusCode)
+	if e.Title != "" {
+		msg += ": " + e.Title
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// A Result is the raw result of a query. Each row has a value for each
+// column, as JSON.
+type Result struct {
+	Columns   []string            `json:"columns"`
+	Rows      [][]json.RawMessage `json:"rows"`
+	Truncated bool                `json:"truncated"`
+}
+
+// Rows runs q and returns its result. Truncated results are returned
+// without error; see Result.Truncated.
+func (c *Client) Rows(ctx context.Context, q string) (Result, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return Result{}, err
+	}
+
+	uq := u.Query()
+	uq.Set("sql", q)
+	u.RawQuery = uq.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return Result{}, err
+	}
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return Result{}, responseError(resp.StatusCode, b)
+	}
+
+	var res Result
+	if err := json.Unmarshal(b, &res); err != nil {
+		return Result{}, fmt.Errorf("decoding query response: %w", err)
+	}
+	return res, nil
+}
+
+// responseError returns an *Error for a response with the given status
+// and body.
+func responseError(status int, b []byte) error {
+	e := &Error{StatusCode: status}
+
+	var de struct {
+		Error string `json:"error"`
+		Title string `json:"title"`
+	}
+	if json.Unmarshal(b, &de) == nil && (de.Error != "" || de.Title != "") {
+		e.Title, e.Message = de.Title, de.Error
+		return e
+	}
+
+	const max = 200
+	b = bytes.TrimSpace(b)
+	if len(b) > max {
+		b = append(b[:max:max], "..."...)
+	}
+	e.Message = string(b)
+	return e
+}
+
+// Query runs q, which must select a Unix time and a value, optionally
+// followed by a stored resolution as in counter_data.
+func (c *Client) Query(ctx context.Context, q string) ([]Point, error) {
+	res, err := c.Rows(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	var pts []Point
+	for i, row := range res.Rows {
+		if len(row) < 2 {
+			return nil, fmt.Errorf("row %d: got %d columns, want at least 2", i, len(row))
+		}
+
+		t, err := number(row[0])
+		if err != nil {
+			return nil, fmt.Errorf("row %d time: %w", i, err)
+		}
+		v, err := number(row[1])
+		if err != nil {
+			return nil, fmt.Errorf("row %d value: %w", i, err)
+		}
+
+		p := Point{
+			Time:  time.Unix(int64(t), 0),
+			Value: v,
+		}
+		if len(row) > 2 {
+			r, err := number(row[2])
+			if err != nil {
+				return nil, fmt.Errorf("row %d resolution: %w", i, err)
+			}
+			p.Resolution = StoredResolution(int64(r))
+		}
+		pts = append(pts, p)
+	}
+
+	if res.Truncated {
+		return pts, ErrTruncated
+	}
+	return pts, nil
+}
+
+// number decodes a JSON number, or a string holding one as SQLite may
+// return for numeric columns.
+func number(m json.RawMessage) (float64, error) {
+	var f float64
+	if err := json.Unmarshal(m, &f); err == nil {
+		return f, nil
+	}
+	var s string
+	if err := json.Unmarshal(m, &s); err != nil {
+		return 0, fmt.Errorf("got %s, want a number", m)
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("got %q, want a number", s)
+	}
+	return f, nil
+}
+
+// QueryRows runs q and decodes each row into a T, a struct whose fields
+// are matched to columns as encoding/json matches object keys. For example:
+//
+//	type counterTotal struct {
+//		CounterID string  `json:"counter_id"`
+//		Total     float64 `json:"total"`
+//	}
+//	totals, err := QueryRows[counterTotal](ctx, cl, "select counter_id, sum(value) as total from counter_data group by 1")
+//
+// If the result was truncated, the decoded rows are returned with ErrTruncated.
+func QueryRows[T any](ctx context.Context, c *Client, q string) ([]T, error) {
+	res, err := c.Rows(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := DecodeRows[T](res)
+	if err != nil {
+		return nil, err
+	}
+	if res.Truncated {
+		return out, ErrTruncated
+	}
+	return out, nil
+}
+
+// DecodeRows decodes each row of res into a T, as QueryRows does.
+func DecodeRows[T any](res Result) ([]T, error) {
+	out := make([]T, 0, len(res.Rows))
+	for i, row := range res.Rows {
+		if len(row) != len(res.Columns) {
+			return nil, fmt.Errorf("row %d: got %d values for %d columns", i, len(row), len(res.Columns))
+		}
+
+		obj := make(map[string]json.RawMessage, len(row))
+		for j, col := range res.Columns {
+			obj[col] = row[j]
+		}
+		b, err := json.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+
+		var v T
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, fmt.Errorf("row %d: %w", i, err)
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
@@ -0,0 +1,136 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// An Alignment controls how prior periods line up with the compared period.
+type Alignment string
+
+const (
+	// AlignDate compares with the same calendar dates in prior years.
+	AlignDate Alignment = "date"
+	// AlignWeekday compares with periods 52 weeks apart, so weekdays line up.
+	AlignWeekday Alignment = "weekday"
+)
+
+// A CompareRequest asks for a counter's total over a period alongside its
+// totals for the same period in prior years.
+type CompareRequest struct {
+	CounterID   string
+	DirectionID string
+
+	// Start and End are the period to compare, End being exclusive.
+	Start, End time.Time
+
+	// Years is how many prior years to compare with. If zero, 1 is used.
+	Years int
+
+	// Align controls how prior periods are chosen. If blank, AlignDate is used.
+	Align Alignment
+}
+
+func (r CompareRequest) validate() error {
+	if r.Start.IsZero() || r.End.IsZero() || !r.End.After(r.Start) {
+		return fmt.Errorf("need start before end")
+	}
+	switch r.Align {
+	case "", AlignDate, AlignWeekday:
+	default:
+		return fmt.Errorf("unknown alignment %q", r.Align)
+	}
+	return nil
+}
+
+// A Comparison is the result of a CompareRequest.
+type Comparison struct {
+	CounterID   string    `json:"counter_id"`
+	DirectionID string    `json:"direction_id,omitempty"`
+	Align       Alignment `json:"align"`
+	Zone        string    `json:"zone"`
+
+	// Period is the compared period.
+	Period PeriodTotal `json:"period"`
+
+	// Prior are the prior periods, most recent first.
+	Prior []PeriodTotal `json:"prior"`
+}
+
+// A PeriodTotal is the total count over a period.
+type PeriodTotal struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Total float64   `json:"total"`
+
+	// Change is the compared period's total minus this one's, and
+	// PercentChange is that as a percentage of this one's total. Both are
+	// omitted for the compared period itself, and PercentChange is omitted
+	// if this period's total is zero.
+	Change        *float64 `json:"change,omitempty"`
+	PercentChange *float64 `json:"percent_change,omitempty"`
+}
+
+// Compare returns totals for req's period and the same period in prior years.
+func (e *Engine) Compare(ctx context.Context, req CompareRequest) (Comparison, error) {
+	if err := req.validate(); err != nil {
+		return Comparison{}, err
+	}
+
+	years := req.Years
+	if years <= 0 {
+		years = 1
+	}
+
+	align := req.Align
+	if align == "" {
+		align = AlignDate
+	}
+
+	loc, err := e.Location(ctx, req.CounterID)
+	if err != nil {
+		return Comparison{}, err
+	}
+
+	cmp := Comparison{
+		CounterID:   req.CounterID,
+		DirectionID: req.DirectionID,
+		Align:       align,
+		Zone:        loc.String(),
+	}
+
+	for y := 0; y <= years; y++ {
+		start, end := req.Start.In(loc), req.End.In(loc)
+		if align == AlignWeekday {
+			start, end = start.AddDate(0, 0, -364*y), end.AddDate(0, 0, -364*y)
+		} else {
+			start, end = start.AddDate(-y, 0, 0), end.AddDate(-y, 0, 0)
+		}
+
+		s, err := e.Series(ctx, Request{CounterID: req.CounterID, DirectionID: req.DirectionID, Start: start, End: end})
+		if err != nil {
+			return Comparison{}, err
+		}
+
+		pt := PeriodTotal{Start: start, End: end}
+		for _, p := range s.Points {
+			pt.Total += p.Value
+		}
+
+		if y == 0 {
+			cmp.Period = pt
+			continue
+		}
+
+		change := cmp.Period.Total - pt.Total
+		pt.Change = &change
+		if pt.Total != 0 {
+			pct := change / pt.Total * 100
+			pt.PercentChange = &pct
+		}
+		cmp.Prior = append(cmp.Prior, pt)
+	}
+
+	return cmp, nil
+}
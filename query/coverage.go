@@ -0,0 +1,204 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/danp/counterbase/directory"
+)
+
+// A CoverageRequest asks how complete the data of the selected counters is.
+type CoverageRequest struct {
+	Selector Selector
+
+	// Start and End are the time range to check, End being exclusive.
+	// Both are required.
+	Start, End time.Time
+
+	// Period splits the range into local calendar periods.
+	// If blank, the whole range is one period.
+	Period Resolution
+}
+
+func (r CoverageRequest) validate() error {
+	if r.Start.IsZero() || r.End.IsZero() || !r.End.After(r.Start) {
+		return fmt.Errorf("need start before end")
+	}
+	if r.Period != "" {
+		if _, err := ParseResolution(string(r.Period)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Coverage describes how complete a counter direction's data is.
+//
+// Intervals are expected at the direction's resolution whenever the counter
+// is in service. If a direction has no resolution, hourly is assumed.
+// A counter without directions is checked as a whole.
+type Coverage struct {
+	CounterID   string `json:"counter_id"`
+	DirectionID string `json:"direction_id,omitempty"`
+	// Interval is the expected resolution: minute, hour or day.
+	Interval string `json:"interval"`
+	Zone     string `json:"zone"`
+
+	Periods []PeriodCoverage `json:"periods"`
+}
+
+// A PeriodCoverage counts the intervals in a period.
+type PeriodCoverage struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// Expected is how many intervals should have data, Present how many
+	// of those do, and Zero how many of those have a value of zero.
+	Expected int `json:"expected"`
+	Present  int `json:"present"`
+	Zero     int `json:"zero"`
+
+	// PercentComplete is Present as a percentage of Expected.
+	// It's omitted if no intervals were expected.
+	PercentComplete *float64 `json:"percent_complete,omitempty"`
+}
+
+// Coverage returns the coverage of each direction of the counters selected
+// by req, in directory order.
+func (e *Engine) Coverage(ctx context.Context, req CoverageRequest) ([]Coverage, error) {
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+
+	counters, err := e.SelectCounters(ctx, req.Selector)
+	if err != nil {
+		return nil, err
+	}
+	if len(counters) == 0 {
+		return nil, fmt.Errorf("no counters selected")
+	}
+
+	var out []Coverage
+	for _, c := range counters {
+		dirs := c.Directions
+		if len(dirs) == 0 {
+			dirs = []directory.Direction{{}}
+		}
+		for _, d := range dirs {
+			cov, err := e.coverage(ctx, c, d, req)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, cov)
+		}
+	}
+	return out, nil
+}
+
+func (e *Engine) coverage(ctx context.Context, c directory.Counter, d directory.Direction, req CoverageRequest) (Coverage, error) {
+	loc, err := c.TimeZone()
+	if err != nil {
+		return Coverage{}, err
+	}
+
+	ival := d.Resolution
+	if ival == "" {
+		ival = "hour"
+	}
+	step, err := stepFor(ival)
+	if err != nil {
+		return Coverage{}, fmt.Errorf("counter %q direction %q: %w", c.ID, d.ID, err)
+	}
+
+	s, err := e.Series(ctx, Request{CounterID: c.ID, DirectionID: d.ID, Start: req.Start, End: req.End})
+	if err != nil {
+		return Coverage{}, err
+	}
+
+	values := make(map[int64]float64)
+	for _, p := range s.Points {
+		values[step.start(p.Time, loc).Unix()] += p.Value
+	}
+
+	cov := Coverage{
+		CounterID:   c.ID,
+		DirectionID: d.ID,
+		Interval:    ival,
+		Zone:        loc.String(),
+	}
+
+	var pc *PeriodCoverage
+	var pb time.Time
+	for t := step.start(req.Start, loc); t.Before(req.End); t = step.next(t) {
+		if t.Before(req.Start) {
+			continue
+		}
+
+		// Periods are clipped to the requested range.
+		if b := periodStart(t, loc, req); pc == nil || !b.Equal(pb) {
+			pb = b
+			p := PeriodCoverage{Start: req.Start.In(loc), End: req.End.In(loc)}
+			if req.Period != "" {
+				if b.After(p.Start) {
+					p.Start = b
+				}
+				if n := req.Period.Next(b); n.Before(p.End) {
+					p.End = n
+				}
+			}
+			cov.Periods = append(cov.Periods, p)
+			pc = &cov.Periods[len(cov.Periods)-1]
+		}
+
+		if len(c.ServiceRanges) > 0 && !c.InService(t, loc) {
+			continue
+		}
+		pc.Expected++
+		v, ok := values[t.Unix()]
+		if !ok {
+			continue
+		}
+		pc.Present++
+		if v == 0 {
+			pc.Zero++
+		}
+	}
+
+	for i := range cov.Periods {
+		if p := &cov.Periods[i]; p.Expected > 0 {
+			pct := float64(p.Present) / float64(p.Expected) * 100
+			p.PercentComplete = &pct
+		}
+	}
+
+	return cov, nil
+}
+
+func periodStart(t time.Time, loc *time.Location, req CoverageRequest) time.Time {
+	if req.Period == "" {
+		return req.Start
+	}
+	return req.Period.Bucket(t, loc)
+}
+
+// An intervalStep finds and steps through intervals of a direction's resolution.
+type intervalStep struct {
+	start func(t time.Time, loc *time.Location) time.Time
+	next  func(t time.Time) time.Time
+}
+
+func stepFor(res string) (intervalStep, error) {
+	switch res {
+	case "minute":
+		return intervalStep{
+			start: func(t time.Time, loc *time.Location) time.Time { return t.In(loc).Truncate(time.Minute) },
+			next:  func(t time.Time) time.Time { return t.Add(time.Minute) },
+		}, nil
+	case "hour":
+		return intervalStep{start: ResolutionHour.Bucket, next: ResolutionHour.Next}, nil
+	case "day":
+		return intervalStep{start: ResolutionDay.Bucket, next: ResolutionDay.Next}, nil
+	}
+	return intervalStep{}, fmt.Errorf("unknown resolution %q", res)
+}
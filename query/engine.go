@@ -0,0 +1,383 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danp/counterbase/directory"
+)
+
+type Querier interface {
+	Query(ctx context.Context, q string) ([]Point, error)
+}
+
+type Directory interface {
+	Counters(context.Context) ([]directory.Counter, error)
+}
+
+// Engine answers Requests using counter data from Querier and counter
+// time zones from Directory.
+type Engine struct {
+	Querier Querier
+
+	// Directory is used to find counter time zones.
+	// If nil, directory.DefaultZone is used for all counters.
+	Directory Directory
+
+	// PageSize is how many rows to ask Querier for at once.
+	// If zero, DefaultPageSize is used.
+	PageSize int
+}
+
+// DefaultPageSize matches Datasette's default max_returned_rows.
+const DefaultPageSize = 1000
+
+// A Request asks for a counter's data over a time range.
+type Request struct {
+	CounterID string
+	// DirectionID limits data to a single direction.
+	// If blank, all directions are summed.
+	DirectionID string
+
+	// Start and End limit the time range, with End being exclusive.
+	// Either may be zero for no limit.
+	Start, End time.Time
+
+	// Resolution aggregates data into local calendar periods.
+	// If blank, data is returned as stored.
+	Resolution Resolution
+
+	// Limit is the most points to return. If there are more, the
+	// returned Series has NextCursor set. Zero means no limit.
+	Limit int
+
+	// Cursor continues from the NextCursor of an earlier Series
+	// returned for the same Request.
+	Cursor string
+
+	// Window, if its Size is set, replaces each period with a rolling
+	// window over it and the periods before it. It needs a Resolution.
+	Window Window
+}
+
+func (r Request) validate() error {
+	if r.CounterID == "" {
+		return fmt.Errorf("missing counter")
+	}
+	if r.Limit < 0 {
+		return fmt.Errorf("bad limit %d", r.Limit)
+	}
+	if _, err := parseCursor(r.Cursor); err != nil {
+		return err
+	}
+	if err := r.Window.validate(r.Resolution); err != nil {
+		return err
+	}
+	return nil
+}
+
+// A Series is a counter's data returned for a Request, or the combined
+// data of several counters returned for a GroupRequest.
+type Series struct {
+	CounterID   string     `json:"counter_id,omitempty"`
+	DirectionID string     `json:"direction_id,omitempty"`
+	Resolution  Resolution `json:"resolution,omitempty"`
+	Window      *Window    `json:"window,omitempty"`
+	Zone        string     `json:"zone"`
+	Points      []Point    `json:"points"`
+
+	// CounterIDs lists the counters in a combined Series.
+	CounterIDs []string `json:"counter_ids,omitempty"`
+	// Partial lists the times of points in a combined Series where a
+	// counter in service had no data.
+	Partial []time.Time `json:"partial,omitempty"`
+
+	// NextCursor is set when Request.Limit cut the Series short.
+	// Pass it as Request.Cursor to get the next page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Series returns the data for req.
+func (e *Engine) Series(ctx context.Context, req Request) (Series, error) {
+	var s Series
+	err := e.StreamSeries(ctx, req, func(piece Series) error {
+		pts := append(s.Points, piece.Points...)
+		s = piece
+		s.Points = pts
+		return nil
+	})
+	if err != nil {
+		return Series{}, err
+	}
+	return s, nil
+}
+
+// StreamSeries calls fn with the data for req in pieces as it's fetched, so
+// long ranges aren't held in memory. Each piece is the Series that Series
+// would return with only the next of its Points. fn is called at least
+// once, and if req.Limit cuts the Series short the last piece has
+// NextCursor set. A piece with no points is only sent when the Series has
+// none. It stops at the first error returned by fn.
+func (e *Engine) StreamSeries(ctx context.Context, req Request, fn func(Series) error) error {
+	if err := req.validate(); err != nil {
+		return err
+	}
+
+	loc, err := e.Location(ctx, req.CounterID)
+	if err != nil {
+		return err
+	}
+
+	start := req.Start
+	if c, _ := parseCursor(req.Cursor); c.After(start) {
+		start = c
+	}
+
+	// A window needs the periods leading up to the first one returned.
+	fetchStart, first := start, time.Time{}
+	if req.Window.Size > 0 && !start.IsZero() {
+		first = req.Resolution.Bucket(start, loc)
+		fetchStart = req.Resolution.back(first, req.Window.Size-1)
+	}
+
+	var src pointStream = e.pager(req.CounterID, req.DirectionID, fetchStart, req.End, loc)
+	if req.Resolution != "" {
+		src = &aggregator{src: src, counterID: req.CounterID, loc: loc, res: req.Resolution}
+	}
+	if req.Window.Size > 0 {
+		src = &roller{src: src, loc: loc, res: req.Resolution, w: req.Window, first: first}
+	}
+
+	s := Series{
+		CounterID:   req.CounterID,
+		DirectionID: req.DirectionID,
+		Resolution:  req.Resolution,
+		Zone:        loc.String(),
+	}
+	if req.Window.Size > 0 {
+		s.Window = req.Window.normalized()
+	}
+
+	var sent int
+	for {
+		pts, err := src.next(ctx)
+		if err != nil {
+			return err
+		}
+		if pts == nil {
+			break
+		}
+
+		piece := s
+		piece.Points = pts
+		if req.Limit > 0 && sent+len(pts) >= req.Limit {
+			// The piece reaching the limit is the last, and only has
+			// NextCursor set if there are points after it.
+			n := req.Limit - sent
+			rest := pts[n:]
+			if len(rest) == 0 {
+				if rest, err = src.next(ctx); err != nil {
+					return err
+				}
+			}
+			piece.Points = pts[:n]
+			if len(rest) > 0 {
+				piece.NextCursor = strconv.FormatInt(rest[0].Time.Unix(), 10)
+			}
+			return fn(piece)
+		}
+		if err := fn(piece); err != nil {
+			return err
+		}
+		sent += len(pts)
+	}
+	if sent == 0 {
+		return fn(s)
+	}
+	return nil
+}
+
+// A pointStream returns points in time order a chunk at a time. Points
+// in later chunks are after those in earlier ones. next returns nil once
+// there are no more.
+type pointStream interface {
+	next(ctx context.Context) ([]Point, error)
+}
+
+// pager fetches a counter's data from Querier a page at a time.
+type pager struct {
+	e                      *Engine
+	counterID, directionID string
+	start, end             time.Time
+	loc                    *time.Location
+	done                   bool
+}
+
+func (e *Engine) pager(counterID, directionID string, start, end time.Time, loc *time.Location) *pager {
+	return &pager{e: e, counterID: counterID, directionID: directionID, start: start, end: end, loc: loc}
+}
+
+// next returns the next page, with times in p.loc, continuing from the
+// last time of the page before. Points at the last time of a full page are
+// fetched again with the next page, since there may be more of them at
+// other resolutions.
+func (p *pager) next(ctx context.Context) ([]Point, error) {
+	if p.done {
+		return nil, nil
+	}
+
+	size := p.e.PageSize
+	if size <= 0 {
+		size = DefaultPageSize
+	}
+
+	pts, err := p.e.Querier.Query(ctx, dataQuery(p.counterID, p.directionID, p.start, p.end, p.loc, size))
+	// A truncated page is complete up to its last time, so carry on from
+	// there.
+	truncated := errors.Is(err, ErrTruncated) && len(pts) > 0
+	if err != nil && !truncated {
+		return nil, err
+	}
+
+	if !truncated && len(pts) < size {
+		p.done = true
+	} else {
+		last := pts[len(pts)-1].Time
+		n := len(pts)
+		for n > 0 && pts[n-1].Time.Equal(last) {
+			n--
+		}
+		if n == 0 {
+			// The whole page is one time, so there's no splitting it.
+			n = len(pts)
+			last = last.Add(time.Second)
+		}
+		pts = pts[:n]
+		p.start = last
+	}
+
+	if len(pts) == 0 {
+		return nil, nil
+	}
+	for i := range pts {
+		pts[i].Time = pts[i].Time.In(p.loc)
+	}
+	return pts, nil
+}
+
+// from returns the points of pts, in time order, at or after t.
+func from(pts []Point, t time.Time) []Point {
+	i := sort.Search(len(pts), func(i int) bool { return !pts[i].Time.Before(t) })
+	return pts[i:]
+}
+
+// parseCursor returns the time a cursor continues from. A blank cursor
+// returns the zero time.
+func parseCursor(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad cursor %q", s)
+	}
+	return time.Unix(n, 0), nil
+}
+
+// Location returns the time zone of the counter with the given ID.
+func (e *Engine) Location(ctx context.Context, counterID string) (*time.Location, error) {
+	c, err := e.counter(ctx, counterID)
+	if err != nil {
+		return nil, err
+	}
+	return c.TimeZone()
+}
+
+// counter returns the directory entry for the counter with the given ID.
+// If e has no Directory, a Counter with only ID set is returned.
+func (e *Engine) counter(ctx context.Context, counterID string) (directory.Counter, error) {
+	if e.Directory == nil {
+		return directory.Counter{ID: counterID}, nil
+	}
+
+	counters, err := e.Directory.Counters(ctx)
+	if err != nil {
+		return directory.Counter{}, err
+	}
+
+	for _, c := range counters {
+		if c.ID == counterID {
+			return c, nil
+		}
+	}
+	return directory.Counter{}, fmt.Errorf("unknown counter %q", counterID)
+}
+
+// dataQuery returns SQL selecting time, value and resolution, summing
+// directions stored at the same time and resolution. Rows within the span
+// of a coarser row for the same direction are left out, so data stored at
+// more than one resolution isn't counted twice. Day rows span their local
+// date in loc, which may be 23 or 25 hours around DST changes.
+func dataQuery(counterID, directionID string, start, end time.Time, loc *time.Location, limit int) string {
+	conds := []string{"counter_id=" + quote(counterID)}
+	if directionID != "" {
+		conds = append(conds, "direction_id="+quote(directionID))
+	}
+	if !start.IsZero() {
+		conds = append(conds, "time >= "+strconv.FormatInt(start.Unix(), 10))
+	}
+	if !end.IsZero() {
+		conds = append(conds, "time < "+strconv.FormatInt(end.Unix(), 10))
+	}
+
+	// Day rows can be up to 25 hours before the rows they cover.
+	lo, hi := start, end
+	if lo.IsZero() {
+		lo = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	if hi.IsZero() {
+		hi = time.Now()
+	}
+	lo, hi = lo.AddDate(0, 0, -2), hi.AddDate(0, 0, 2)
+	localDay := func(col string) string {
+		return "(" + col + " + " + offsetSQL(col, loc, lo, hi) + ") / 86400"
+	}
+
+	covered := "(c.resolution < 3 and c.time <= d.time and c.time > d.time - (case c.resolution when 1 then 60 else 3600 end))" +
+		" or (c.resolution = 3 and c.time <= d.time and c.time > d.time - 90000 and " + localDay("c.time") + " = " + localDay("d.time") + ")"
+	conds = append(conds, "not exists (select 1 from counter_data c where c.counter_id=d.counter_id and c.direction_id=d.direction_id and c.resolution > d.resolution and ("+covered+"))")
+	return "select time, sum(value), resolution from counter_data d where " + strings.Join(conds, " and ") + " group by time, resolution order by time, resolution limit " + strconv.Itoa(limit)
+}
+
+// offsetSQL returns SQL for the UTC offset in seconds of loc at the Unix
+// time in col, for times between lo and hi.
+func offsetSQL(col string, loc *time.Location, lo, hi time.Time) string {
+	_, off := lo.In(loc).Zone()
+	var b strings.Builder
+	for t := lo; ; {
+		_, next := t.In(loc).ZoneBounds()
+		if next.IsZero() || !next.Before(hi) {
+			break
+		}
+		_, noff := next.In(loc).Zone()
+		if noff != off {
+			fmt.Fprintf(&b, " when %s < %d then %d", col, next.Unix(), off)
+			off = noff
+		}
+		t = next
+	}
+	if b.Len() == 0 {
+		return strconv.Itoa(off)
+	}
+	return "(case" + b.String() + " else " + strconv.Itoa(off) + " end)"
+}
+
+// quote returns s as a SQL string literal.
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,200 @@
+package query
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Format is an output format for Series points written as rows.
+type Format string
+
+const (
+	FormatJSON   Format = "json"
+	FormatNDJSON Format = "ndjson"
+	FormatCSV    Format = "csv"
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatJSON, FormatNDJSON, FormatCSV:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown format %q", s)
+}
+
+// ContentType returns the MIME type of f.
+func (f Format) ContentType() string {
+	switch f {
+	case FormatNDJSON:
+		return "application/x-ndjson"
+	case FormatCSV:
+		return "text/csv"
+	}
+	return "application/json"
+}
+
+// A Row is a single Series point, as written by a RowWriter.
+type Row struct {
+	CounterID   string `json:"counter_id"`
+	DirectionID string `json:"direction_id"`
+	// Time is the UTC time of the point in RFC 3339 format.
+	Time string `json:"time"`
+	// LocalTime is the time of the point in the counter's time zone,
+	// without an offset.
+	LocalTime string  `json:"local_time"`
+	Value     float64 `json:"value"`
+}
+
+const localTimeFormat = "2006-01-02T15:04:05"
+
+var csvHeader = []string{"counter_id", "direction_id", "time", "local_time", "value"}
+
+// A RowWriter writes the points of one or more Series as rows, a Series at
+// a time, so large results don't need to be held in memory at once. A
+// Series may also be written in pieces, as passed by Engine.StreamSeries or
+// Engine.EachSeries.
+type RowWriter struct {
+	f  Format
+	bw *bufio.Writer
+	cw *csv.Writer
+
+	n int
+
+	// zone and loc are the time zone of the last Series written.
+	zone string
+	loc  *time.Location
+}
+
+// NewRowWriter returns a RowWriter writing rows to w in format f.
+// Close, or Abort if the rows can't all be written, must be called once
+// all Series are written.
+func NewRowWriter(w io.Writer, f Format) *RowWriter {
+	rw := &RowWriter{f: f, bw: bufio.NewWriter(w)}
+	if f == FormatCSV {
+		rw.cw = csv.NewWriter(rw.bw)
+	}
+	return rw
+}
+
+// WriteSeries writes the points of s and flushes them to the underlying
+// writer. Combined series have their counter IDs joined with "+".
+func (rw *RowWriter) WriteSeries(s Series) error {
+	id := s.CounterID
+	if id == "" {
+		id = strings.Join(s.CounterIDs, "+")
+	}
+
+	if rw.loc == nil || s.Zone != rw.zone {
+		loc, err := time.LoadLocation(s.Zone)
+		if err != nil {
+			loc = time.UTC
+		}
+		rw.zone, rw.loc = s.Zone, loc
+	}
+
+	for _, p := range s.Points {
+		r := Row{
+			CounterID:   id,
+			DirectionID: s.DirectionID,
+			Time:        p.Time.UTC().Format(time.RFC3339),
+			LocalTime:   p.Time.In(rw.loc).Format(localTimeFormat),
+			Value:       p.Value,
+		}
+		if err := rw.writeRow(r); err != nil {
+			return err
+		}
+	}
+	return rw.flush()
+}
+
+func (rw *RowWriter) writeRow(r Row) error {
+	defer func() { rw.n++ }()
+
+	switch rw.f {
+	case FormatCSV:
+		if rw.n == 0 {
+			if err := rw.cw.Write(csvHeader); err != nil {
+				return err
+			}
+		}
+		return rw.cw.Write([]string{r.CounterID, r.DirectionID, r.Time, r.LocalTime, strconv.FormatFloat(r.Value, 'f', -1, 64)})
+	case FormatNDJSON:
+		return json.NewEncoder(rw.bw).Encode(r)
+	}
+
+	sep := ","
+	if rw.n == 0 {
+		sep = "["
+	}
+	if _, err := rw.bw.WriteString(sep); err != nil {
+		return err
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = rw.bw.Write(b)
+	return err
+}
+
+func (rw *RowWriter) flush() error {
+	if rw.cw != nil {
+		rw.cw.Flush()
+		if err := rw.cw.Error(); err != nil {
+			return err
+		}
+	}
+	return rw.bw.Flush()
+}
+
+// Close finishes the output, closing the JSON array, or writing the CSV
+// header if no rows were written.
+func (rw *RowWriter) Close() error {
+	switch {
+	case rw.f == FormatJSON && rw.n == 0:
+		rw.bw.WriteString("[]\n")
+	case rw.f == FormatJSON:
+		rw.bw.WriteString("]\n")
+	case rw.f == FormatCSV && rw.n == 0:
+		rw.cw.Write(csvHeader)
+	}
+	return rw.flush()
+}
+
+// Abort ends output cut short by err with a record saying so, so a failed
+// export can't be mistaken for a complete one. For NDJSON this is an
+// object with an error field, for CSV a row of "error" and the message,
+// which has fewer fields than the header, and for JSON an object with an
+// error field as the last element of the array, which is then closed.
+func (rw *RowWriter) Abort(err error) error {
+	switch rw.f {
+	case FormatCSV:
+		if rw.n == 0 {
+			rw.cw.Write(csvHeader)
+		}
+		rw.cw.Write([]string{"error", err.Error()})
+	case FormatNDJSON:
+		json.NewEncoder(rw.bw).Encode(errorRecord{err.Error()})
+	default:
+		sep := ","
+		if rw.n == 0 {
+			sep = "["
+		}
+		b, _ := json.Marshal(errorRecord{err.Error()})
+		rw.bw.WriteString(sep)
+		rw.bw.Write(b)
+		rw.bw.WriteString("]\n")
+	}
+	return rw.flush()
+}
+
+// errorRecord is the record Abort writes for JSON formats.
+type errorRecord struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,391 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/danp/counterbase/directory"
+)
+
+// A Selector chooses counters from the directory.
+//
+// Each non-empty field must match for a counter to be selected, and a field
+// matches if any of its values do. An empty Selector selects all counters.
+type Selector struct {
+	CounterIDs []string
+	Tags       []string
+	Modes      []string
+}
+
+// Match reports whether s selects c.
+func (s Selector) Match(c directory.Counter) bool {
+	if len(s.CounterIDs) > 0 && !slices.Contains(s.CounterIDs, c.ID) {
+		return false
+	}
+	if len(s.Tags) > 0 && !slices.ContainsFunc(s.Tags, func(t string) bool { return slices.Contains(c.Tags, t) }) {
+		return false
+	}
+	if len(s.Modes) > 0 && !slices.Contains(s.Modes, c.Mode) {
+		return false
+	}
+	return true
+}
+
+// A GroupRequest asks for data from several counters at once.
+type GroupRequest struct {
+	Selector Selector
+
+	// Start, End and Resolution are as in Request.
+	Start, End time.Time
+	Resolution Resolution
+
+	// ByDirection returns a Series per counter direction rather than
+	// per counter.
+	ByDirection bool
+
+	// Combine returns a single Series totalling all selected counters.
+	// It can't be used with ByDirection. Without a Resolution, the
+	// counters' data must all be stored at the same resolution, so that
+	// only points covering the same period are summed.
+	Combine bool
+
+	// Window is as in Request. For a combined Series it applies to the
+	// combined totals.
+	Window Window
+}
+
+// Group returns data for the counters selected by req, one Series per
+// counter (or direction) in directory order, or a single combined Series.
+//
+// Periods without data are left out of each Series rather than being
+// treated as zero. In a combined Series, periods where a counter that was
+// in service had no data are listed in Partial.
+func (e *Engine) Group(ctx context.Context, req GroupRequest) ([]Series, error) {
+	var out []Series
+	err := e.eachPiece(ctx, req, func(s Series, first bool) error {
+		if first {
+			s.Points = append([]Point(nil), s.Points...)
+			out = append(out, s)
+			return nil
+		}
+		last := &out[len(out)-1]
+		last.Points = append(last.Points, s.Points...)
+		last.Partial = append(last.Partial, s.Partial...)
+		return nil
+	})
+	return out, err
+}
+
+// EachSeries calls fn with each Series that Group would return, in pieces
+// as its data is fetched, so long ranges aren't held in memory. Pieces of
+// a Series are passed one after another, each with the fields of the
+// Series and the next of its Points and Partial times. It stops at the
+// first error returned by fn.
+func (e *Engine) EachSeries(ctx context.Context, req GroupRequest, fn func(Series) error) error {
+	return e.eachPiece(ctx, req, func(s Series, _ bool) error { return fn(s) })
+}
+
+// eachPiece is EachSeries, also passing whether each piece is the first of
+// its Series.
+func (e *Engine) eachPiece(ctx context.Context, req GroupRequest, fn func(s Series, first bool) error) error {
+	if req.ByDirection && req.Combine {
+		return fmt.Errorf("can't combine and split by direction")
+	}
+	if err := req.Window.validate(req.Resolution); err != nil {
+		return err
+	}
+
+	counters, err := e.SelectCounters(ctx, req.Selector)
+	if err != nil {
+		return err
+	}
+	if len(counters) == 0 {
+		return fmt.Errorf("no counters selected")
+	}
+
+	if req.Combine {
+		return e.combined(ctx, req, counters, fn)
+	}
+
+	for _, c := range counters {
+		r := Request{CounterID: c.ID, Start: req.Start, End: req.End, Resolution: req.Resolution, Window: req.Window}
+
+		dirs := []string{""}
+		if req.ByDirection {
+			dirs = dirs[:0]
+			for _, d := range c.Directions {
+				dirs = append(dirs, d.ID)
+			}
+		}
+
+		for _, d := range dirs {
+			r.DirectionID = d
+			first := true
+			err := e.StreamSeries(ctx, r, func(s Series) error {
+				err := fn(s, first)
+				first = false
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// combined passes the combined Series of counters for req to fn in pieces.
+func (e *Engine) combined(ctx context.Context, req GroupRequest, counters []directory.Counter, fn func(s Series, first bool) error) error {
+	// Combined data is aggregated in the first counter's time zone.
+	loc, err := counters[0].TimeZone()
+	if err != nil {
+		return err
+	}
+
+	start := req.Start
+	if req.Window.Size > 0 && !start.IsZero() {
+		start = req.Resolution.back(req.Resolution.Bucket(start, loc), req.Window.Size-1)
+	}
+
+	m := &merger{counters: counters, loc: loc, res: req.Resolution}
+	for _, c := range counters {
+		var src pointStream = e.pager(c.ID, "", start, req.End, loc)
+		if req.Resolution != "" {
+			src = &aggregator{src: src, counterID: c.ID, loc: loc, res: req.Resolution}
+		}
+		m.srcs = append(m.srcs, src)
+
+		cloc, err := c.TimeZone()
+		if err != nil {
+			cloc = loc
+		}
+		m.clocs = append(m.clocs, cloc)
+	}
+
+	var rl *roller
+	var first time.Time
+	if req.Window.Size > 0 {
+		if !req.Start.IsZero() {
+			first = req.Resolution.Bucket(req.Start, loc)
+		}
+		rl = &roller{loc: loc, res: req.Resolution, w: req.Window, first: first}
+	}
+
+	cs := Series{
+		Resolution: req.Resolution,
+		Zone:       loc.String(),
+	}
+	for _, c := range counters {
+		cs.CounterIDs = append(cs.CounterIDs, c.ID)
+	}
+	if req.Window.Size > 0 {
+		cs.Window = req.Window.normalized()
+	}
+
+	sent := false
+	for {
+		pts, partial, err := m.next(ctx)
+		if err != nil {
+			return err
+		}
+		if pts == nil {
+			break
+		}
+
+		if rl != nil {
+			pts = rl.roll(pts)
+			for len(partial) > 0 && partial[0].Before(first) {
+				partial = partial[1:]
+			}
+		}
+		if len(pts) == 0 && len(partial) == 0 {
+			continue
+		}
+
+		piece := cs
+		piece.Points, piece.Partial = pts, partial
+		if err := fn(piece, !sent); err != nil {
+			return err
+		}
+		sent = true
+	}
+	if !sent {
+		cs.Points = []Point{}
+		return fn(cs, true)
+	}
+	return nil
+}
+
+// merger combines the points of several counters, one source each,
+// returning each period once every counter has passed it.
+type merger struct {
+	counters []directory.Counter
+	// clocs are the time zones of counters, used to check service dates.
+	clocs []*time.Location
+	srcs  []pointStream
+	loc   *time.Location
+	res   Resolution
+
+	// stored is the resolution raw points were stored at, when combining
+	// them without a Resolution.
+	stored Resolution
+
+	bufs [][]Point
+	done []bool
+}
+
+// next returns the next combined points and the times of those that are
+// partial, or nil points once there are no more.
+func (m *merger) next(ctx context.Context) ([]Point, []time.Time, error) {
+	if m.bufs == nil {
+		m.bufs = make([][]Point, len(m.srcs))
+		m.done = make([]bool, len(m.srcs))
+	}
+
+	for i, src := range m.srcs {
+		for len(m.bufs[i]) == 0 && !m.done[i] {
+			pts, err := src.next(ctx)
+			if err != nil {
+				return nil, nil, err
+			}
+			m.bufs[i], m.done[i] = pts, pts == nil
+		}
+	}
+
+	// Sources only return later points than they have, so points up to
+	// the earliest last point of those with more to come are final.
+	var until time.Time
+	bounded := false
+	for i, b := range m.bufs {
+		if m.done[i] {
+			continue
+		}
+		if t := b[len(b)-1].Time; !bounded || t.Before(until) {
+			until, bounded = t, true
+		}
+	}
+
+	parts := make([][]Point, len(m.bufs))
+	var n int
+	for i, b := range m.bufs {
+		j := len(b)
+		if bounded {
+			j = sort.Search(len(b), func(k int) bool { return b[k].Time.After(until) })
+		}
+		parts[i], m.bufs[i] = b[:j], b[j:]
+		n += j
+	}
+	if n == 0 {
+		return nil, nil, nil
+	}
+	if m.res == "" {
+		if err := m.checkStored(parts); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	pts, partial := combine(m.counters, m.clocs, parts, m.loc)
+	return pts, partial, nil
+}
+
+// checkStored returns an error wrapping ErrTooFine if parts holds raw
+// points stored at different resolutions, such as a day total and an hour
+// starting at the same time, which can't be summed.
+func (m *merger) checkStored(parts [][]Point) error {
+	for i, pts := range parts {
+		for _, p := range pts {
+			if p.Resolution == "" || p.Resolution == m.stored {
+				continue
+			}
+			if m.stored == "" {
+				m.stored = p.Resolution
+				continue
+			}
+			coarsest := m.stored
+			if m.stored.Finer(p.Resolution) {
+				coarsest = p.Resolution
+			}
+			return fmt.Errorf("%w: combining data stored by %s and %s (%s at %s) needs a resolution of %s or coarser", ErrTooFine, m.stored, p.Resolution, m.counters[i].ID, p.Time.Format(time.RFC3339), coarsest)
+		}
+	}
+	return nil
+}
+
+// combine sums pts, the points of each of counters, returning the totals
+// in loc and the times of those where a counter in service had no data.
+func combine(counters []directory.Counter, clocs []*time.Location, pts [][]Point, loc *time.Location) ([]Point, []time.Time) {
+	type period struct {
+		value float64
+		have  []string
+	}
+
+	periods := make(map[int64]*period)
+	for i, cpts := range pts {
+		for _, p := range cpts {
+			k := p.Time.Unix()
+			pp, ok := periods[k]
+			if !ok {
+				pp = &period{}
+				periods[k] = pp
+			}
+			pp.value += p.Value
+			pp.have = append(pp.have, counters[i].ID)
+		}
+	}
+
+	keys := make([]int64, 0, len(periods))
+	for k := range periods {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	out := make([]Point, 0, len(keys))
+	var partial []time.Time
+	for _, k := range keys {
+		t := time.Unix(k, 0).In(loc)
+		pp := periods[k]
+		out = append(out, Point{Time: t, Value: pp.value})
+
+		for i, c := range counters {
+			if len(c.ServiceRanges) > 0 && !c.InService(t, clocs[i]) {
+				continue
+			}
+			if !slices.Contains(pp.have, c.ID) {
+				partial = append(partial, t)
+				break
+			}
+		}
+	}
+	return out, partial
+}
+
+// SelectCounters returns the counters selected by sel, in directory order.
+// Without a Directory only sel.CounterIDs can be used.
+func (e *Engine) SelectCounters(ctx context.Context, sel Selector) ([]directory.Counter, error) {
+	if e.Directory == nil {
+		if len(sel.Tags) > 0 || len(sel.Modes) > 0 {
+			return nil, fmt.Errorf("selecting by tag or mode needs a directory")
+		}
+		var out []directory.Counter
+		for _, id := range sel.CounterIDs {
+			out = append(out, directory.Counter{ID: id})
+		}
+		return out, nil
+	}
+
+	counters, err := e.Directory.Counters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []directory.Counter
+	for _, c := range counters {
+		if sel.Match(c) {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
@@ -1,64 +1,467 @@
 package query
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
+
+	"github.com/danp/counterbase/directory"
 )
 
-type Client struct {
-	URL string
+// Handler serves Engine results over HTTP.
+//
+// Requests take counter, direction, start, end and resolution query
+// parameters matching the fields of Request. start and end may be dates
+// (YYYY-MM-DD, in the counter's time zone), RFC 3339 times, or Unix times.
+//
+// By default a Series is returned as JSON. A format parameter of json,
+// ndjson or csv instead streams its points as rows as they're fetched; see
+// Row.
+//
+// Rolling windows are requested with window (the number of periods),
+// window_func and window_min parameters matching the fields of Window.
+//
+// A limit parameter limits the number of points returned. When there are
+// more, the Series has next_cursor set and a Link header with rel="next"
+// gives the URL of the next page, which repeats the request with a
+// cursor parameter.
+type Handler struct {
+	Engine *Engine
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := h.parseRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if fs := r.URL.Query().Get("format"); fs != "" {
+		f, err := ParseFormat(fs)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeRows(w, f, func(fn func(Series) error) error {
+			if req.Limit == 0 {
+				return h.Engine.StreamSeries(r.Context(), req, fn)
+			}
+
+			// A limited Series is small, and is fetched whole so the
+			// Link header can be set before writing it.
+			s, err := h.Engine.Series(r.Context(), req)
+			if err != nil {
+				return err
+			}
+			setNextLink(w, r, s)
+			return fn(s)
+		})
+		return
+	}
+
+	s, err := h.Engine.Series(r.Context(), req)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	setNextLink(w, r, s)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// ServeCompare serves Engine.Compare results. In addition to the counter,
+// direction, start and end parameters, it takes years and align parameters
+// matching the fields of CompareRequest.
+func (h *Handler) ServeCompare(w http.ResponseWriter, r *http.Request) {
+	req, err := h.parseRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	creq := CompareRequest{
+		CounterID:   req.CounterID,
+		DirectionID: req.DirectionID,
+		Start:       req.Start,
+		End:         req.End,
+		Align:       Alignment(r.URL.Query().Get("align")),
+	}
+	if ys := r.URL.Query().Get("years"); ys != "" {
+		if creq.Years, err = strconv.Atoi(ys); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad years: %w", err))
+			return
+		}
+	}
+
+	if err := creq.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	cmp, err := h.Engine.Compare(r.Context(), creq)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmp)
+}
+
+// ServeRecords serves Engine.Records results. It takes one or more counter
+// parameters, and direction, resolution, n and check parameters matching
+// the fields of RecordsRequest.
+func (h *Handler) ServeRecords(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	req := RecordsRequest{
+		CounterIDs:  q["counter"],
+		DirectionID: q.Get("direction"),
+		Resolution:  Resolution(q.Get("resolution")),
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if ns := q.Get("n"); ns != "" {
+		n, err := strconv.Atoi(ns)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad n: %w", err))
+			return
+		}
+		req.N = n
+	}
+
+	if cs := q.Get("check"); cs != "" {
+		loc, err := h.Engine.Location(r.Context(), req.CounterIDs[0])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Check, err = ParseTime(cs, loc); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad check: %w", err))
+			return
+		}
+	}
+
+	recs, err := h.Engine.Records(r.Context(), req)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recs)
 }
 
-func (c *Client) Query(ctx context.Context, q string) ([]Point, error) {
-	u, err := url.Parse(c.URL)
+// ServeGroup serves Engine.Group results. It takes counter, tag and mode
+// parameters, each of which may be repeated, to build a Selector, along
+// with start, end, resolution, by_direction and combine parameters
+// matching the fields of GroupRequest. Like ServeHTTP it takes a format
+// parameter.
+func (h *Handler) ServeGroup(w http.ResponseWriter, r *http.Request) {
+	req, err := h.parseGroupRequest(r)
 	if err != nil {
-		return nil, err
+		writeError(w, http.StatusBadRequest, err)
+		return
 	}
 
-	uq := u.Query()
-	uq.Set("sql", q)
-	u.RawQuery = uq.Encode()
+	if fs := r.URL.Query().Get("format"); fs != "" {
+		f, err := ParseFormat(fs)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeRows(w, f, func(fn func(Series) error) error {
+			return h.Engine.EachSeries(r.Context(), req, fn)
+		})
+		return
+	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	series, err := h.Engine.Group(r.Context(), req)
 	if err != nil {
-		return nil, err
+		writeError(w, errorStatus(err), err)
+		return
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Series []Series `json:"series"`
+	}{series})
+}
+
+// ServeCoverage serves Engine.Coverage results. Like ServeGroup it takes
+// counter, tag and mode parameters, along with start, end and period
+// parameters matching the fields of CoverageRequest.
+func (h *Handler) ServeCoverage(w http.ResponseWriter, r *http.Request) {
+	sel, start, end, err := h.parseSelection(r)
 	if err != nil {
-		return nil, err
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	req := CoverageRequest{
+		Selector: sel,
+		Start:    start,
+		End:      end,
+		Period:   Resolution(r.URL.Query().Get("period")),
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
 	}
-	defer resp.Body.Close()
 
-	b, err := io.ReadAll(resp.Body)
+	cov, err := h.Engine.Coverage(r.Context(), req)
 	if err != nil {
-		return nil, err
+		writeError(w, errorStatus(err), err)
+		return
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("got bad status %d", resp.StatusCode)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Coverage []Coverage `json:"coverage"`
+	}{cov})
+}
+
+func (h *Handler) parseGroupRequest(r *http.Request) (GroupRequest, error) {
+	q := r.URL.Query()
+
+	sel, start, end, err := h.parseSelection(r)
+	if err != nil {
+		return GroupRequest{}, err
+	}
+	req := GroupRequest{
+		Selector: sel,
+		Start:    start,
+		End:      end,
+	}
+
+	if req.ByDirection, err = parseBool(q.Get("by_direction")); err != nil {
+		return GroupRequest{}, fmt.Errorf("bad by_direction: %w", err)
+	}
+	if req.Combine, err = parseBool(q.Get("combine")); err != nil {
+		return GroupRequest{}, fmt.Errorf("bad combine: %w", err)
+	}
+	if req.ByDirection && req.Combine {
+		return GroupRequest{}, fmt.Errorf("by_direction and combine can't be used together")
+	}
+
+	if rs := q.Get("resolution"); rs != "" {
+		if req.Resolution, err = ParseResolution(rs); err != nil {
+			return GroupRequest{}, err
+		}
 	}
 
-	var resps struct {
-		Rows [][]float64
+	if req.Window, err = parseWindow(q); err != nil {
+		return GroupRequest{}, err
 	}
-	if err := json.Unmarshal(b, &resps); err != nil {
-		return nil, err
+	if err := req.Window.validate(req.Resolution); err != nil {
+		return GroupRequest{}, err
 	}
 
-	var pts []Point
-	for _, row := range resps.Rows {
-		p := Point{
-			Time:  time.Unix(int64(row[0]), 0),
-			Value: row[1],
+	return req, nil
+}
+
+func parseWindow(q url.Values) (Window, error) {
+	var w Window
+	var err error
+	if ws := q.Get("window"); ws != "" {
+		if w.Size, err = strconv.Atoi(ws); err != nil {
+			return Window{}, fmt.Errorf("bad window: %w", err)
+		}
+	}
+	w.Func = WindowFunc(q.Get("window_func"))
+	if ms := q.Get("window_min"); ms != "" {
+		if w.MinPeriods, err = strconv.Atoi(ms); err != nil {
+			return Window{}, fmt.Errorf("bad window_min: %w", err)
 		}
-		pts = append(pts, p)
 	}
+	return w, nil
+}
+
+// parseSelection parses the counter, tag and mode parameters into a
+// Selector, and the start and end parameters in the zone of the first
+// selected counter.
+func (h *Handler) parseSelection(r *http.Request) (Selector, time.Time, time.Time, error) {
+	q := r.URL.Query()
+
+	sel := Selector{
+		CounterIDs: q["counter"],
+		Tags:       q["tag"],
+		Modes:      q["mode"],
+	}
+
+	loc, err := time.LoadLocation(directory.DefaultZone)
+	if err != nil {
+		return Selector{}, time.Time{}, time.Time{}, err
+	}
+	if counters, err := h.Engine.SelectCounters(r.Context(), sel); err != nil {
+		return Selector{}, time.Time{}, time.Time{}, err
+	} else if len(counters) > 0 {
+		if loc, err = counters[0].TimeZone(); err != nil {
+			return Selector{}, time.Time{}, time.Time{}, err
+		}
+	}
+
+	start, err := ParseTime(q.Get("start"), loc)
+	if err != nil {
+		return Selector{}, time.Time{}, time.Time{}, fmt.Errorf("bad start: %w", err)
+	}
+	end, err := ParseTime(q.Get("end"), loc)
+	if err != nil {
+		return Selector{}, time.Time{}, time.Time{}, fmt.Errorf("bad end: %w", err)
+	}
+
+	return sel, start, end, nil
+}
+
+func parseBool(s string) (bool, error) {
+	if s == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+func (h *Handler) parseRequest(r *http.Request) (Request, error) {
+	q := r.URL.Query()
+
+	req := Request{
+		CounterID:   q.Get("counter"),
+		DirectionID: q.Get("direction"),
+	}
+	if req.CounterID == "" {
+		return Request{}, fmt.Errorf("missing counter")
+	}
+
+	if rs := q.Get("resolution"); rs != "" {
+		res, err := ParseResolution(rs)
+		if err != nil {
+			return Request{}, err
+		}
+		req.Resolution = res
+	}
+
+	if ls := q.Get("limit"); ls != "" {
+		n, err := strconv.Atoi(ls)
+		if err != nil {
+			return Request{}, fmt.Errorf("bad limit: %w", err)
+		}
+		req.Limit = n
+	}
+	req.Cursor = q.Get("cursor")
+
+	w, err := parseWindow(q)
+	if err != nil {
+		return Request{}, err
+	}
+	req.Window = w
+
+	if err := req.validate(); err != nil {
+		return Request{}, err
+	}
+
+	loc, err := h.Engine.Location(r.Context(), req.CounterID)
+	if err != nil {
+		return Request{}, err
+	}
+
+	if req.Start, err = ParseTime(q.Get("start"), loc); err != nil {
+		return Request{}, fmt.Errorf("bad start: %w", err)
+	}
+	if req.End, err = ParseTime(q.Get("end"), loc); err != nil {
+		return Request{}, fmt.Errorf("bad end: %w", err)
+	}
+
+	return req, nil
+}
+
+// setNextLink sets a Link header for the next page of s, if there is one.
+func setNextLink(w http.ResponseWriter, r *http.Request, s Series) {
+	if s.NextCursor == "" {
+		return
+	}
+	u := *r.URL
+	q := u.Query()
+	q.Set("cursor", s.NextCursor)
+	u.RawQuery = q.Encode()
+	w.Header().Set("Link", "<"+u.RequestURI()+`>; rel="next"`)
+}
+
+// ParseTime parses s as a date (YYYY-MM-DD) in loc, an RFC 3339 time, or
+// Unix time in seconds. A blank s returns the zero time.
+func ParseTime(s string, loc *time.Location) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", s)
+}
+
+// writeRows writes the Series passed to fn by each as rows in format f,
+// flushing after each. Nothing is sent until the first row, so if each
+// fails before then an error response is sent. Otherwise the output ends
+// with an error record; see RowWriter.Abort.
+func writeRows(w http.ResponseWriter, f Format, each func(fn func(Series) error) error) {
+	rw := NewRowWriter(w, f)
+	err := each(func(s Series) error {
+		if len(s.Points) == 0 {
+			return nil
+		}
+		if rw.n == 0 {
+			w.Header().Set("Content-Type", f.ContentType())
+		}
+		if err := rw.WriteSeries(s); err != nil {
+			return err
+		}
+		if fl, ok := w.(http.Flusher); ok {
+			fl.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if rw.n == 0 {
+			writeError(w, errorStatus(err), err)
+		} else {
+			rw.Abort(err)
+		}
+		return
+	}
+
+	if rw.n == 0 {
+		w.Header().Set("Content-Type", f.ContentType())
+	}
+	rw.Close()
+}
+
+// errorStatus returns the HTTP status for an Engine error.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNoData):
+		return http.StatusNotFound
+	case errors.Is(err, ErrTooFine):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
 
-	return pts, nil
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{err.Error()})
 }
@@ -1,14 +1,26 @@
 package query_test
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/danp/counterbase/directory"
+	"github.com/danp/counterbase/internal/testutil"
 	"github.com/danp/counterbase/query"
+	"github.com/danp/counterbase/submit"
 	"github.com/google/go-cmp/cmp"
+	_ "modernc.org/sqlite"
 )
 
 func TestClientQuery(t *testing.T) {
@@ -43,3 +55,1343 @@ func TestClientQuery(t *testing.T) {
 		t.Error(d)
 	}
 }
+
+func TestClientErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		body   string
+		want   query.Error
+	}{
+		{
+			"datasette",
+			http.StatusBadRequest,
+			`{"ok": false, "error": "no such column: nope", "status": 400, "title": "Invalid SQL"}`,
+			query.Error{StatusCode: 400, Title: "Invalid SQL", Message: "no such column: nope"},
+		},
+		{
+			"plain",
+			http.StatusBadGateway,
+			"upstream unavailable\n",
+			query.Error{StatusCode: 502, Message: "upstream unavailable"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(c.status)
+				io.WriteString(w, c.body)
+			}))
+			defer srv.Close()
+
+			cl := &query.Client{URL: srv.URL}
+			_, err := cl.Query(context.Background(), "select nope")
+
+			var qe *query.Error
+			if !errors.As(err, &qe) {
+				t.Fatalf("got error %v, want *query.Error", err)
+			}
+			if d := cmp.Diff(c.want, *qe); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestQueryRows(t *testing.T) {
+	const resp = `{"rows": [["south-park", "nb", 1616727600, 12.5, null], ["south-park", "sb", 1616731200, 3, "x"]], "truncated": false, "columns": ["counter_id", "direction_id", "time", "total", "note"]}`
+
+	var used bool
+	cl := &query.Client{
+		URL: "http://datasette.example/data.json",
+		HTTPClient: &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			used = true
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": {"application/json"}},
+				Body:       io.NopCloser(bytes.NewBufferString(resp)),
+			}, nil
+		})},
+	}
+
+	type row struct {
+		CounterID   string  `json:"counter_id"`
+		DirectionID string  `json:"direction_id"`
+		Time        int64   `json:"time"`
+		Total       float64 `json:"total"`
+		Note        *string `json:"note"`
+	}
+
+	got, err := query.QueryRows[row](context.Background(), cl, "select counter_id, direction_id, time, total, note from totals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !used {
+		t.Error("HTTPClient not used")
+	}
+
+	x := "x"
+	want := []row{
+		{CounterID: "south-park", DirectionID: "nb", Time: 1616727600, Total: 12.5},
+		{CounterID: "south-park", DirectionID: "sb", Time: 1616731200, Total: 3, Note: &x},
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestClientQueryTruncated(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Act like a Datasette with max_returned_rows set to 2.
+		m := regexp.MustCompile(`time >= (\d+)`).FindStringSubmatch(r.URL.Query().Get("sql"))
+		start, _ := strconv.ParseInt(m[1], 10, 64)
+
+		var rows [][]float64
+		for t := int64(1616727600); t < 1616727600+5*3600 && len(rows) < 2; t += 3600 {
+			if t >= start {
+				rows = append(rows, []float64{float64(t), 1})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"rows": rows, "truncated": len(rows) == 2})
+	}))
+	defer srv.Close()
+
+	cl := &query.Client{URL: srv.URL}
+
+	pts, err := cl.Query(context.Background(), "select time, sum(value) from counter_data where time >= 1616727600")
+	if !errors.Is(err, query.ErrTruncated) {
+		t.Fatalf("got error %v, want ErrTruncated", err)
+	}
+	if len(pts) != 2 {
+		t.Errorf("got %d points with ErrTruncated, want 2", len(pts))
+	}
+
+	// The Engine carries on after truncated pages.
+	e := &query.Engine{Querier: cl}
+	s, err := e.Series(context.Background(), query.Request{CounterID: "south-park", Start: time.Unix(1616727600, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Points) != 5 {
+		t.Errorf("got %d points, want 5", len(s.Points))
+	}
+}
+
+func TestEngineSeriesPages(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, loc)
+	var pts []query.Point
+	for h := 0; h < 24*3; h++ {
+		pts = append(pts, query.Point{Time: start.Add(time.Duration(h) * time.Hour), Value: 1})
+	}
+
+	e := &query.Engine{Querier: testutil.DataQuerier{"south-park": {"nb": pts}}, PageSize: 7}
+
+	// Follow cursors through all the hourly points.
+	req := query.Request{CounterID: "south-park", Limit: 10}
+	var got []query.Point
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("too many pages")
+		}
+		s, err := e.Series(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s.Points) > req.Limit {
+			t.Fatalf("got %d points, want at most %d", len(s.Points), req.Limit)
+		}
+		got = append(got, s.Points...)
+		if s.NextCursor == "" {
+			break
+		}
+		req.Cursor = s.NextCursor
+	}
+	if d := cmp.Diff(pts, got); d != "" {
+		t.Error(d)
+	}
+
+	// Periods aren't split across pages.
+	req = query.Request{CounterID: "south-park", Resolution: query.ResolutionDay, Limit: 2}
+	s, err := e.Series(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []query.Point{
+		{Time: start, Value: 24},
+		{Time: start.AddDate(0, 0, 1), Value: 24},
+	}
+	if d := cmp.Diff(want, s.Points); d != "" {
+		t.Error(d)
+	}
+
+	req.Cursor = s.NextCursor
+	s, err = e.Series(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []query.Point{{Time: start.AddDate(0, 0, 2), Value: 24}}
+	if d := cmp.Diff(want, s.Points); d != "" {
+		t.Error(d)
+	}
+	if s.NextCursor != "" {
+		t.Errorf("got next cursor %q on last page", s.NextCursor)
+	}
+
+	// Pages hold 6 points, the 7th being fetched again with the next page.
+	// A limit ending on a page boundary gets no empty trailing piece, and
+	// no cursor if nothing is after it.
+	for _, limit := range []int{6, 72} {
+		req = query.Request{CounterID: "south-park", Limit: limit}
+		var pieces []query.Series
+		err := e.StreamSeries(context.Background(), req, func(s query.Series) error {
+			pieces = append(pieces, s)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := pieces[len(pieces)-1]
+		if len(last.Points) == 0 {
+			t.Errorf("limit %d: got empty last piece", limit)
+		}
+		var n int
+		for _, p := range pieces {
+			n += len(p.Points)
+		}
+		if n != limit {
+			t.Errorf("limit %d: got %d points, want %d", limit, n, limit)
+		}
+		wantCursor := ""
+		if limit < len(pts) {
+			wantCursor = strconv.FormatInt(pts[limit].Time.Unix(), 10)
+		}
+		if last.NextCursor != wantCursor {
+			t.Errorf("limit %d: got next cursor %q, want %q", limit, last.NextCursor, wantCursor)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// DST starts at 2am on 2021-03-14, making that day 23 hours long.
+	var pts []query.Point
+	for h := time.Date(2021, 3, 13, 0, 0, 0, 0, loc); h.Before(time.Date(2021, 3, 16, 0, 0, 0, 0, loc)); h = h.Add(time.Hour) {
+		pts = append(pts, query.Point{Time: h, Value: 1})
+	}
+
+	cases := []struct {
+		res  query.Resolution
+		want []query.Point
+	}{
+		{
+			query.ResolutionDay,
+			[]query.Point{
+				{Time: time.Date(2021, 3, 13, 0, 0, 0, 0, loc), Value: 24},
+				{Time: time.Date(2021, 3, 14, 0, 0, 0, 0, loc), Value: 23},
+				{Time: time.Date(2021, 3, 15, 0, 0, 0, 0, loc), Value: 24},
+			},
+		},
+		{
+			query.ResolutionWeek,
+			[]query.Point{
+				{Time: time.Date(2021, 3, 8, 0, 0, 0, 0, loc), Value: 47},
+				{Time: time.Date(2021, 3, 15, 0, 0, 0, 0, loc), Value: 24},
+			},
+		},
+		{
+			query.ResolutionMonth,
+			[]query.Point{
+				{Time: time.Date(2021, 3, 1, 0, 0, 0, 0, loc), Value: 71},
+			},
+		},
+		{
+			query.ResolutionYear,
+			[]query.Point{
+				{Time: time.Date(2021, 1, 1, 0, 0, 0, 0, loc), Value: 71},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(string(c.res), func(t *testing.T) {
+			got := query.Aggregate(pts, loc, c.res)
+			if d := cmp.Diff(c.want, got); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
+
+func TestResolutionBucketHour(t *testing.T) {
+	loc, err := time.LoadLocation("America/St_Johns")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm := time.Date(2021, 6, 1, 10, 45, 12, 0, loc)
+	if got, want := query.ResolutionHour.Bucket(tm, loc), time.Date(2021, 6, 1, 10, 0, 0, 0, loc); !got.Equal(want) {
+		t.Errorf("got bucket %v, want %v", got, want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	loc, err := time.LoadLocation("America/Vancouver")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2021, 3, 26, 0, 0, 0, 0, loc)
+	end := time.Date(2021, 3, 28, 0, 0, 0, 0, loc)
+
+	que := fakeQuerier{
+		P: map[string][]query.Point{
+			"select time, sum(value), resolution from counter_data d where counter_id='south-park' and direction_id='nb' and time >= " + strconv.FormatInt(start.Unix(), 10) + " and time < " + strconv.FormatInt(end.Unix(), 10) + " and not exists (select 1 from counter_data c where c.counter_id=d.counter_id and c.direction_id=d.direction_id and c.resolution > d.resolution and ((c.resolution < 3 and c.time <= d.time and c.time > d.time - (case c.resolution when 1 then 60 else 3600 end)) or (c.resolution = 3 and c.time <= d.time and c.time > d.time - 90000 and (c.time + -25200) / 86400 = (d.time + -25200) / 86400))) group by time, resolution order by time, resolution limit 1000": {
+				{Time: start.Add(1 * time.Hour), Value: 1},
+				{Time: start.Add(2 * time.Hour), Value: 2},
+				{Time: start.Add(25 * time.Hour), Value: 3},
+			},
+		},
+	}
+
+	dir := testutil.Directory{
+		C: []directory.Counter{{ID: "south-park", Zone: "America/Vancouver"}},
+	}
+
+	h := &query.Handler{
+		Engine: &query.Engine{Querier: que, Directory: dir},
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "?counter=south-park&direction=nb&start=2021-03-26&end=2021-03-28&resolution=day")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("got status %d, want %d", got, want)
+	}
+
+	var got query.Series
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := query.Series{
+		CounterID:   "south-park",
+		DirectionID: "nb",
+		Resolution:  query.ResolutionDay,
+		Zone:        "America/Vancouver",
+		Points: []query.Point{
+			{Time: start, Value: 3},
+			{Time: start.AddDate(0, 0, 1), Value: 3},
+		},
+	}
+	if d := cmp.Diff(want, got, cmp.Comparer(func(a, b time.Time) bool { return a.Equal(b) })); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestHandlerUnknownCounter(t *testing.T) {
+	h := &query.Handler{
+		Engine: &query.Engine{Querier: fakeQuerier{}, Directory: testutil.Directory{}},
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "?counter=nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+		t.Fatalf("got status %d, want %d", got, want)
+	}
+}
+
+type fakeQuerier struct {
+	P map[string][]query.Point
+}
+
+func (f fakeQuerier) Query(ctx context.Context, q string) ([]query.Point, error) {
+	return append([]query.Point(nil), f.P[q]...), nil
+}
+
+func TestEngineCompare(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 12, 0, 0, 0, loc) }
+
+	que := testutil.DataQuerier{
+		"south-park": {
+			"nb": {
+				{Time: day(2019, 6, 3), Value: 10},
+				{Time: day(2020, 6, 1), Value: 50},
+				{Time: day(2020, 6, 3), Value: 20},
+				{Time: day(2021, 6, 3), Value: 30},
+			},
+		},
+	}
+
+	e := &query.Engine{Querier: que}
+
+	req := query.CompareRequest{
+		CounterID: "south-park",
+		Start:     time.Date(2021, 6, 3, 0, 0, 0, 0, loc),
+		End:       time.Date(2021, 6, 4, 0, 0, 0, 0, loc),
+		Years:     2,
+	}
+
+	got, err := e.Compare(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr := func(f float64) *float64 { return &f }
+	want := query.Comparison{
+		CounterID: "south-park",
+		Align:     query.AlignDate,
+		Zone:      "America/Halifax",
+		Period:    query.PeriodTotal{Start: req.Start, End: req.End, Total: 30},
+		Prior: []query.PeriodTotal{
+			{Start: req.Start.AddDate(-1, 0, 0), End: req.End.AddDate(-1, 0, 0), Total: 20, Change: ptr(10), PercentChange: ptr(50)},
+			{Start: req.Start.AddDate(-2, 0, 0), End: req.End.AddDate(-2, 0, 0), Total: 10, Change: ptr(20), PercentChange: ptr(200)},
+		},
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Error(d)
+	}
+
+	// 2021-06-03 was a Thursday, 52 weeks earlier is 2020-06-04.
+	req.Years = 1
+	req.Align = query.AlignWeekday
+	got, err = e.Compare(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := got.Prior[0].Start, time.Date(2020, 6, 4, 0, 0, 0, 0, loc); !got.Equal(want) {
+		t.Errorf("got prior start %v, want %v", got, want)
+	}
+	if got.Prior[0].PercentChange != nil {
+		t.Errorf("got percent change %v for zero prior total, want nil", *got.Prior[0].PercentChange)
+	}
+}
+
+func TestEngineRecords(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, loc) }
+	hour := func(y int, m time.Month, d, h int) time.Time { return time.Date(y, m, d, h, 0, 0, 0, loc) }
+
+	que := testutil.DataQuerier{
+		"a": {
+			"nb": {
+				{Time: hour(2020, 6, 1, 8), Value: 10},
+				{Time: hour(2020, 6, 2, 8), Value: 30},
+				{Time: hour(2020, 6, 3, 8), Value: 500},
+				{Time: hour(2021, 6, 1, 8), Value: 20},
+				{Time: hour(2021, 6, 2, 8), Value: 5},
+			},
+		},
+		"b": {
+			"sb": {
+				{Time: hour(2021, 6, 1, 9), Value: 5},
+				{Time: hour(2021, 6, 2, 9), Value: 6},
+				{Time: hour(2021, 6, 3, 9), Value: 20},
+			},
+		},
+	}
+
+	dir := testutil.Directory{
+		C: []directory.Counter{
+			{
+				ID: "a",
+				BadData: []directory.BadDataRange{
+					{Start: directory.SD(time.Date(2020, 6, 3, 0, 0, 0, 0, time.UTC)), End: directory.SD(time.Date(2020, 6, 3, 0, 0, 0, 0, time.UTC)), Note: "stuck sensor"},
+				},
+			},
+			{ID: "b"},
+		},
+	}
+
+	e := &query.Engine{Querier: que, Directory: dir}
+
+	got, err := e.Records(context.Background(), query.RecordsRequest{
+		CounterIDs: []string{"a", "b"},
+		Resolution: query.ResolutionDay,
+		N:          2,
+		Check:      hour(2021, 6, 3, 12),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	since := query.Point{Time: day(2021, 6, 1), Value: 25}
+	want := query.Records{
+		CounterIDs: []string{"a", "b"},
+		Resolution: query.ResolutionDay,
+		Zone:       "America/Halifax",
+		AllTime: []query.Point{
+			{Time: day(2020, 6, 2), Value: 30},
+			{Time: day(2021, 6, 1), Value: 25},
+		},
+		Years: []query.YearRecords{
+			{Year: 2021, Top: []query.Point{{Time: day(2021, 6, 1), Value: 25}, {Time: day(2021, 6, 3), Value: 20}}},
+			{Year: 2020, Top: []query.Point{{Time: day(2020, 6, 2), Value: 30}, {Time: day(2020, 6, 1), Value: 10}}},
+		},
+		Check: &query.RecordCheck{
+			Period:      query.Point{Time: day(2021, 6, 3), Value: 20},
+			AllTimeRank: 3,
+			YearRank:    2,
+			Since:       &since,
+		},
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Error(d)
+	}
+
+	_, err = e.Records(context.Background(), query.RecordsRequest{
+		CounterIDs: []string{"a"},
+		Resolution: query.ResolutionDay,
+		Check:      hour(2021, 7, 1, 0),
+	})
+	if !errors.Is(err, query.ErrNoData) {
+		t.Errorf("got error %v, want ErrNoData", err)
+	}
+}
+
+func TestEngineRecordsTie(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := func(d int) time.Time { return time.Date(2021, 6, d, 0, 0, 0, 0, loc) }
+
+	que := testutil.DataQuerier{
+		"a": {
+			"nb": {
+				{Time: day(1), Value: 30},
+				{Time: day(2), Value: 10},
+				{Time: day(3), Value: 30},
+			},
+		},
+	}
+	e := &query.Engine{Querier: que, Directory: testutil.Directory{C: []directory.Counter{{ID: "a"}}}}
+
+	cases := []struct {
+		check    time.Time
+		wantRank int
+	}{
+		{day(1), 1},
+		{day(2), 3},
+		// Matching the record isn't a new one.
+		{day(3), 2},
+	}
+	for _, tc := range cases {
+		got, err := e.Records(context.Background(), query.RecordsRequest{
+			CounterIDs: []string{"a"},
+			Resolution: query.ResolutionDay,
+			Check:      tc.check,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Check.AllTimeRank != tc.wantRank || got.Check.YearRank != tc.wantRank {
+			t.Errorf("%s: got ranks %d and %d, want %d", tc.check.Format(time.DateOnly), got.Check.AllTimeRank, got.Check.YearRank, tc.wantRank)
+		}
+		if got.Check.IsRecord() != (tc.wantRank == 1) {
+			t.Errorf("%s: got IsRecord %v", tc.check.Format(time.DateOnly), got.Check.IsRecord())
+		}
+	}
+}
+
+func TestEngineGroup(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := func(d int) time.Time { return time.Date(2021, 6, d, 0, 0, 0, 0, loc) }
+	hour := func(d, h int) time.Time { return time.Date(2021, 6, d, h, 0, 0, 0, loc) }
+
+	que := testutil.DataQuerier{
+		"a": {
+			"nb": {{Time: hour(1, 8), Value: 1}, {Time: hour(2, 8), Value: 2}},
+			"sb": {{Time: hour(1, 9), Value: 3}},
+		},
+		"b": {
+			"nb": {{Time: hour(1, 8), Value: 10}},
+		},
+		"c": {
+			"non": {{Time: hour(1, 8), Value: 100}},
+		},
+	}
+
+	inService := []directory.ServiceRange{{Start: directory.SD(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))}}
+	dir := testutil.Directory{
+		C: []directory.Counter{
+			{ID: "a", Mode: "cycling", Tags: []string{"downtown"}, ServiceRanges: inService, Directions: []directory.Direction{{ID: "nb"}, {ID: "sb"}}},
+			{ID: "b", Mode: "cycling", ServiceRanges: inService, Directions: []directory.Direction{{ID: "nb"}}},
+			{ID: "c", Mode: "bus", Tags: []string{"downtown"}, ServiceRanges: inService, Directions: []directory.Direction{{ID: "non"}}},
+		},
+	}
+
+	e := &query.Engine{Querier: que, Directory: dir}
+
+	t.Run("combine", func(t *testing.T) {
+		got, err := e.Group(context.Background(), query.GroupRequest{
+			Selector:   query.Selector{Modes: []string{"cycling"}},
+			Resolution: query.ResolutionDay,
+			Combine:    true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []query.Series{
+			{
+				Resolution: query.ResolutionDay,
+				Zone:       "America/Halifax",
+				CounterIDs: []string{"a", "b"},
+				Points:     []query.Point{{Time: day(1), Value: 14}, {Time: day(2), Value: 2}},
+				Partial:    []time.Time{day(2)},
+			},
+		}
+		if d := cmp.Diff(want, got); d != "" {
+			t.Error(d)
+		}
+	})
+
+	t.Run("by direction", func(t *testing.T) {
+		got, err := e.Group(context.Background(), query.GroupRequest{
+			Selector:    query.Selector{Tags: []string{"downtown"}},
+			Resolution:  query.ResolutionDay,
+			ByDirection: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []query.Series{
+			{CounterID: "a", DirectionID: "nb", Resolution: query.ResolutionDay, Zone: "America/Halifax", Points: []query.Point{{Time: day(1), Value: 1}, {Time: day(2), Value: 2}}},
+			{CounterID: "a", DirectionID: "sb", Resolution: query.ResolutionDay, Zone: "America/Halifax", Points: []query.Point{{Time: day(1), Value: 3}}},
+			{CounterID: "c", DirectionID: "non", Resolution: query.ResolutionDay, Zone: "America/Halifax", Points: []query.Point{{Time: day(1), Value: 100}}},
+		}
+		if d := cmp.Diff(want, got); d != "" {
+			t.Error(d)
+		}
+	})
+}
+
+func TestRowWriter(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	series := []query.Series{
+		{CounterID: "a", DirectionID: "nb", Zone: "America/Halifax", Points: []query.Point{{Time: time.Date(2021, 6, 1, 8, 0, 0, 0, loc), Value: 1}}},
+		{CounterIDs: []string{"a", "b"}, Zone: "America/Halifax", Points: []query.Point{{Time: time.Date(2021, 6, 1, 9, 0, 0, 0, loc), Value: 2.5}}},
+	}
+
+	cases := []struct {
+		f    query.Format
+		want string
+	}{
+		{
+			query.FormatCSV,
+			"counter_id,direction_id,time,local_time,value\n" +
+				"a,nb,2021-06-01T11:00:00Z,2021-06-01T08:00:00,1\n" +
+				"a+b,,2021-06-01T12:00:00Z,2021-06-01T09:00:00,2.5\n",
+		},
+		{
+			query.FormatNDJSON,
+			`{"counter_id":"a","direction_id":"nb","time":"2021-06-01T11:00:00Z","local_time":"2021-06-01T08:00:00","value":1}` + "\n" +
+				`{"counter_id":"a+b","direction_id":"","time":"2021-06-01T12:00:00Z","local_time":"2021-06-01T09:00:00","value":2.5}` + "\n",
+		},
+		{
+			query.FormatJSON,
+			`[{"counter_id":"a","direction_id":"nb","time":"2021-06-01T11:00:00Z","local_time":"2021-06-01T08:00:00","value":1},` +
+				`{"counter_id":"a+b","direction_id":"","time":"2021-06-01T12:00:00Z","local_time":"2021-06-01T09:00:00","value":2.5}]` + "\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(string(c.f), func(t *testing.T) {
+			var buf bytes.Buffer
+			rw := query.NewRowWriter(&buf, c.f)
+			for _, s := range series {
+				if err := rw.WriteSeries(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := rw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if d := cmp.Diff(c.want, buf.String()); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	rw := query.NewRowWriter(&buf, query.FormatJSON)
+	if err := rw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "[]\n"; got != want {
+		t.Errorf("got empty JSON %q, want %q", got, want)
+	}
+}
+
+func TestHandlerGroupCSV(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	que := testutil.DataQuerier{
+		"a": {"nb": {{Time: time.Date(2021, 6, 1, 8, 0, 0, 0, loc), Value: 1}}},
+		"b": {"nb": {{Time: time.Date(2021, 6, 1, 9, 0, 0, 0, loc), Value: 2}}},
+	}
+
+	dir := testutil.Directory{
+		C: []directory.Counter{{ID: "a", Mode: "cycling"}, {ID: "b", Mode: "cycling"}, {ID: "c", Mode: "bus"}},
+	}
+
+	h := &query.Handler{
+		Engine: &query.Engine{Querier: que, Directory: dir},
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(h.ServeGroup))
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "?mode=cycling&resolution=day&format=csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if got, want := resp.Header.Get("Content-Type"), "text/csv"; got != want {
+		t.Errorf("got Content-Type %q, want %q", got, want)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "counter_id,direction_id,time,local_time,value\n" +
+		"a,,2021-06-01T03:00:00Z,2021-06-01T00:00:00,1\n" +
+		"b,,2021-06-01T03:00:00Z,2021-06-01T00:00:00,2\n"
+	if d := cmp.Diff(want, string(b)); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestEngineCoverage(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hour := func(d, h int) time.Time { return time.Date(2021, 6, d, h, 0, 0, 0, loc) }
+
+	var nb []query.Point
+	for h := 0; h < 24; h++ {
+		if h == 5 {
+			continue
+		}
+		v := 1.0
+		if h < 2 {
+			v = 0
+		}
+		nb = append(nb, query.Point{Time: hour(1, h), Value: v})
+	}
+	// Out of service on 2021-06-02, so not counted.
+	nb = append(nb, query.Point{Time: hour(2, 12), Value: 1})
+
+	dir := testutil.Directory{C: []directory.Counter{
+		{
+			ID: "south-park",
+			ServiceRanges: []directory.ServiceRange{
+				{Start: directory.SD(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)), End: directory.SD(time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC))},
+				{Start: directory.SD(time.Date(2021, 6, 3, 0, 0, 0, 0, time.UTC))},
+			},
+			Directions: []directory.Direction{
+				{ID: "nb", Resolution: "hour"},
+				{ID: "sb", Resolution: "day"},
+			},
+		},
+	}}
+	que := testutil.DataQuerier{"south-park": {
+		"nb": nb,
+		"sb": {{Time: hour(3, 0), Value: 5}},
+	}}
+
+	e := &query.Engine{Querier: que, Directory: dir}
+
+	got, err := e.Coverage(context.Background(), query.CoverageRequest{
+		Selector: query.Selector{CounterIDs: []string{"south-park"}},
+		Start:    hour(1, 0),
+		End:      hour(5, 0),
+		Period:   query.ResolutionDay,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pct := func(f float64) *float64 { return &f }
+	day := func(d int) query.PeriodCoverage { return query.PeriodCoverage{Start: hour(d, 0), End: hour(d+1, 0)} }
+	with := func(p query.PeriodCoverage, exp, pres, zero int, pc *float64) query.PeriodCoverage {
+		p.Expected, p.Present, p.Zero, p.PercentComplete = exp, pres, zero, pc
+		return p
+	}
+
+	want := []query.Coverage{
+		{
+			CounterID: "south-park", DirectionID: "nb", Interval: "hour", Zone: "America/Halifax",
+			Periods: []query.PeriodCoverage{
+				with(day(1), 24, 23, 2, pct(float64(23)/24*100)),
+				day(2),
+				with(day(3), 24, 0, 0, pct(0)),
+				with(day(4), 24, 0, 0, pct(0)),
+			},
+		},
+		{
+			CounterID: "south-park", DirectionID: "sb", Interval: "day", Zone: "America/Halifax",
+			Periods: []query.PeriodCoverage{
+				with(day(1), 1, 0, 0, pct(0)),
+				day(2),
+				with(day(3), 1, 1, 0, pct(100)),
+				with(day(4), 1, 0, 0, pct(0)),
+			},
+		},
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestRolling(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := func(d int) time.Time { return time.Date(2021, 6, d, 0, 0, 0, 0, loc) }
+
+	// No data on 2021-06-04.
+	pts := []query.Point{
+		{Time: day(1), Value: 1},
+		{Time: day(2), Value: 2},
+		{Time: day(3), Value: 6},
+		{Time: day(5), Value: 4},
+		{Time: day(6), Value: 5},
+	}
+
+	cases := []struct {
+		name string
+		w    query.Window
+		want []query.Point
+	}{
+		{
+			"mean",
+			query.Window{Size: 3},
+			[]query.Point{
+				{Time: day(3), Value: 3},
+			},
+		},
+		{
+			"mean min",
+			query.Window{Size: 3, MinPeriods: 2},
+			[]query.Point{
+				{Time: day(2), Value: 1.5},
+				{Time: day(3), Value: 3},
+				{Time: day(4), Value: 4},
+				{Time: day(5), Value: 5},
+				{Time: day(6), Value: 4.5},
+			},
+		},
+		{
+			"sum",
+			query.Window{Size: 2, Func: query.WindowSum},
+			[]query.Point{
+				{Time: day(2), Value: 3},
+				{Time: day(3), Value: 8},
+				{Time: day(6), Value: 9},
+			},
+		},
+		{
+			"median",
+			query.Window{Size: 3, Func: query.WindowMedian, MinPeriods: 3},
+			[]query.Point{
+				{Time: day(3), Value: 2},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := query.Rolling(pts, loc, query.ResolutionDay, c.w)
+			if d := cmp.Diff(c.want, got); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
+
+func TestEngineSeriesWindow(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := func(d int) time.Time { return time.Date(2021, 6, d, 12, 0, 0, 0, loc) }
+
+	var pts []query.Point
+	for d := 1; d <= 10; d++ {
+		pts = append(pts, query.Point{Time: day(d), Value: float64(d)})
+	}
+	e := &query.Engine{Querier: testutil.DataQuerier{"south-park": {"nb": pts}}}
+
+	// The window looks back before Start.
+	s, err := e.Series(context.Background(), query.Request{
+		CounterID:  "south-park",
+		Start:      time.Date(2021, 6, 8, 0, 0, 0, 0, loc),
+		Resolution: query.ResolutionDay,
+		Window:     query.Window{Size: 3, Func: query.WindowSum},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []query.Point{
+		{Time: time.Date(2021, 6, 8, 0, 0, 0, 0, loc), Value: 6 + 7 + 8},
+		{Time: time.Date(2021, 6, 9, 0, 0, 0, 0, loc), Value: 7 + 8 + 9},
+		{Time: time.Date(2021, 6, 10, 0, 0, 0, 0, loc), Value: 8 + 9 + 10},
+	}
+	if d := cmp.Diff(want, s.Points); d != "" {
+		t.Error(d)
+	}
+
+	if _, err := e.Series(context.Background(), query.Request{CounterID: "south-park", Window: query.Window{Size: 3}}); err == nil {
+		t.Error("got no error for window without resolution")
+	}
+}
+
+// sqliteQuerier runs queries against an in-memory counter_data table.
+type sqliteQuerier struct {
+	db *sql.DB
+}
+
+func newSQLiteQuerier(t *testing.T) sqliteQuerier {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("create table counter_data (counter_id text not null, direction_id text not null, time integer not null, resolution integer not null, value numeric not null, primary key(counter_id, direction_id, time))"); err != nil {
+		t.Fatal(err)
+	}
+	return sqliteQuerier{db: db}
+}
+
+func (s sqliteQuerier) add(t *testing.T, direction string, tm time.Time, res submit.Resolution, value float64) {
+	s.addTo(t, "south-park", direction, tm, res, value)
+}
+
+func (s sqliteQuerier) addTo(t *testing.T, counterID, direction string, tm time.Time, res submit.Resolution, value float64) {
+	if _, err := s.db.Exec("insert into counter_data values (?, ?, ?, ?, ?)", counterID, direction, tm.Unix(), res, value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (s sqliteQuerier) Query(ctx context.Context, q string) ([]query.Point, error) {
+	rows, err := s.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pts []query.Point
+	for rows.Next() {
+		var t, res int64
+		var p query.Point
+		if err := rows.Scan(&t, &p.Value, &res); err != nil {
+			return nil, err
+		}
+		p.Time = time.Unix(t, 0)
+		p.Resolution = query.StoredResolution(res)
+		pts = append(pts, p)
+	}
+	return pts, rows.Err()
+}
+
+func TestEngineMixedResolutions(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2021, 6, 1, 0, 0, 0, 0, loc)
+
+	que := newSQLiteQuerier(t)
+	// nb reports hourly.
+	for h := 0; h < 48; h++ {
+		que.add(t, "nb", day.Add(time.Duration(h)*time.Hour), submit.ResolutionHour, 1)
+	}
+	// sb reports daily, but also has some hourly data for the first day
+	// that its daily total covers.
+	que.add(t, "sb", day, submit.ResolutionDay, 100)
+	que.add(t, "sb", day.Add(time.Hour), submit.ResolutionHour, 40)
+	que.add(t, "sb", day.Add(2*time.Hour), submit.ResolutionHour, 60)
+	que.add(t, "sb", day.AddDate(0, 0, 1), submit.ResolutionDay, 200)
+
+	e := &query.Engine{Querier: que, PageSize: 5}
+
+	s, err := e.Series(context.Background(), query.Request{CounterID: "south-park", Resolution: query.ResolutionDay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []query.Point{
+		{Time: day, Value: 24 + 100},
+		{Time: day.AddDate(0, 0, 1), Value: 24 + 200},
+	}
+	if d := cmp.Diff(want, s.Points); d != "" {
+		t.Error(d)
+	}
+
+	// Raw points at the same time are kept apart by resolution.
+	s, err = e.Series(context.Background(), query.Request{CounterID: "south-park", End: day.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []query.Point{
+		{Time: day, Value: 1, Resolution: query.ResolutionHour},
+		{Time: day, Value: 100, Resolution: query.ResolutionDay},
+	}
+	if d := cmp.Diff(want, s.Points); d != "" {
+		t.Error(d)
+	}
+
+	_, err = e.Series(context.Background(), query.Request{CounterID: "south-park", Resolution: query.ResolutionHour})
+	if !errors.Is(err, query.ErrTooFine) {
+		t.Errorf("got error %v for hourly data from daily rows, want ErrTooFine", err)
+	}
+
+	s, err = e.Series(context.Background(), query.Request{CounterID: "south-park", DirectionID: "nb", Resolution: query.ResolutionHour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Points) != 48 {
+		t.Errorf("got %d hourly points for nb, want 48", len(s.Points))
+	}
+}
+
+func TestEngineMixedResolutionsDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// March 14 2021 has 23 hours in Halifax and November 7 has 25.
+	for _, day := range []time.Time{
+		time.Date(2021, 3, 14, 0, 0, 0, 0, loc),
+		time.Date(2021, 11, 7, 0, 0, 0, 0, loc),
+	} {
+		t.Run(day.Format("2006-01-02"), func(t *testing.T) {
+			next := day.AddDate(0, 0, 1)
+
+			que := newSQLiteQuerier(t)
+			que.add(t, "sb", day, submit.ResolutionDay, 100)
+			for h := day.Add(time.Hour); h.Before(next.Add(3 * time.Hour)); h = h.Add(time.Hour) {
+				que.add(t, "sb", h, submit.ResolutionHour, 1)
+			}
+
+			e := &query.Engine{Querier: que, PageSize: 5}
+			dir := testutil.Directory{C: []directory.Counter{{ID: "south-park", Zone: "America/Halifax"}}}
+			e.Directory = dir
+
+			// Every hour of the local day is covered by its day row, and
+			// none of the next.
+			s, err := e.Series(context.Background(), query.Request{CounterID: "south-park"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []query.Point{
+				{Time: day, Value: 100, Resolution: query.ResolutionDay},
+				{Time: next, Value: 1, Resolution: query.ResolutionHour},
+				{Time: next.Add(time.Hour), Value: 1, Resolution: query.ResolutionHour},
+				{Time: next.Add(2 * time.Hour), Value: 1, Resolution: query.ResolutionHour},
+			}
+			if d := cmp.Diff(want, s.Points); d != "" {
+				t.Error(d)
+			}
+
+			s, err = e.Series(context.Background(), query.Request{CounterID: "south-park", Start: day, End: next.AddDate(0, 0, 1), Resolution: query.ResolutionDay})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want = []query.Point{{Time: day, Value: 100}, {Time: next, Value: 3}}
+			if d := cmp.Diff(want, s.Points); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
+
+func TestEngineCombineMixedResolutions(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2021, 6, 1, 0, 0, 0, 0, loc)
+
+	que := newSQLiteQuerier(t)
+	// bike reports hourly and bus daily.
+	for h := 0; h < 48; h++ {
+		que.addTo(t, "bike", "nb", day.Add(time.Duration(h)*time.Hour), submit.ResolutionHour, 1)
+	}
+	que.addTo(t, "bus", "all", day, submit.ResolutionDay, 100)
+	que.addTo(t, "bus", "all", day.AddDate(0, 0, 1), submit.ResolutionDay, 200)
+
+	dir := testutil.Directory{C: []directory.Counter{
+		{ID: "bike", Zone: "America/Halifax"},
+		{ID: "bus", Zone: "America/Halifax"},
+	}}
+	e := &query.Engine{Querier: que, Directory: dir, PageSize: 5}
+	sel := query.Selector{CounterIDs: []string{"bike", "bus"}}
+
+	// The bus's day totals can't be added to the bike's midnight hours.
+	_, err = e.Group(context.Background(), query.GroupRequest{Selector: sel, Combine: true})
+	if !errors.Is(err, query.ErrTooFine) {
+		t.Errorf("got error %v combining raw hourly and daily data, want ErrTooFine", err)
+	}
+
+	_, err = e.Group(context.Background(), query.GroupRequest{Selector: sel, Resolution: query.ResolutionHour, Combine: true})
+	if !errors.Is(err, query.ErrTooFine) {
+		t.Errorf("got error %v combining hourly, want ErrTooFine", err)
+	}
+
+	got, err := e.Group(context.Background(), query.GroupRequest{Selector: sel, Resolution: query.ResolutionDay, Combine: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []query.Point{
+		{Time: day, Value: 24 + 100},
+		{Time: day.AddDate(0, 0, 1), Value: 24 + 200},
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d series, want 1", len(got))
+	}
+	if d := cmp.Diff(want, got[0].Points); d != "" {
+		t.Error(d)
+	}
+
+	// Raw data stored at the same resolution still combines.
+	got, err = e.Group(context.Background(), query.GroupRequest{Selector: query.Selector{CounterIDs: []string{"bike"}}, End: day.Add(2 * time.Hour), Combine: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []query.Point{{Time: day, Value: 1}, {Time: day.Add(time.Hour), Value: 1}}
+	if d := cmp.Diff(want, got[0].Points); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestEngineStreaming(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, loc)
+	que := testutil.DataQuerier{"a": {"nb": nil}, "b": {"nb": nil}}
+	for h := 0; h < 24*10; h++ {
+		tm := start.Add(time.Duration(h) * time.Hour)
+		que["a"]["nb"] = append(que["a"]["nb"], query.Point{Time: tm, Value: float64(h % 7)})
+		// b is missing the third day.
+		if h/24 != 2 {
+			que["b"]["nb"] = append(que["b"]["nb"], query.Point{Time: tm, Value: 1})
+		}
+	}
+
+	inService := []directory.ServiceRange{{Start: directory.SD(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))}}
+	dir := testutil.Directory{C: []directory.Counter{{ID: "a", ServiceRanges: inService}, {ID: "b", ServiceRanges: inService}}}
+
+	// Small pages give the same results as whole ones, in pieces.
+	whole := &query.Engine{Querier: que, Directory: dir}
+	paged := &query.Engine{Querier: que, Directory: dir, PageSize: 5}
+
+	window := query.Window{Size: 3, Func: query.WindowMedian, MinPeriods: 2}
+	from := start.AddDate(0, 0, 4)
+
+	reqs := map[string]query.GroupRequest{
+		"raw":             {Selector: query.Selector{CounterIDs: []string{"a", "b"}}},
+		"hour":            {Selector: query.Selector{CounterIDs: []string{"a"}}, Resolution: query.ResolutionHour},
+		"day window":      {Selector: query.Selector{CounterIDs: []string{"a", "b"}}, Start: from, Resolution: query.ResolutionDay, Window: window},
+		"combine":         {Selector: query.Selector{CounterIDs: []string{"a", "b"}}, Combine: true},
+		"combine day":     {Selector: query.Selector{CounterIDs: []string{"a", "b"}}, Resolution: query.ResolutionDay, Combine: true},
+		"combine windows": {Selector: query.Selector{CounterIDs: []string{"a", "b"}}, Start: from, Resolution: query.ResolutionHour, Window: window, Combine: true},
+	}
+	for name, req := range reqs {
+		t.Run(name, func(t *testing.T) {
+			want, err := whole.Group(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := paged.Group(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(want, got); d != "" {
+				t.Error(d)
+			}
+
+			var pieces int
+			if err := paged.EachSeries(context.Background(), req, func(query.Series) error { pieces++; return nil }); err != nil {
+				t.Fatal(err)
+			}
+			if pieces <= len(want) {
+				t.Errorf("got %d pieces for %d series, want more", pieces, len(want))
+			}
+		})
+	}
+}
+
+func TestHandlerStreamError(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, loc)
+	var pts []query.Point
+	for h := 0; h < 24; h++ {
+		pts = append(pts, query.Point{Time: start.Add(time.Duration(h) * time.Hour), Value: 1})
+	}
+
+	// The second page fails.
+	que := &failingQuerier{Querier: testutil.DataQuerier{"south-park": {"nb": pts}}, after: 1}
+	h := &query.Handler{
+		Engine: &query.Engine{Querier: que, PageSize: 10},
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	cases := []struct {
+		format string
+		last   string
+	}{
+		{"ndjson", `{"error":"query failed"}`},
+		{"csv", "error,query failed"},
+		{"json", `"value":1},{"error":"query failed"}]`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.format, func(t *testing.T) {
+			que.calls = 0
+
+			resp, err := srv.Client().Get(srv.URL + "?counter=south-park&format=" + c.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if got, want := resp.StatusCode, http.StatusOK; got != want {
+				t.Fatalf("got status %d, want %d", got, want)
+			}
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+			if got := lines[len(lines)-1]; !strings.HasSuffix(got, c.last) {
+				t.Errorf("got last line %q, want it to end with %q", got, c.last)
+			}
+			if c.format == "json" {
+				var rows []map[string]any
+				if err := json.Unmarshal(b, &rows); err != nil {
+					t.Errorf("output isn't a JSON array: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerStreamErrorBeforeRows(t *testing.T) {
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	// a has no data, so nothing is written before b's query fails.
+	que := &failingQuerier{Querier: testutil.DataQuerier{"b": {"nb": {{Time: start, Value: 1}}}}, after: 1}
+	h := &query.Handler{
+		Engine: &query.Engine{Querier: que},
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(h.ServeGroup))
+	defer srv.Close()
+
+	for _, format := range []string{"json", "ndjson", "csv"} {
+		t.Run(format, func(t *testing.T) {
+			que.calls = 0
+
+			resp, err := srv.Client().Get(srv.URL + "?counter=a&counter=b&format=" + format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if got, want := resp.StatusCode, http.StatusInternalServerError; got != want {
+				t.Errorf("got status %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+// failingQuerier fails queries after the first after.
+type failingQuerier struct {
+	query.Querier
+	after int
+	calls int
+}
+
+func (f *failingQuerier) Query(ctx context.Context, q string) ([]query.Point, error) {
+	f.calls++
+	if f.calls > f.after {
+		return nil, errors.New("query failed")
+	}
+	return f.Querier.Query(ctx, q)
+}
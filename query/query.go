@@ -2,9 +2,23 @@ package query
 
 import (
 	"time"
+
+	"github.com/danp/counterbase/submit"
 )
 
 type Point struct {
-	Time  time.Time
-	Value float64
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	// Resolution is the resolution a point was stored at, if known.
+	// It's blank for aggregated points.
+	Resolution Resolution `json:"resolution,omitempty"`
+}
+
+// StoredResolution returns the Resolution for the resolution column of
+// counter_data, or blank if it isn't known.
+func StoredResolution(n int64) Resolution {
+	if r := submit.Resolution(n); r.Valid() {
+		return Resolution(r.String())
+	}
+	return ""
 }
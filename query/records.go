@@ -0,0 +1,211 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrNoData is returned when data needed to answer a request is missing.
+var ErrNoData = errors.New("no data")
+
+// DefaultRecordsN is used when RecordsRequest.N is zero.
+const DefaultRecordsN = 5
+
+// A RecordsRequest asks for the highest periods of one or more counters.
+type RecordsRequest struct {
+	// CounterIDs are the counters to include. Their data is summed.
+	CounterIDs []string
+	// DirectionID limits data to a single direction of each counter.
+	DirectionID string
+
+	Resolution Resolution
+
+	// N is how many periods to return. If zero, DefaultRecordsN is used.
+	N int
+
+	// Check, if set, is a time within a period to check for a record,
+	// such as one that was just submitted.
+	Check time.Time
+}
+
+// Records are the highest periods for a RecordsRequest.
+//
+// Data within counters' bad data ranges is excluded. When more than one
+// counter is included, periods are in the time zone of the first.
+type Records struct {
+	CounterIDs []string   `json:"counter_ids"`
+	Resolution Resolution `json:"resolution"`
+	Zone       string     `json:"zone"`
+
+	// AllTime are the highest periods, highest first.
+	AllTime []Point `json:"all_time"`
+
+	// Years are the highest periods within each year, most recent year first.
+	Years []YearRecords `json:"years"`
+
+	// Check is set if RecordsRequest.Check was.
+	Check *RecordCheck `json:"check,omitempty"`
+}
+
+type YearRecords struct {
+	Year int     `json:"year"`
+	Top  []Point `json:"top"`
+}
+
+// A RecordCheck describes how a period ranks.
+type RecordCheck struct {
+	Period Point `json:"period"`
+
+	// AllTimeRank and YearRank are the period's 1-based rank overall
+	// and within its year. Earlier periods with the same value rank above
+	// it, so a period that ties a record doesn't set a new one.
+	AllTimeRank int `json:"all_time_rank"`
+	YearRank    int `json:"year_rank"`
+
+	// Since is the most recent earlier period with a value at least as
+	// high, if there is one. It's useful for "highest since" reporting.
+	Since *Point `json:"since,omitempty"`
+}
+
+// IsRecord reports whether the period is the highest ever.
+func (c RecordCheck) IsRecord() bool { return c.AllTimeRank == 1 }
+
+// IsYearRecord reports whether the period is the highest in its year.
+func (c RecordCheck) IsYearRecord() bool { return c.YearRank == 1 }
+
+// Records returns the highest periods for req.
+func (e *Engine) Records(ctx context.Context, req RecordsRequest) (Records, error) {
+	if err := req.validate(); err != nil {
+		return Records{}, err
+	}
+
+	n := req.N
+	if n <= 0 {
+		n = DefaultRecordsN
+	}
+
+	pts, loc, err := e.groupPoints(ctx, req.CounterIDs, req.DirectionID)
+	if err != nil {
+		return Records{}, err
+	}
+
+	if err := checkStored(pts, req.Resolution); err != nil {
+		return Records{}, err
+	}
+	periods := Aggregate(pts, loc, req.Resolution)
+
+	recs := Records{
+		CounterIDs: req.CounterIDs,
+		Resolution: req.Resolution,
+		Zone:       loc.String(),
+		AllTime:    top(periods, n),
+	}
+
+	byYear := make(map[int][]Point)
+	var years []int
+	for _, p := range periods {
+		y := p.Time.Year()
+		if _, ok := byYear[y]; !ok {
+			years = append(years, y)
+		}
+		byYear[y] = append(byYear[y], p)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(years)))
+	for _, y := range years {
+		recs.Years = append(recs.Years, YearRecords{Year: y, Top: top(byYear[y], n)})
+	}
+
+	if !req.Check.IsZero() {
+		b := req.Resolution.Bucket(req.Check, loc)
+		i := sort.Search(len(periods), func(i int) bool { return !periods[i].Time.Before(b) })
+		if i == len(periods) || !periods[i].Time.Equal(b) {
+			return Records{}, fmt.Errorf("%w for period starting %s", ErrNoData, b.Format(time.RFC3339))
+		}
+
+		chk := &RecordCheck{
+			Period:      periods[i],
+			AllTimeRank: rank(periods, periods[i]),
+			YearRank:    rank(byYear[b.Year()], periods[i]),
+		}
+		for j := i - 1; j >= 0; j-- {
+			if periods[j].Value >= periods[i].Value {
+				since := periods[j]
+				chk.Since = &since
+				break
+			}
+		}
+		recs.Check = chk
+	}
+
+	return recs, nil
+}
+
+func (r RecordsRequest) validate() error {
+	if len(r.CounterIDs) == 0 {
+		return fmt.Errorf("missing counter")
+	}
+	if _, err := ParseResolution(string(r.Resolution)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// groupPoints returns the summed points for counterIDs, excluding bad data,
+// along with the time zone of the first counter.
+func (e *Engine) groupPoints(ctx context.Context, counterIDs []string, directionID string) ([]Point, *time.Location, error) {
+	var loc *time.Location
+	var pts []Point
+	for _, id := range counterIDs {
+		c, err := e.counter(ctx, id)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		cloc, err := c.TimeZone()
+		if err != nil {
+			return nil, nil, err
+		}
+		if loc == nil {
+			loc = cloc
+		}
+
+		s, err := e.Series(ctx, Request{CounterID: id, DirectionID: directionID})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, p := range s.Points {
+			if !c.IsBadData(p.Time, cloc) {
+				pts = append(pts, p)
+			}
+		}
+	}
+
+	sort.SliceStable(pts, func(i, j int) bool { return pts[i].Time.Before(pts[j].Time) })
+	return pts, loc, nil
+}
+
+// top returns the n highest of pts, highest first. Ties go to the earlier point.
+func top(pts []Point, n int) []Point {
+	sorted := append([]Point(nil), pts...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Value > sorted[j].Value })
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// rank returns the 1-based rank of p among pts. Ties go to the earlier
+// point, as in top.
+func rank(pts []Point, p Point) int {
+	r := 1
+	for _, o := range pts {
+		if o.Value > p.Value || (o.Value == p.Value && o.Time.Before(p.Time)) {
+			r++
+		}
+	}
+	return r
+}
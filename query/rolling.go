@@ -0,0 +1,209 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A WindowFunc combines the periods in a rolling window.
+type WindowFunc string
+
+const (
+	WindowSum    WindowFunc = "sum"
+	WindowMean   WindowFunc = "mean"
+	WindowMedian WindowFunc = "median"
+)
+
+// A Window is a rolling window over periods of a Resolution, such as a
+// 7 day mean.
+type Window struct {
+	// Size is the number of periods in the window, ending with the
+	// period being computed.
+	Size int `json:"size"`
+
+	// Func combines the periods with data in the window.
+	// If blank, WindowMean is used.
+	Func WindowFunc `json:"func"`
+
+	// MinPeriods is how many periods in the window must have data for a
+	// value to be computed. Periods without data are left out rather than
+	// treated as zero. If zero, all Size periods are required.
+	MinPeriods int `json:"min_periods,omitempty"`
+}
+
+// validate checks w for use with periods of r. A zero Window is valid.
+func (w Window) validate(r Resolution) error {
+	if w == (Window{}) {
+		return nil
+	}
+	if r == "" {
+		return fmt.Errorf("window needs a resolution")
+	}
+	if w.Size < 1 {
+		return fmt.Errorf("bad window size %d", w.Size)
+	}
+	switch w.Func {
+	case "", WindowSum, WindowMean, WindowMedian:
+	default:
+		return fmt.Errorf("unknown window func %q", w.Func)
+	}
+	if w.MinPeriods < 0 || w.MinPeriods > w.Size {
+		return fmt.Errorf("bad window min periods %d", w.MinPeriods)
+	}
+	return nil
+}
+
+// normalized returns a copy of w with defaults filled in.
+func (w Window) normalized() *Window {
+	if w.Func == "" {
+		w.Func = WindowMean
+	}
+	if w.MinPeriods == 0 {
+		w.MinPeriods = w.Size
+	}
+	return &w
+}
+
+// Rolling applies w to pts, which must be periods of r in loc as returned
+// by Aggregate. There is a point for each period from the first of pts to
+// the last whose window has enough periods with data, including periods
+// that have no data themselves.
+func Rolling(pts []Point, loc *time.Location, r Resolution, w Window) []Point {
+	if len(pts) == 0 || w.Size < 1 {
+		return nil
+	}
+
+	min := w.MinPeriods
+	if min <= 0 {
+		min = w.Size
+	}
+
+	// Each period, with or without data, from first to last.
+	type period struct {
+		t    time.Time
+		v    float64
+		have bool
+	}
+	var periods []period
+	i := 0
+	for b := r.Bucket(pts[0].Time, loc); !b.After(pts[len(pts)-1].Time); b = r.Next(b) {
+		p := period{t: b}
+		if i < len(pts) && pts[i].Time.Equal(b) {
+			p.v, p.have = pts[i].Value, true
+			i++
+		}
+		periods = append(periods, p)
+	}
+
+	var out []Point
+	for j := range periods {
+		var vals []float64
+		for k := max(0, j-w.Size+1); k <= j; k++ {
+			if periods[k].have {
+				vals = append(vals, periods[k].v)
+			}
+		}
+		if len(vals) < min {
+			continue
+		}
+		out = append(out, Point{Time: periods[j].t, Value: w.apply(vals)})
+	}
+	return out
+}
+
+// roller applies a Window to the periods of src a chunk at a time.
+type roller struct {
+	src pointStream
+	loc *time.Location
+	res Resolution
+	w   Window
+
+	// first, if set, is the first period to return.
+	first time.Time
+
+	// hist holds the last periods seen, enough to fill a window for the
+	// next chunk.
+	hist []Point
+}
+
+func (r *roller) next(ctx context.Context) ([]Point, error) {
+	for {
+		pts, err := r.src.next(ctx)
+		if err != nil || pts == nil {
+			return nil, err
+		}
+		if out := r.roll(pts); len(out) > 0 {
+			return out, nil
+		}
+	}
+}
+
+// roll returns the windowed periods for pts, the next chunk of periods.
+func (r *roller) roll(pts []Point) []Point {
+	all := append(append([]Point(nil), r.hist...), pts...)
+
+	out := Rolling(all, r.loc, r.res, r.w)
+	if n := len(r.hist); n > 0 {
+		// Periods up to the last of hist were returned with earlier chunks.
+		out = from(out, r.res.Next(r.hist[n-1].Time))
+	}
+	if !r.first.IsZero() {
+		out = from(out, r.first)
+	}
+
+	r.hist = append(r.hist[:0:0], all[max(0, len(all)-(r.w.Size-1)):]...)
+	return out
+}
+
+func (w Window) apply(vals []float64) float64 {
+	switch w.Func {
+	case WindowSum:
+		var sum float64
+		for _, v := range vals {
+			sum += v
+		}
+		return sum
+	case WindowMedian:
+		return Median(vals)
+	}
+
+	var sum float64
+	for _, v := range vals {
+		sum += v
+	}
+	return sum / float64(len(vals))
+}
+
+// Median returns the median of vals, which must not be empty. vals is not
+// modified.
+func Median(vals []float64) float64 {
+	s := append([]float64(nil), vals...)
+	sort.Float64s(s)
+	n := len(s)
+	if n%2 == 1 {
+		return s[n/2]
+	}
+	return (s[n/2-1] + s[n/2]) / 2
+}
+
+// back returns the start of the period n periods of r before b, which
+// should be a value returned by Bucket.
+func (r Resolution) back(b time.Time, n int) time.Time {
+	switch r {
+	case ResolutionMinute:
+		return b.Add(-time.Duration(n) * time.Minute)
+	case ResolutionHour:
+		return b.Add(-time.Duration(n) * time.Hour)
+	case ResolutionDay:
+		return b.AddDate(0, 0, -n)
+	case ResolutionWeek:
+		return b.AddDate(0, 0, -7*n)
+	case ResolutionMonth:
+		return b.AddDate(0, -n, 0)
+	case ResolutionYear:
+		return b.AddDate(-n, 0, 0)
+	}
+	return b
+}
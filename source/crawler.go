@@ -2,14 +2,17 @@ package source
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/url"
 	"slices"
 	"time"
 
 	"github.com/danp/counterbase/directory"
+	"github.com/danp/counterbase/metrics"
 	"github.com/danp/counterbase/query"
 	"github.com/danp/counterbase/submit"
 )
@@ -27,18 +30,83 @@ type Crawler struct {
 	Querier   Querier
 	Submitter submit.Submitter
 
+	// Selector, if not empty, limits Run to the counters it selects.
+	// Run fails if Selector.CounterIDs names a counter not in Directory.
+	Selector query.Selector
+	// Schemes, if not empty, limits Run to directions with source URLs
+	// using these schemes.
+	Schemes []string
+	// IncludeInactive has Run crawl counters that are no longer in
+	// service, as well as active ones.
+	IncludeInactive bool
+
+	// Metrics, if set, records what Run does.
+	Metrics *CrawlerMetrics
+
+	// Logger is used to log what Run does, with a run_id attribute
+	// identifying each Run. If nil, slog.Default is used.
+	Logger *slog.Logger
+
 	getters map[string]Getter
 }
 
+// CrawlerMetrics are the metrics recorded by a Crawler. Any may be nil.
+type CrawlerMetrics struct {
+	// GetDuration observes how long each Get takes, in seconds, by
+	// scheme.
+	GetDuration *metrics.Histogram
+	// GetErrors counts failed Gets by scheme.
+	GetErrors *metrics.Counter
+	// PointsWritten counts points inserted or updated.
+	PointsWritten *metrics.Counter
+	// LastSuccess is set to the Unix time of the last crawl of each
+	// counter, by counter ID, in which every direction was fetched and
+	// submitted.
+	LastSuccess *metrics.Gauge
+}
+
+// NewCrawlerMetrics registers CrawlerMetrics with r.
+func NewCrawlerMetrics(r *metrics.Registry) *CrawlerMetrics {
+	return &CrawlerMetrics{
+		GetDuration:   r.Histogram("counterbase_crawler_get_duration_seconds", "Time taken to get counter data from a source.", []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120}, "scheme"),
+		GetErrors:     r.Counter("counterbase_crawler_get_errors", "Failed gets of counter data from a source.", "scheme"),
+		PointsWritten: r.Counter("counterbase_crawler_points_written", "Points inserted or updated by the crawler."),
+		LastSuccess:   r.Gauge("counterbase_crawler_last_success_timestamp_seconds", "Time of the last crawl of a counter where all directions succeeded.", "counter_id"),
+	}
+}
+
 type GetRequest struct {
 	URL   *url.URL
 	After time.Time
+
+	// Options are the options of the direction's source.
+	Options map[string]string
+	// Location is the counter's time zone.
+	Location *time.Location
+
+	// Logger has attributes for the run, counter, direction and scheme
+	// being fetched. If nil, Getters log to slog.Default.
+	Logger *slog.Logger
+}
+
+func (r GetRequest) logger() *slog.Logger {
+	if r.Logger != nil {
+		return r.Logger
+	}
+	return slog.Default()
 }
 
 type Getter interface {
 	Get(ctx context.Context, req GetRequest) ([]submit.Point, error)
 }
 
+// A Committer is a Getter that needs to know when the points it returned
+// for a request have been submitted, such as to record what it has read.
+type Committer interface {
+	Getter
+	Commit(ctx context.Context, req GetRequest) error
+}
+
 func (c *Crawler) AddGetter(scheme string, getter Getter) {
 	if c.getters == nil {
 		c.getters = make(map[string]Getter)
@@ -51,22 +119,61 @@ func (c *Crawler) Run(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	for _, id := range c.Selector.CounterIDs {
+		if !slices.ContainsFunc(counters, func(ctr directory.Counter) bool { return ctr.ID == id }) {
+			return fmt.Errorf("unknown counter %q", id)
+		}
+	}
+
+	m := c.Metrics
+	if m == nil {
+		m = &CrawlerMetrics{}
+	}
+
+	logger := c.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger = logger.With("run_id", newRunID())
+
+	start := time.Now()
+	logger.InfoContext(ctx, "crawl started", "counters", len(counters))
 
 	var getErrs []error
 	for _, ctr := range counters {
-		if !ctr.IsActive() {
+		if !c.IncludeInactive && !ctr.IsActive() {
+			continue
+		}
+		if !c.Selector.Match(ctr) {
+			continue
+		}
+		if len(ctr.ServiceRanges) == 0 {
+			logger.WarnContext(ctx, "no service ranges, skipping", "counter_id", ctr.ID)
 			continue
 		}
 
+		loc, err := ctr.TimeZone()
+		if err != nil {
+			logger.ErrorContext(ctx, "bad time zone, skipping", "counter_id", ctr.ID, "err", err)
+			getErrs = append(getErrs, fmt.Errorf("time zone for %v: %w", ctr.ID, err))
+			continue
+		}
+
+		succeeded, crawled := true, false
 		for _, dir := range ctr.Directions {
 			dsurl, err := url.Parse(dir.Source.URL)
 			if err != nil {
 				return err
 			}
+			if len(c.Schemes) > 0 && !slices.Contains(c.Schemes, dsurl.Scheme) {
+				continue
+			}
+			crawled = true
+			dirLog := logger.With("counter_id", ctr.ID, "direction_id", dir.ID, "scheme", dsurl.Scheme)
 
 			gtr, ok := c.getters[dsurl.Scheme]
 			if !ok {
-				return fmt.Errorf("no getter for active counter %q direction %q source URL %q", ctr.ID, dir.ID, dir.Source.URL)
+				return fmt.Errorf("no getter for counter %q direction %q source URL %q", ctr.ID, dir.ID, dir.Source.URL)
 			}
 
 			after := ctr.ServiceRanges[len(ctr.ServiceRanges)-1].Start.Add(-1 * time.Minute)
@@ -78,13 +185,20 @@ func (c *Crawler) Run(ctx context.Context) error {
 				after = latest[0].Time
 				if slices.Contains(ctr.Tags, "backdate1d") {
 					after = after.AddDate(0, 0, -1)
-					log.Println("backdating", ctr.ID, "request to", after.Format(time.RFC3339))
+					dirLog.InfoContext(ctx, "backdating request", "after", after.Format(time.RFC3339))
 				}
 			}
 
-			pts, err := gtr.Get(ctx, GetRequest{URL: dsurl, After: after})
+			getStart := time.Now()
+			greq := GetRequest{URL: dsurl, After: after, Options: dir.Source.Options, Location: loc, Logger: dirLog}
+			pts, err := gtr.Get(ctx, greq)
+			getTime := time.Since(getStart)
+			m.GetDuration.Observe(getTime.Seconds(), dsurl.Scheme)
 			if err != nil {
+				m.GetErrors.Inc(dsurl.Scheme)
+				dirLog.ErrorContext(ctx, "get failed", "after", after.Format(time.RFC3339), "duration", getTime, "err", err)
 				getErrs = append(getErrs, fmt.Errorf("Get for %v %v after %v: %w", ctr.ID, dir, after, err))
+				succeeded = false
 				continue
 			}
 
@@ -94,11 +208,34 @@ func (c *Crawler) Run(ctx context.Context) error {
 				Points:      pts,
 			}
 
-			if err := c.Submitter.Submit(ctx, req); err != nil {
+			res, err := c.Submitter.Submit(ctx, req)
+			if err != nil {
+				dirLog.ErrorContext(ctx, "submit failed", "points", len(pts), "err", err)
 				return err
 			}
+			m.PointsWritten.Add(float64(res.Written()))
+
+			if cm, ok := gtr.(Committer); ok {
+				if err := cm.Commit(ctx, greq); err != nil {
+					dirLog.ErrorContext(ctx, "commit failed", "err", err)
+					return err
+				}
+			}
+			dirLog.InfoContext(ctx, "crawled", "after", after.Format(time.RFC3339), "duration", getTime, "points", len(pts), "written", res.Written())
+		}
+
+		if crawled && succeeded {
+			m.LastSuccess.Set(float64(time.Now().Unix()), ctr.ID)
 		}
 	}
 
+	logger.InfoContext(ctx, "crawl finished", "duration", time.Since(start), "get_errors", len(getErrs))
 	return errors.Join(getErrs...)
 }
+
+// newRunID returns a random ID to tell the logs of different runs apart.
+func newRunID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
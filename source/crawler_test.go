@@ -1,11 +1,17 @@
 package source_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/danp/counterbase/directory"
+	"github.com/danp/counterbase/metrics"
 	"github.com/danp/counterbase/query"
 	"github.com/danp/counterbase/source"
 	"github.com/danp/counterbase/submit"
@@ -583,6 +589,294 @@ func TestCrawlerMultipleSchemes(t *testing.T) {
 	}
 }
 
+func TestCrawlerSelection(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	active := []directory.ServiceRange{{Start: directory.SD(now.Add(-5 * time.Hour))}}
+	inactive := []directory.ServiceRange{{Start: directory.SD(now.Add(-30 * time.Hour)), End: directory.SD(now)}}
+
+	dir := fakeDirectory{
+		C: []directory.Counter{
+			{
+				ID:            "bike-1",
+				Mode:          "cycling",
+				Tags:          []string{"downtown"},
+				ServiceRanges: active,
+				Directions: []directory.Direction{
+					{ID: "nb", Source: directory.Source{URL: "schemea:1"}},
+					{ID: "sb", Source: directory.Source{URL: "schemeb:1"}},
+				},
+			},
+			{
+				ID:            "walk-1",
+				Mode:          "walking",
+				ServiceRanges: active,
+				Directions:    []directory.Direction{{ID: "eb", Source: directory.Source{URL: "schemea:2"}}},
+			},
+			{
+				ID:            "bike-old",
+				Mode:          "cycling",
+				Tags:          []string{"downtown"},
+				ServiceRanges: inactive,
+				Directions:    []directory.Direction{{ID: "nb", Source: directory.Source{URL: "schemea:3"}}},
+			},
+		},
+	}
+
+	cases := []struct {
+		name            string
+		selector        query.Selector
+		schemes         []string
+		includeInactive bool
+		want            []string
+	}{
+		{"all", query.Selector{}, nil, false, []string{"bike-1 nb", "bike-1 sb", "walk-1 eb"}},
+		{"counter", query.Selector{CounterIDs: []string{"walk-1"}}, nil, false, []string{"walk-1 eb"}},
+		{"tag", query.Selector{Tags: []string{"downtown"}}, nil, false, []string{"bike-1 nb", "bike-1 sb"}},
+		{"mode", query.Selector{Modes: []string{"walking"}}, nil, false, []string{"walk-1 eb"}},
+		{"scheme", query.Selector{}, []string{"schemeb"}, false, []string{"bike-1 sb"}},
+		{"inactive", query.Selector{Modes: []string{"cycling"}}, []string{"schemea"}, true, []string{"bike-1 nb", "bike-old nb"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sub := &fakeSubmitter{}
+			c := source.Crawler{
+				Directory:       dir,
+				Querier:         fakeQuerier{},
+				Submitter:       sub,
+				Selector:        tc.selector,
+				Schemes:         tc.schemes,
+				IncludeInactive: tc.includeInactive,
+			}
+			c.AddGetter("schemea", &fakeGetter{})
+			c.AddGetter("schemeb", &fakeGetter{})
+
+			if err := c.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, req := range sub.submits {
+				got = append(got, req.ID+" "+req.DirectionID)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
+
+func TestCrawlerUnknownCounter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+
+	dir := fakeDirectory{
+		C: []directory.Counter{
+			{
+				ID:            "bike-1",
+				ServiceRanges: []directory.ServiceRange{{Start: directory.SD(now.Add(-5 * time.Hour))}},
+				Directions:    []directory.Direction{{ID: "nb", Source: directory.Source{URL: "testscheme:1"}}},
+			},
+		},
+	}
+
+	sub := &fakeSubmitter{}
+	c := source.Crawler{
+		Directory: dir,
+		Querier:   fakeQuerier{},
+		Submitter: sub,
+		Selector:  query.Selector{CounterIDs: []string{"bike-1", "bkie-1"}},
+	}
+	c.AddGetter("testscheme", &fakeGetter{})
+
+	err := c.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), `"bkie-1"`) {
+		t.Fatalf("got error %v, want one naming the unknown counter", err)
+	}
+	if len(sub.submits) > 0 {
+		t.Errorf("got %d submits, want none", len(sub.submits))
+	}
+}
+
+func TestCrawlerBadTimeZone(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	active := []directory.ServiceRange{{Start: directory.SD(now.Add(-5 * time.Hour))}}
+
+	dir := fakeDirectory{
+		C: []directory.Counter{
+			{
+				ID:            "bad-zone",
+				Zone:          "Nowhere/Special",
+				ServiceRanges: active,
+				Directions:    []directory.Direction{{ID: "nb", Source: directory.Source{URL: "testscheme:1"}}},
+			},
+			{
+				ID:            "good",
+				ServiceRanges: active,
+				Directions:    []directory.Direction{{ID: "nb", Source: directory.Source{URL: "testscheme:2"}}},
+			},
+		},
+	}
+
+	sub := &fakeSubmitter{}
+	c := source.Crawler{
+		Directory: dir,
+		Querier:   fakeQuerier{},
+		Submitter: sub,
+	}
+	c.AddGetter("testscheme", &fakeGetter{})
+
+	err := c.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "bad-zone") {
+		t.Fatalf("got error %v, want one naming the bad-zone counter", err)
+	}
+
+	var got []string
+	for _, req := range sub.submits {
+		got = append(got, req.ID)
+	}
+	if d := cmp.Diff([]string{"good"}, got); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestCrawlerMetrics(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+
+	dir := fakeDirectory{
+		C: []directory.Counter{
+			{
+				ID:            "good",
+				ServiceRanges: []directory.ServiceRange{{Start: directory.SD(now.Add(-5 * time.Hour))}},
+				Directions:    []directory.Direction{{ID: "nb", Source: directory.Source{URL: "goodscheme:1"}}},
+			},
+			{
+				ID:            "bad",
+				ServiceRanges: []directory.ServiceRange{{Start: directory.SD(now.Add(-5 * time.Hour))}},
+				Directions: []directory.Direction{
+					{ID: "nb", Source: directory.Source{URL: "goodscheme:2"}},
+					{ID: "sb", Source: directory.Source{URL: "badscheme:1"}},
+				},
+			},
+		},
+	}
+
+	get := &fakeGetter{
+		P: []submit.Point{
+			{Time: now.Add(-2 * time.Hour).Unix(), Resolution: submit.ResolutionHour, Value: 5},
+			{Time: now.Add(-1 * time.Hour).Unix(), Resolution: submit.ResolutionHour, Value: 6},
+		},
+	}
+
+	var reg metrics.Registry
+	c := source.Crawler{
+		Directory: dir,
+		Querier:   fakeQuerier{},
+		Submitter: &fakeSubmitter{},
+		Metrics:   source.NewCrawlerMetrics(&reg),
+	}
+	c.AddGetter("goodscheme", get)
+	c.AddGetter("badscheme", failingGetter{})
+
+	if err := c.Run(context.Background()); err == nil {
+		t.Fatal("got no error")
+	}
+
+	var b strings.Builder
+	if _, err := reg.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+
+	for _, want := range []string{
+		`counterbase_crawler_get_duration_seconds_count{scheme="goodscheme"} 2`,
+		`counterbase_crawler_get_duration_seconds_count{scheme="badscheme"} 1`,
+		`counterbase_crawler_get_errors_total{scheme="badscheme"} 1`,
+		`counterbase_crawler_points_written_total 4`,
+		`counterbase_crawler_last_success_timestamp_seconds{counter_id="good"} `,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `counter_id="bad"`) {
+		t.Errorf("got last success for counter with failed get:\n%s", out)
+	}
+}
+
+func TestCrawlerLogs(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+
+	dir := fakeDirectory{
+		C: []directory.Counter{
+			{
+				ID:            "bad",
+				ServiceRanges: []directory.ServiceRange{{Start: directory.SD(now.Add(-5 * time.Hour))}},
+				Directions:    []directory.Direction{{ID: "sb", Source: directory.Source{URL: "badscheme:1"}}},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	c := source.Crawler{
+		Directory: dir,
+		Querier:   fakeQuerier{},
+		Submitter: &fakeSubmitter{},
+		Logger:    slog.New(slog.NewJSONHandler(&buf, nil)),
+	}
+	c.AddGetter("badscheme", failingGetter{})
+
+	if err := c.Run(context.Background()); err == nil {
+		t.Fatal("got no error")
+	}
+
+	type entry struct {
+		Level       string `json:"level"`
+		Msg         string `json:"msg"`
+		RunID       string `json:"run_id"`
+		CounterID   string `json:"counter_id"`
+		DirectionID string `json:"direction_id"`
+		Scheme      string `json:"scheme"`
+		Err         string `json:"err"`
+	}
+
+	var got []entry
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var e entry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, e)
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("got %d log entries, want 3: %+v", len(got), got)
+	}
+	runID := got[0].RunID
+	if runID == "" {
+		t.Fatal("no run_id")
+	}
+
+	want := []entry{
+		{Level: "INFO", Msg: "crawl started", RunID: runID},
+		{Level: "ERROR", Msg: "get failed", RunID: runID, CounterID: "bad", DirectionID: "sb", Scheme: "badscheme", Err: "boom"},
+		{Level: "INFO", Msg: "crawl finished", RunID: runID},
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Error(d)
+	}
+}
+
 type fakeDirectory struct {
 	C []directory.Counter
 }
@@ -614,11 +908,17 @@ func (f *fakeGetter) Get(ctx context.Context, req source.GetRequest) ([]submit.P
 	return out, nil
 }
 
+type failingGetter struct{}
+
+func (failingGetter) Get(ctx context.Context, req source.GetRequest) ([]submit.Point, error) {
+	return nil, errors.New("boom")
+}
+
 type fakeSubmitter struct {
 	submits []submit.Request
 }
 
-func (f *fakeSubmitter) Submit(ctx context.Context, req submit.Request) error {
+func (f *fakeSubmitter) Submit(ctx context.Context, req submit.Request) (submit.Result, error) {
 	f.submits = append(f.submits, req)
-	return nil
+	return submit.Result{Inserted: len(req.Points)}, nil
 }
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -60,7 +59,7 @@ func (g *EcoCounter) Get(ctx context.Context, req GetRequest) ([]submit.Point, e
 
 		domain, ok := g.privateDomains[domainName]
 		if !ok {
-			log.Printf("no private auth for URL %q domain %q available, skipping", req.URL, domainName)
+			req.logger().WarnContext(ctx, "no private auth available, skipping", "url", req.URL.String(), "domain", domainName)
 			return nil, nil
 		}
 
@@ -73,7 +72,7 @@ func (g *EcoCounter) Get(ctx context.Context, req GetRequest) ([]submit.Point, e
 
 		dps, err = q.Query(req.After, time.Now(), ecocounter.ResolutionHour)
 	default:
-		log.Println("not handling url", req.URL, "yet")
+		req.logger().WarnContext(ctx, "not handling url yet, skipping", "url", req.URL.String())
 		return nil, nil
 	}
 
@@ -0,0 +1,189 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/danp/counterbase/submit"
+)
+
+// DefaultExecTimeout is how long Exec lets a program run if Timeout isn't
+// set.
+const DefaultExecTimeout = time.Minute
+
+// Exec gets counts by running a program, so sources can be added in any
+// language without changing counterbase. A source URL such as
+// exec:acme-counts?site=12 runs the program acme-counts in Dir.
+//
+// The program is given an ExecRequest as JSON on stdin and must write
+// submit.Point values as JSON to stdout, either as an array or one after
+// another. Anything it writes to stderr is logged. It fails if it exits
+// with a non-zero status or runs longer than Timeout.
+type Exec struct {
+	// Dir holds the programs that may be run. Source URLs can't name
+	// programs outside it.
+	Dir string
+
+	// Timeout limits how long each run may take. If zero,
+	// DefaultExecTimeout is used.
+	Timeout time.Duration
+}
+
+// ExecRequest is what Exec gives a program on stdin.
+type ExecRequest struct {
+	// URL is the full source URL.
+	URL string `json:"url"`
+	// After is the time points must be after, as RFC 3339 and Unix
+	// seconds.
+	After     time.Time `json:"after"`
+	AfterUnix int64     `json:"after_unix"`
+	// Zone is the counter's time zone, such as America/Halifax.
+	Zone string `json:"zone,omitempty"`
+	// Options are the source's options.
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// maxExecStderr is how much of a program's stderr is kept.
+const maxExecStderr = 64 << 10
+
+func (g *Exec) Get(ctx context.Context, req GetRequest) ([]submit.Point, error) {
+	if g.Dir == "" {
+		return nil, fmt.Errorf("no program dir set for exec sources")
+	}
+
+	name := req.URL.Opaque
+	if name == "" {
+		name = strings.TrimPrefix(req.URL.Path, "/")
+	}
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("bad program name %q", name)
+	}
+
+	ereq := ExecRequest{
+		URL:       req.URL.String(),
+		After:     req.After,
+		AfterUnix: req.After.Unix(),
+		Options:   req.Options,
+	}
+	if req.Location != nil {
+		ereq.Zone = req.Location.String()
+	}
+	stdin, err := json.Marshal(ereq)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := g.Timeout
+	if timeout <= 0 {
+		timeout = DefaultExecTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout bytes.Buffer
+	stderr := &limitedBuffer{max: maxExecStderr}
+
+	cmd := exec.CommandContext(ctx, filepath.Join(g.Dir, name))
+	cmd.Dir = g.Dir
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = 5 * time.Second
+
+	start := time.Now()
+	runErr := cmd.Run()
+
+	if s := strings.TrimSpace(stderr.String()); s != "" {
+		req.logger().InfoContext(ctx, "program stderr", "program", name, "stderr", s)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("%s: timed out after %v", name, time.Since(start).Round(time.Millisecond))
+	}
+	if runErr != nil {
+		return nil, fmt.Errorf("%s: %w%s", name, runErr, stderrTail(stderr.String()))
+	}
+
+	pts, err := decodeExecPoints(&stdout)
+	if err != nil {
+		return nil, fmt.Errorf("%s: decoding output: %w", name, err)
+	}
+
+	out := pts[:0]
+	for i, pt := range pts {
+		if !pt.Resolution.Valid() {
+			return nil, fmt.Errorf("%s: point %d: unknown resolution %d", name, i, pt.Resolution)
+		}
+		if time.Unix(pt.Time, 0).After(req.After) {
+			out = append(out, pt)
+		}
+	}
+	return out, nil
+}
+
+// decodeExecPoints decodes points written as a JSON array or as a
+// sequence of JSON objects.
+func decodeExecPoints(r io.Reader) ([]submit.Point, error) {
+	var pts []submit.Point
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); errors.Is(err, io.EOF) {
+			return pts, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if b := bytes.TrimSpace(raw); len(b) > 0 && b[0] == '[' {
+			var arr []submit.Point
+			if err := json.Unmarshal(b, &arr); err != nil {
+				return nil, err
+			}
+			pts = append(pts, arr...)
+			continue
+		}
+
+		var pt submit.Point
+		if err := json.Unmarshal(raw, &pt); err != nil {
+			return nil, err
+		}
+		pts = append(pts, pt)
+	}
+}
+
+// stderrTail returns the last line of stderr, if any, for an error
+// message.
+func stderrTail(stderr string) string {
+	s := strings.TrimSpace(stderr)
+	if s == "" {
+		return ""
+	}
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		s = s[i+1:]
+	}
+	return ": " + s
+}
+
+// limitedBuffer keeps the first max bytes written to it.
+type limitedBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := b.max - b.buf.Len(); n > 0 {
+		b.buf.Write(p[:min(n, len(p))])
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
@@ -0,0 +1,107 @@
+package source_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danp/counterbase/source"
+	"github.com/danp/counterbase/submit"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExec(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	script := func(name, body string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+body), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	script("counts", `cat > request.json
+echo "fetching site" >&2
+echo '[{"time": 1622516400, "resolution": 2, "value": 3}]'
+echo '{"time": 1622520000, "resolution": 2, "value": 4}'
+`)
+	script("fails", "echo 'bad credentials' >&2\nexit 3\n")
+	script("slow", "exec sleep 5\n")
+	script("badres", `echo '[{"time": 1622516400, "resolution": 9, "value": 3}]'`+"\n")
+
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	g := &source.Exec{Dir: dir, Timeout: 500 * time.Millisecond}
+	req := func(u string) source.GetRequest {
+		pu, err := url.Parse(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return source.GetRequest{
+			URL:      pu,
+			After:    time.Unix(1622516400, 0),
+			Options:  map[string]string{"key": "value"},
+			Location: loc,
+			Logger:   slog.New(slog.NewTextHandler(&logs, nil)),
+		}
+	}
+
+	got, err := g.Get(context.Background(), req("exec:counts?site=12"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []submit.Point{{Time: 1622520000, Resolution: submit.ResolutionHour, Value: 4}}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Error(d)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "request.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotReq source.ExecRequest
+	if err := json.Unmarshal(b, &gotReq); err != nil {
+		t.Fatal(err)
+	}
+	wantReq := source.ExecRequest{
+		URL:       "exec:counts?site=12",
+		After:     time.Unix(1622516400, 0),
+		AfterUnix: 1622516400,
+		Zone:      "America/Halifax",
+		Options:   map[string]string{"key": "value"},
+	}
+	if d := cmp.Diff(wantReq, gotReq); d != "" {
+		t.Error(d)
+	}
+	if !strings.Contains(logs.String(), "fetching site") {
+		t.Errorf("stderr not logged: %s", logs.String())
+	}
+
+	for _, tc := range []struct {
+		url     string
+		wantErr string
+	}{
+		{"exec:fails", "bad credentials"},
+		{"exec:slow", "timed out"},
+		{"exec:badres", "unknown resolution"},
+		{"exec:missing", "missing"},
+		{"exec:../counts", "bad program name"},
+		{"exec:///tmp/counts", "bad program name"},
+	} {
+		_, err := g.Get(context.Background(), req(tc.url))
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got error %v, want one containing %q", tc.url, err, tc.wantErr)
+		}
+	}
+}
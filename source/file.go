@@ -0,0 +1,185 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danp/counterbase/submit"
+)
+
+// File gets counts from CSV or JSON files matching a glob, such as dumps
+// dropped into a directory by partners. A source URL such as
+// file:///srv/dumps/bridge/*.csv reads every matching file. Files are read
+// as described for HTTPTable, using the same options, with the format
+// taken from the format option or each file's extension. Files are read in
+// name order, and points in later files replace those at the same time in
+// earlier ones.
+//
+// If Log is set, files that were already read for a source and whose
+// points were submitted are skipped until their contents change. A changed
+// file is read in full, ignoring the request's After time, so corrections
+// to points before it are submitted too. Sources sharing files, such as
+// directions picked out by filters, are tracked separately.
+type File struct {
+	Log FileLog
+
+	mu      sync.Mutex
+	pending map[string][]IngestedFile
+}
+
+// A FileLog records which files File has ingested.
+type FileLog interface {
+	// IngestedFile returns the record of the file at path for source,
+	// and whether there was one.
+	IngestedFile(ctx context.Context, source, path string) (IngestedFile, bool, error)
+	// AddIngestedFile records f, replacing any record for its source and
+	// path.
+	AddIngestedFile(ctx context.Context, f IngestedFile) error
+}
+
+// IngestedFile describes a file read by File.
+type IngestedFile struct {
+	// Source identifies the source URL and options the file was read for.
+	Source     string
+	Path       string
+	Size       int64
+	ModTime    time.Time
+	SHA256     string
+	IngestedAt time.Time
+}
+
+func (g *File) Get(ctx context.Context, req GetRequest) ([]submit.Point, error) {
+	opts, err := parseTableOptions(req.Options, req.Location)
+	if err != nil {
+		return nil, err
+	}
+
+	pattern := req.URL.Path
+	if req.URL.Opaque != "" {
+		pattern = req.URL.Opaque
+	}
+	key := fileSourceKey(req)
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		req.logger().WarnContext(ctx, "no files match", "pattern", pattern)
+	}
+
+	var (
+		pts     []submit.Point
+		pending []IngestedFile
+	)
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(b)
+		f := IngestedFile{Source: key, Path: path, Size: fi.Size(), ModTime: fi.ModTime(), SHA256: hex.EncodeToString(sum[:])}
+
+		changed := false
+		if g.Log != nil {
+			prev, ok, err := g.Log.IngestedFile(ctx, key, path)
+			if err != nil {
+				return nil, err
+			}
+			if ok && prev.SHA256 == f.SHA256 {
+				continue
+			}
+			changed = ok
+		}
+
+		format := req.Options["format"]
+		if format == "" {
+			format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+		}
+
+		after := req.After
+		if changed {
+			after = time.Time{}
+		}
+		fpts, err := opts.read(format, bytes.NewReader(b), after)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		req.logger().InfoContext(ctx, "read file", "path", path, "points", len(fpts), "changed", changed)
+
+		pts = append(pts, fpts...)
+		pending = append(pending, f)
+	}
+
+	g.mu.Lock()
+	if g.pending == nil {
+		g.pending = make(map[string][]IngestedFile)
+	}
+	g.pending[key] = pending
+	g.mu.Unlock()
+
+	return mergePoints(pts), nil
+}
+
+// Commit records the files read by the last Get for req in Log.
+func (g *File) Commit(ctx context.Context, req GetRequest) error {
+	g.mu.Lock()
+	key := fileSourceKey(req)
+	pending := g.pending[key]
+	delete(g.pending, key)
+	g.mu.Unlock()
+
+	if g.Log == nil {
+		return nil
+	}
+	for _, f := range pending {
+		f.IngestedAt = time.Now()
+		if err := g.Log.AddIngestedFile(ctx, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileSourceKey identifies the source of req by its URL and options.
+func fileSourceKey(req GetRequest) string {
+	opts := make(url.Values)
+	for k, v := range req.Options {
+		opts.Set(k, v)
+	}
+	if len(opts) == 0 {
+		return req.URL.String()
+	}
+	return req.URL.String() + " " + opts.Encode()
+}
+
+// mergePoints sorts pts by time. Where points have the same time, the
+// last one is kept, so points from later files replace those in earlier
+// ones.
+func mergePoints(pts []submit.Point) []submit.Point {
+	sort.SliceStable(pts, func(i, j int) bool { return pts[i].Time < pts[j].Time })
+
+	var out []submit.Point
+	for _, pt := range pts {
+		if n := len(out); n > 0 && out[n-1].Time == pt.Time {
+			out[n-1] = pt
+			continue
+		}
+		out = append(out, pt)
+	}
+	return out
+}
@@ -0,0 +1,186 @@
+package source_test
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danp/counterbase/directory"
+	"github.com/danp/counterbase/source"
+	"github.com/danp/counterbase/submit"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFile(t *testing.T) {
+	t.Parallel()
+
+	dumps := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dumps, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("2021-05.csv", "time,dir,count\n2021-05-31T23:00:00Z,nb,1\n2021-05-31T23:00:00Z,sb,2\n")
+	write("2021-06.csv", "time,dir,count\n2021-06-01T00:00:00Z,nb,3\n2021-06-01T00:00:00Z,sb,4\n")
+	write("notes.txt", "not a dump")
+
+	source1 := func(dir string) directory.Source {
+		return directory.Source{
+			URL:     "file://" + filepath.Join(dumps, "*.csv"),
+			Options: map[string]string{"time": "time", "value": "count", "filter.dir": dir},
+		}
+	}
+
+	dir := fakeDirectory{
+		C: []directory.Counter{
+			{
+				ID:            "bridge",
+				ServiceRanges: []directory.ServiceRange{{Start: directory.SD(time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC))}},
+				Directions: []directory.Direction{
+					{ID: "nb", Source: source1("nb")},
+					{ID: "sb", Source: source1("sb")},
+				},
+			},
+		},
+	}
+
+	log := &fakeFileLog{}
+	sub := &fakeSubmitter{}
+	c := source.Crawler{
+		Directory: dir,
+		Querier:   fakeQuerier{},
+		Submitter: sub,
+	}
+	c.AddGetter("file", &source.File{Log: log})
+
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	hour := func(d, h int) int64 { return time.Date(2021, 5, d, h, 0, 0, 0, time.UTC).Unix() }
+	want := []submit.Request{
+		{ID: "bridge", DirectionID: "nb", Points: []submit.Point{
+			{Time: hour(31, 23), Resolution: submit.ResolutionHour, Value: 1},
+			{Time: hour(32, 0), Resolution: submit.ResolutionHour, Value: 3},
+		}},
+		{ID: "bridge", DirectionID: "sb", Points: []submit.Point{
+			{Time: hour(31, 23), Resolution: submit.ResolutionHour, Value: 2},
+			{Time: hour(32, 0), Resolution: submit.ResolutionHour, Value: 4},
+		}},
+	}
+	if d := cmp.Diff(want, sub.submits); d != "" {
+		t.Error(d)
+	}
+	if len(log.files) != 4 {
+		t.Errorf("got %d ingested files, want 4", len(log.files))
+	}
+
+	// Nothing new is read until a file changes.
+	sub.submits = nil
+	write("2021-06.csv", "time,dir,count\n2021-06-01T00:00:00Z,nb,3\n2021-06-01T00:00:00Z,sb,5\n")
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want = []submit.Request{
+		{ID: "bridge", DirectionID: "nb", Points: []submit.Point{
+			{Time: hour(32, 0), Resolution: submit.ResolutionHour, Value: 3},
+		}},
+		{ID: "bridge", DirectionID: "sb", Points: []submit.Point{
+			{Time: hour(32, 0), Resolution: submit.ResolutionHour, Value: 5},
+		}},
+	}
+	if d := cmp.Diff(want, sub.submits); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestFileChanged(t *testing.T) {
+	t.Parallel()
+
+	dumps := t.TempDir()
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dumps, "2021-05.csv"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("time,count\n2021-05-31T23:00:00Z,1\n")
+
+	u, err := url.Parse("file://" + filepath.Join(dumps, "*.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	var logs bytes.Buffer
+	log := &fakeFileLog{}
+	f := &source.File{Log: log}
+	after := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	get := func() []submit.Point {
+		t.Helper()
+		req := source.GetRequest{
+			URL:      u,
+			After:    after,
+			Options:  map[string]string{"time": "time", "value": "count"},
+			Location: time.UTC,
+			Logger:   slog.New(slog.NewTextHandler(&logs, nil)),
+		}
+		pts, err := f.Get(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Commit(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		return pts
+	}
+
+	// The file has nothing after the cursor, but is still recorded so it
+	// isn't read again.
+	for range 2 {
+		if pts := get(); len(pts) > 0 {
+			t.Errorf("got %d points, want none", len(pts))
+		}
+	}
+	if len(log.files) != 1 {
+		t.Errorf("got %d ingested files, want 1", len(log.files))
+	}
+	if n := strings.Count(logs.String(), "read file"); n != 1 {
+		t.Errorf("file read %d times, want 1", n)
+	}
+
+	// A correction before the cursor is submitted with the new point.
+	write("time,count\n2021-05-31T23:00:00Z,2\n2021-06-01T01:00:00Z,5\n")
+	want := []submit.Point{
+		{Time: time.Date(2021, 5, 31, 23, 0, 0, 0, time.UTC).Unix(), Resolution: submit.ResolutionHour, Value: 2},
+		{Time: time.Date(2021, 6, 1, 1, 0, 0, 0, time.UTC).Unix(), Resolution: submit.ResolutionHour, Value: 5},
+	}
+	if d := cmp.Diff(want, get()); d != "" {
+		t.Error(d)
+	}
+}
+
+type fakeFileLog struct {
+	files map[[2]string]source.IngestedFile
+}
+
+func (f *fakeFileLog) IngestedFile(ctx context.Context, src, path string) (source.IngestedFile, bool, error) {
+	fi, ok := f.files[[2]string{src, path}]
+	return fi, ok, nil
+}
+
+func (f *fakeFileLog) AddIngestedFile(ctx context.Context, fi source.IngestedFile) error {
+	if f.files == nil {
+		f.files = make(map[[2]string]source.IngestedFile)
+	}
+	f.files[[2]string{fi.Source, fi.Path}] = fi
+	return nil
+}
@@ -2,12 +2,15 @@ package ecocounter
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,6 +18,14 @@ type EcoVisioQuerier struct {
 	Auth             *EcoVisioAuth
 	UserID, DomainID string
 	FlowIDs          []string
+
+	// Transport is the http.RoundTripper to use for making API requests.
+	// If nil, http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	// BaseURL is the base URL to use for API requests.
+	// If blank, DefaultBaseURL is used.
+	BaseURL string
 }
 
 func (q EcoVisioQuerier) Query(begin, end time.Time, resolution Resolution) ([]Datapoint, error) {
@@ -32,8 +43,13 @@ func (q EcoVisioQuerier) Query(begin, end time.Time, resolution Resolution) ([]D
 	// our end is inclusive, API's is not
 	end = end.AddDate(0, 0, 1)
 
+	base := q.BaseURL
+	if base == "" {
+		base = DefaultBaseURL
+	}
+
 	begins, ends := begin.Format("2006-01-02"), end.Format("2006-01-02")
-	bu := "https://www.eco-visio.net/api/aladdin/1.0.0/domain/" + q.DomainID + "/user/" + q.UserID + "/query/from/" + begins + "%2000:00/to/" + ends + "%2000:00/by/" + ress
+	bu := base + "/api/aladdin/1.0.0/domain/" + q.DomainID + "/user/" + q.UserID + "/query/from/" + begins + "%2000:00/to/" + ends + "%2000:00/by/" + ress
 
 	var reqs struct {
 		Flows []int `json:"flows"`
@@ -50,41 +66,16 @@ func (q EcoVisioQuerier) Query(begin, end time.Time, resolution Resolution) ([]D
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", bu, bytes.NewReader(reqb))
-	if err != nil {
-		return nil, err
-	}
-
-	tok, err := q.Auth.Token()
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:80.0) Gecko/20100101 Firefox/80.0")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.5")
-	req.Header.Set("Content-Type", "application/json; charset=utf-8")
-	req.Header.Set("Authorization", "Bearer "+tok)
-	req.Header.Set("X-Requested-With", "XMLHttpRequest")
-	req.Header.Set("Origin", "https://www.eco-visio.net")
-	req.Header.Set("DNT", "1")
-	req.Header.Set("Referer", "https://www.eco-visio.net/v5/")
-
-	resp, err := http.DefaultClient.Do(req)
+	b, status, err := q.post(bu, reqb)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("reading query response for %s: %w", q.FlowIDs, err)
-	}
 
-	if resp.StatusCode/100 != 2 {
+	if status/100 != 2 {
 		if len(b) > 100 {
 			b = b[:100]
 		}
-		return nil, fmt.Errorf("bad status %d querying %s: %s", resp.StatusCode, q.FlowIDs, b)
+		return nil, fmt.Errorf("bad status %d querying %s: %s", status, q.FlowIDs, b)
 	}
 
 	var resps map[string]struct {
@@ -115,38 +106,156 @@ func (q EcoVisioQuerier) Query(begin, end time.Time, resolution Resolution) ([]D
 	return ds, nil
 }
 
+// post posts body to u with a token from q.Auth, returning the response
+// body and status. If the token is refused it's dropped and the post is
+// retried once with a new one.
+func (q EcoVisioQuerier) post(u string, body []byte) ([]byte, int, error) {
+	for attempt := 0; ; attempt++ {
+		tok, err := q.Auth.Token()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		setEcoVisioHeaders(req)
+		req.Header.Set("Authorization", "Bearer "+tok)
+
+		resp, err := (&http.Client{Transport: q.Transport}).Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, 0, fmt.Errorf("reading query response for %s: %w", q.FlowIDs, err)
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			q.Auth.Invalidate(tok)
+			continue
+		}
+		return b, resp.StatusCode, nil
+	}
+}
+
+func setEcoVisioHeaders(req *http.Request) {
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:80.0) Gecko/20100101 Firefox/80.0")
+	req.Header.Set("Accept-Language", "en-US,en;q=0.5")
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	req.Header.Set("Origin", "https://www.eco-visio.net")
+	req.Header.Set("DNT", "1")
+	req.Header.Set("Referer", "https://www.eco-visio.net/v5/")
+}
+
+const (
+	// defaultTokenLifetime is how long a token is used when its expiry
+	// can't be found.
+	defaultTokenLifetime = time.Hour
+
+	// tokenRefreshMargin is how long before its expiry a token is
+	// replaced.
+	tokenRefreshMargin = time.Minute
+)
+
+// EcoVisioAuth gets and caches access tokens. Tokens are replaced shortly
+// before they expire, going by the expires_in of the connect response or
+// the token's exp claim, or after an hour if neither is available.
 type EcoVisioAuth struct {
 	username, password string
 
-	// should support expiry, etc
-	tokenCh chan string
+	// Transport is the http.RoundTripper to use for connect requests.
+	// If nil, http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	// BaseURL is the base URL to use for connect requests.
+	// If blank, DefaultBaseURL is used.
+	BaseURL string
+
+	now func() time.Time // for tests
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
 }
 
 func NewEcoVisioAuth(username, password string) *EcoVisioAuth {
-	ch := make(chan string, 1)
-	ch <- ""
 	return &EcoVisioAuth{
 		username: username,
 		password: password,
-		tokenCh:  ch,
 	}
 }
 
+// Token returns a token that hasn't expired, connecting for a new one if
+// needed.
 func (a *EcoVisioAuth) Token() (string, error) {
-	tok := <-a.tokenCh
-	if tok == "" {
-		t, err := a.auth()
-		if err != nil {
-			a.tokenCh <- ""
-			return "", err
-		}
-		tok = t
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if a.now != nil {
+		now = a.now()
+	}
+	if a.token != "" && now.Before(a.expiry.Add(-tokenRefreshMargin)) {
+		return a.token, nil
+	}
+
+	tok, expiresIn, err := a.auth()
+	if err != nil {
+		return "", err
 	}
-	a.tokenCh <- tok
+
+	exp, ok := jwtExpiry(tok)
+	switch {
+	case expiresIn > 0:
+		exp = now.Add(time.Duration(expiresIn) * time.Second)
+	case !ok:
+		exp = now.Add(defaultTokenLifetime)
+	}
+
+	a.token, a.expiry = tok, exp
 	return tok, nil
 }
 
-func (a *EcoVisioAuth) auth() (string, error) {
+// Invalidate drops tok, such as after it was refused, so the next call to
+// Token gets a new one. It does nothing if tok was already replaced.
+func (a *EcoVisioAuth) Invalidate(tok string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token == tok {
+		a.token, a.expiry = "", time.Time{}
+	}
+}
+
+// jwtExpiry returns the time of the exp claim of tok, if it's a JWT with
+// one.
+func jwtExpiry(tok string) (time.Time, bool) {
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var claims struct {
+		Exp float64 `json:"exp"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil || claims.Exp <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(claims.Exp), 0), true
+}
+
+func (a *EcoVisioAuth) auth() (string, int64, error) {
 	reqs := struct {
 		Login    string `json:"login"`
 		Password string `json:"password"`
@@ -156,46 +265,49 @@ func (a *EcoVisioAuth) auth() (string, error) {
 	}
 	reqb, err := json.Marshal(reqs)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
-	req, err := http.NewRequest("POST", "https://www.eco-visio.net/api/aladdin/1.0.0/connect", bytes.NewReader(reqb))
+	base := a.BaseURL
+	if base == "" {
+		base = DefaultBaseURL
+	}
+
+	req, err := http.NewRequest("POST", base+"/api/aladdin/1.0.0/connect", bytes.NewReader(reqb))
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:80.0) Gecko/20100101 Firefox/80.0")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.5")
-	req.Header.Set("Content-Type", "application/json; charset=utf-8")
-	req.Header.Set("X-Requested-With", "XMLHttpRequest")
-	req.Header.Set("Origin", "https://www.eco-visio.net")
-	req.Header.Set("DNT", "1")
-	req.Header.Set("Referer", "https://www.eco-visio.net/v5/")
+	setEcoVisioHeaders(req)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := (&http.Client{Transport: a.Transport}).Do(req)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 	defer resp.Body.Close()
 
 	b, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("reading eco visio auth response: %w", err)
+		return "", 0, fmt.Errorf("reading eco visio auth response: %w", err)
 	}
 
 	if resp.StatusCode/100 != 2 {
 		if len(b) > 100 {
 			b = b[:100]
 		}
-		return "", fmt.Errorf("bad status %d for eco visio auth: %s", resp.StatusCode, b)
+		return "", 0, fmt.Errorf("bad status %d for eco visio auth: %s", resp.StatusCode, b)
 	}
 
 	var resps struct {
 		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
 	}
 	if err := json.Unmarshal(b, &resps); err != nil {
-		return "", fmt.Errorf("decoding eco visio auth response: %w", err)
+		return "", 0, fmt.Errorf("decoding eco visio auth response: %w", err)
+	}
+	if resps.AccessToken == "" {
+		return "", 0, fmt.Errorf("no access token in eco visio auth response")
 	}
 
-	return resps.AccessToken, nil
+	return resps.AccessToken, resps.ExpiresIn, nil
 }
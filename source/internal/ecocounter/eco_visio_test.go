@@ -0,0 +1,180 @@
+package ecocounter
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEcoVisio serves connect and query requests. Each connect returns a
+// new token, t1, t2, and so on, unless tokens is set.
+type fakeEcoVisio struct {
+	t *testing.T
+
+	mu        sync.Mutex
+	connects  int
+	tokens    []string // returned by connect in turn, if set
+	expiresIn int64
+	valid     map[string]bool
+	refuseAll bool
+}
+
+func (f *fakeEcoVisio) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/api/aladdin/1.0.0/connect" {
+		var body struct{ Login, Password string }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Login != "user" || body.Password != "pass" {
+			http.Error(w, "bad login", http.StatusForbidden)
+			return
+		}
+
+		f.connects++
+		tok := fmt.Sprintf("t%d", f.connects)
+		if len(f.tokens) > 0 {
+			tok = f.tokens[f.connects-1]
+		}
+		if f.valid == nil {
+			f.valid = make(map[string]bool)
+		}
+		f.valid[tok] = true
+
+		resp := map[string]any{"access_token": tok}
+		if f.expiresIn > 0 {
+			resp["expires_in"] = f.expiresIn
+		}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	if want := "/api/aladdin/1.0.0/domain/d/user/u/query/from/2021-06-01%2000:00/to/2021-06-02%2000:00/by/hour"; r.URL.EscapedPath() != want {
+		f.t.Errorf("got path %q, want %q", r.URL.EscapedPath(), want)
+	}
+	if f.refuseAll || !f.valid[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+		http.Error(w, "expired", http.StatusUnauthorized)
+		return
+	}
+	w.Write([]byte(`{"1": {"countdata": [["2021-06-01 00:00:00", 3], ["2021-06-01 01:00:00", 4]]}}`))
+}
+
+func TestEcoVisioAuthExpiry(t *testing.T) {
+	jwt := func(exp time.Time) string {
+		claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp": %d}`, exp.Unix())))
+		return "header." + claims + ".sig"
+	}
+
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name      string
+		expiresIn int64
+		tokens    []string
+		lifetime  time.Duration
+	}{
+		{"expires_in", 600, nil, 10 * time.Minute},
+		{"jwt", 0, []string{jwt(start.Add(30 * time.Minute)), jwt(start.Add(time.Hour))}, 30 * time.Minute},
+		{"default", 0, nil, defaultTokenLifetime},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fev := &fakeEcoVisio{t: t, expiresIn: tc.expiresIn, tokens: tc.tokens}
+			ts := httptest.NewServer(fev)
+			defer ts.Close()
+
+			now := start
+			a := NewEcoVisioAuth("user", "pass")
+			a.BaseURL = ts.URL
+			a.now = func() time.Time { return now }
+
+			first, err := a.Token()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Still fresh just before the refresh margin.
+			now = start.Add(tc.lifetime - tokenRefreshMargin - time.Second)
+			if tok, err := a.Token(); err != nil {
+				t.Fatal(err)
+			} else if tok != first {
+				t.Errorf("got new token %q before expiry", tok)
+			}
+
+			// Replaced within the refresh margin.
+			now = start.Add(tc.lifetime - tokenRefreshMargin)
+			if tok, err := a.Token(); err != nil {
+				t.Fatal(err)
+			} else if tok == first {
+				t.Errorf("got old token %q at expiry", tok)
+			}
+
+			if fev.connects != 2 {
+				t.Errorf("got %d connects, want 2", fev.connects)
+			}
+		})
+	}
+}
+
+func TestEcoVisioQuerierRetry(t *testing.T) {
+	fev := &fakeEcoVisio{t: t}
+	ts := httptest.NewServer(fev)
+	defer ts.Close()
+
+	a := NewEcoVisioAuth("user", "pass")
+	a.BaseURL = ts.URL
+
+	q := EcoVisioQuerier{
+		Auth:     a,
+		UserID:   "u",
+		DomainID: "d",
+		FlowIDs:  []string{"1"},
+		BaseURL:  ts.URL,
+	}
+
+	day := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	want := []Datapoint{{Time: "2021-06-01 00:00:00", Count: 3}, {Time: "2021-06-01 01:00:00", Count: 4}}
+
+	got, err := q.Query(day, day, ResolutionHour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// The server revokes the token before it expires.
+	fev.mu.Lock()
+	fev.valid = nil
+	fev.mu.Unlock()
+
+	got, err = q.Query(day, day, ResolutionHour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if fev.connects != 2 {
+		t.Errorf("got %d connects, want 2", fev.connects)
+	}
+
+	// A new token that's also refused fails after one retry.
+	fev.mu.Lock()
+	fev.refuseAll = true
+	fev.mu.Unlock()
+
+	if _, err := q.Query(day, day, ResolutionHour); err == nil || !strings.Contains(err.Error(), "bad status 401") {
+		t.Errorf("got error %v, want bad status 401", err)
+	}
+	if fev.connects != 3 {
+		t.Errorf("got %d connects, want 3", fev.connects)
+	}
+}
@@ -0,0 +1,331 @@
+package source
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danp/counterbase/submit"
+)
+
+// HTTPTable gets counts from a CSV or JSON document over HTTP, as described
+// by the source's options, so open data feeds can be added without code.
+//
+// A source URL such as csvhttp://data.example.com/counts.csv?year=2021 is
+// fetched as https://data.example.com/counts.csv?year=2021. These options
+// are used:
+//
+//   - time: the field holding each record's time, required
+//   - value: the field holding each record's count, required
+//   - time_format: a Go time layout, or unix or unix_ms, default RFC 3339
+//   - zone: the time zone of times without offsets, default the counter's
+//   - resolution: minute, hour, or day, default hour
+//   - filter.<field>: only use records where field has this value, such as
+//     filter.Direction=Northbound
+//   - records: for JSON, the dot-separated path to the array of records,
+//     such as features, default the top level
+//   - scheme: the scheme to fetch with, http or https, default https
+//
+// For JSON, fields may also be dot-separated paths, such as
+// properties.Date. Values of records with the same time are summed.
+type HTTPTable struct {
+	// Format is csv or json.
+	Format string
+
+	// HTTPClient is used to fetch sources. If nil, http.DefaultClient is
+	// used.
+	HTTPClient *http.Client
+}
+
+func (h *HTTPTable) Get(ctx context.Context, req GetRequest) ([]submit.Point, error) {
+	opts, err := parseTableOptions(req.Options, req.Location)
+	if err != nil {
+		return nil, err
+	}
+
+	u := *req.URL
+	u.Scheme = "https"
+	if s, ok := req.Options["scheme"]; ok {
+		if s != "http" && s != "https" {
+			return nil, fmt.Errorf("bad scheme option %q", s)
+		}
+		u.Scheme = s
+	}
+
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	hc := h.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	resp, err := hc.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status %d", resp.StatusCode)
+	}
+
+	return opts.read(h.Format, resp.Body, req.After)
+}
+
+// tableOptions describe how to turn records into points.
+type tableOptions struct {
+	timeField  string
+	valueField string
+	timeFormat string
+	loc        *time.Location
+	resolution submit.Resolution
+	filters    map[string]string
+	records    string
+}
+
+// parseTableOptions parses source options as described for HTTPTable.
+// Options it doesn't know are ignored so Getters can add their own.
+func parseTableOptions(opts map[string]string, loc *time.Location) (tableOptions, error) {
+	to := tableOptions{
+		timeField:  opts["time"],
+		valueField: opts["value"],
+		timeFormat: opts["time_format"],
+		loc:        loc,
+		resolution: submit.ResolutionHour,
+		filters:    make(map[string]string),
+		records:    opts["records"],
+	}
+
+	if to.timeField == "" || to.valueField == "" {
+		return tableOptions{}, fmt.Errorf("need time and value options")
+	}
+	if to.timeFormat == "" {
+		to.timeFormat = time.RFC3339
+	}
+
+	if z := opts["zone"]; z != "" {
+		l, err := time.LoadLocation(z)
+		if err != nil {
+			return tableOptions{}, fmt.Errorf("bad zone option: %w", err)
+		}
+		to.loc = l
+	}
+	if to.loc == nil {
+		to.loc = time.UTC
+	}
+
+	if r, ok := opts["resolution"]; ok {
+		switch r {
+		case "minute":
+			to.resolution = submit.ResolutionMinute
+		case "hour":
+			to.resolution = submit.ResolutionHour
+		case "day":
+			to.resolution = submit.ResolutionDay
+		default:
+			return tableOptions{}, fmt.Errorf("bad resolution option %q", r)
+		}
+	}
+
+	for k, v := range opts {
+		if f, ok := strings.CutPrefix(k, "filter."); ok {
+			to.filters[f] = v
+		}
+	}
+
+	return to, nil
+}
+
+// read reads records in format, csv or json, from r and returns points
+// after after.
+func (o tableOptions) read(format string, r io.Reader, after time.Time) ([]submit.Point, error) {
+	var recs []tableRecord
+	var err error
+	switch format {
+	case "csv":
+		recs, err = readCSVRecords(r)
+	case "json":
+		recs, err = readJSONRecords(r, o.records)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return o.points(recs, after)
+}
+
+// A tableRecord returns the value of a field as a string, and whether it
+// was present.
+type tableRecord func(field string) (string, bool)
+
+func readCSVRecords(r io.Reader) ([]tableRecord, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	hdrr, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	hdr := make(map[string]int)
+	for i, h := range hdrr {
+		// Drop any byte order mark.
+		hdr[strings.TrimPrefix(h, "\ufeff")] = i
+	}
+
+	var recs []tableRecord
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		recs = append(recs, func(field string) (string, bool) {
+			i, ok := hdr[field]
+			if !ok || i >= len(rec) {
+				return "", false
+			}
+			return rec[i], true
+		})
+	}
+	return recs, nil
+}
+
+func readJSONRecords(r io.Reader, path string) ([]tableRecord, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decoding JSON: %w", err)
+	}
+
+	if path != "" {
+		v, ok := jsonPath(doc, path)
+		if !ok {
+			return nil, fmt.Errorf("no %q in JSON", path)
+		}
+		doc = v
+	}
+
+	arr, ok := doc.([]any)
+	if !ok {
+		return nil, fmt.Errorf("JSON records are %T, want an array", doc)
+	}
+
+	recs := make([]tableRecord, 0, len(arr))
+	for _, obj := range arr {
+		recs = append(recs, func(field string) (string, bool) {
+			v, ok := jsonPath(obj, field)
+			if !ok || v == nil {
+				return "", false
+			}
+			switch v := v.(type) {
+			case string:
+				return v, true
+			case json.Number:
+				return v.String(), true
+			}
+			return fmt.Sprint(v), true
+		})
+	}
+	return recs, nil
+}
+
+// jsonPath returns the value at the dot-separated path in v.
+func jsonPath(v any, path string) (any, bool) {
+	for _, k := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[k]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// points converts recs to points after after, summing values with the same
+// time. Records without a value are skipped.
+func (o tableOptions) points(recs []tableRecord, after time.Time) ([]submit.Point, error) {
+	sums := make(map[int64]float64)
+	for i, rec := range recs {
+		if !o.match(rec) {
+			continue
+		}
+
+		vs, ok := rec(o.valueField)
+		if !ok || strings.TrimSpace(vs) == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(vs), 64)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: bad value %q", i, vs)
+		}
+
+		ts, ok := rec(o.timeField)
+		if !ok {
+			return nil, fmt.Errorf("record %d: no %s field", i, o.timeField)
+		}
+		t, err := o.parseTime(ts)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		if !t.After(after) {
+			continue
+		}
+
+		sums[t.Unix()] += v
+	}
+
+	pts := make([]submit.Point, 0, len(sums))
+	for t, v := range sums {
+		pts = append(pts, submit.Point{Time: t, Resolution: o.resolution, Value: v})
+	}
+	sort.Slice(pts, func(i, j int) bool { return pts[i].Time < pts[j].Time })
+	return pts, nil
+}
+
+func (o tableOptions) match(rec tableRecord) bool {
+	for f, want := range o.filters {
+		if v, _ := rec(f); v != want {
+			return false
+		}
+	}
+	return true
+}
+
+func (o tableOptions) parseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	switch o.timeFormat {
+	case "unix", "unix_ms":
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad time %q", s)
+		}
+		if o.timeFormat == "unix_ms" {
+			return time.UnixMilli(int64(n)), nil
+		}
+		return time.Unix(int64(n), 0), nil
+	}
+
+	t, err := time.ParseInLocation(o.timeFormat, s, o.loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time %q", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,130 @@
+package source_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/danp/counterbase/source"
+	"github.com/danp/counterbase/submit"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHTTPTable(t *testing.T) {
+	t.Parallel()
+
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docs := map[string]string{
+		"/counts.csv": "\ufeffDate,Direction,Lane,Count\n" +
+			"2021-06-01 00:00,Northbound,1,3\n" +
+			"2021-06-01 00:00,Northbound,2,4\n" +
+			"2021-06-01 00:00,Southbound,1,9\n" +
+			"2021-06-01 01:00,Northbound,1,5\n" +
+			"2021-06-01 02:00,Northbound,1,\n" +
+			"2021-06-01 03:00,Northbound,1,6\n",
+		"/counts.json": `{"features": [
+			{"properties": {"time": 1622516400000, "dir": "NB", "count": 7}},
+			{"properties": {"time": 1622520000000, "dir": "NB", "count": 8}},
+			{"properties": {"time": 1622520000000, "dir": "SB", "count": 1}}
+		]}`,
+	}
+
+	var gotQuery string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc, ok := docs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		gotQuery = r.URL.RawQuery
+		io.WriteString(w, doc)
+	}))
+	defer srv.Close()
+
+	host := srv.Listener.Addr().String()
+	hour := func(h int) int64 { return time.Date(2021, 6, 1, h, 0, 0, 0, loc).Unix() }
+
+	t.Run("csv", func(t *testing.T) {
+		g := &source.HTTPTable{Format: "csv"}
+		req := source.GetRequest{
+			URL:   &url.URL{Scheme: "csvhttp", Host: host, Path: "/counts.csv", RawQuery: "year=2021"},
+			After: time.Unix(hour(0), 0),
+			Options: map[string]string{
+				"scheme":           "http",
+				"time":             "Date",
+				"value":            "Count",
+				"time_format":      "2006-01-02 15:04",
+				"filter.Direction": "Northbound",
+			},
+			Location: loc,
+		}
+
+		got, err := g.Get(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []submit.Point{
+			{Time: hour(1), Resolution: submit.ResolutionHour, Value: 5},
+			{Time: hour(3), Resolution: submit.ResolutionHour, Value: 6},
+		}
+		if d := cmp.Diff(want, got); d != "" {
+			t.Error(d)
+		}
+		if gotQuery != "year=2021" {
+			t.Errorf("got query %q, want year=2021", gotQuery)
+		}
+
+		// Records at the same time are summed.
+		req.After = time.Time{}
+		got, err = g.Get(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got[0].Time != hour(0) || got[0].Value != 7 {
+			t.Errorf("got first point %+v, want 7 at %d", got[0], hour(0))
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		g := &source.HTTPTable{Format: "json"}
+		req := source.GetRequest{
+			URL: &url.URL{Scheme: "jsonhttp", Host: host, Path: "/counts.json"},
+			Options: map[string]string{
+				"scheme":                "http",
+				"records":               "features",
+				"time":                  "properties.time",
+				"value":                 "properties.count",
+				"time_format":           "unix_ms",
+				"filter.properties.dir": "NB",
+			},
+		}
+
+		got, err := g.Get(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []submit.Point{
+			{Time: 1622516400, Resolution: submit.ResolutionHour, Value: 7},
+			{Time: 1622520000, Resolution: submit.ResolutionHour, Value: 8},
+		}
+		if d := cmp.Diff(want, got); d != "" {
+			t.Error(d)
+		}
+	})
+
+	t.Run("missing options", func(t *testing.T) {
+		g := &source.HTTPTable{Format: "csv"}
+		req := source.GetRequest{URL: &url.URL{Scheme: "csvhttp", Host: host, Path: "/counts.csv"}}
+		if _, err := g.Get(context.Background(), req); err == nil {
+			t.Error("got no error")
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package submit
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/danp/counterbase/directory"
+)
+
+// A Token allows a client to submit data for some counters.
+//
+// Tokens are looked up by the SHA-256 hash of the bearer token the client
+// sends so the token itself doesn't need to be stored.
+type Token struct {
+	Name string `json:"name"`
+	// Hash is the hex-encoded SHA-256 hash of the bearer token, as returned
+	// by HashToken.
+	Hash string `json:"hash"`
+	// Counters lists the counter IDs the token may submit for.
+	// "*" allows all counters.
+	Counters []string `json:"counters,omitempty"`
+	// Tags allows submitting for any counter with one of the tags.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// Allows reports whether the token may submit data for ctr.
+func (t Token) Allows(ctr directory.Counter) bool {
+	if slices.Contains(t.Counters, "*") || slices.Contains(t.Counters, ctr.ID) {
+		return true
+	}
+	for _, tag := range t.Tags {
+		if slices.Contains(ctr.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrUnknownToken is returned by a TokenStore when no token matches.
+var ErrUnknownToken = errors.New("unknown token")
+
+type TokenStore interface {
+	// LookupToken returns the token with the given hash, or ErrUnknownToken.
+	LookupToken(ctx context.Context, hash string) (Token, error)
+}
+
+// HashToken returns the hash of the bearer token tok, for use in Token.Hash.
+func HashToken(tok string) string {
+	h := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(h[:])
+}
+
+// NewToken returns a new random bearer token.
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// FileTokens is a TokenStore backed by a fixed list of tokens, usually
+// loaded from a JSON file with LoadTokenFile.
+type FileTokens []Token
+
+// LoadTokenFile reads a JSON list of Tokens from the file at path.
+func LoadTokenFile(path string) (FileTokens, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var toks FileTokens
+	if err := json.Unmarshal(b, &toks); err != nil {
+		return nil, err
+	}
+	return toks, nil
+}
+
+func (f FileTokens) LookupToken(ctx context.Context, hash string) (Token, error) {
+	for _, t := range f {
+		if t.Hash == hash {
+			return t, nil
+		}
+	}
+	return Token{}, ErrUnknownToken
+}
+
+func bearerToken(h string) string {
+	scheme, tok, ok := strings.Cut(h, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(tok)
+}
@@ -0,0 +1,333 @@
+package submit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultBatchPoints is used when Handler.BatchPoints or Client.BatchPoints
+// is zero.
+const DefaultBatchPoints = 10000
+
+// A BatchSubmitter can store several Requests at once, such as in a single
+// transaction. Handler.ServeBulk uses it when its Submitter implements it.
+type BatchSubmitter interface {
+	SubmitBatch(context.Context, []Request) ([]Result, error)
+}
+
+// BulkResponse is the body of every response from Handler.ServeBulk.
+type BulkResponse struct {
+	// Result totals the results of all stored requests. Its Warnings are
+	// reported in Errors instead.
+	Result
+
+	// Requests is how many requests were read.
+	Requests int `json:"requests"`
+
+	// Error describes why the submission stopped early, if it did.
+	// Requests read before the problem may have been stored.
+	Error string `json:"error,omitempty"`
+
+	// Errors lists requests that weren't stored or were stored with warnings.
+	Errors []RequestError `json:"errors,omitempty"`
+}
+
+// A RequestError describes a problem with one Request in a bulk submission.
+type RequestError struct {
+	// Index is the position of the request in the submission.
+	Index       int          `json:"index"`
+	ID          string       `json:"id"`
+	DirectionID string       `json:"direction_id"`
+	Message     string       `json:"message,omitempty"`
+	Points      []PointError `json:"points,omitempty"`
+	// Warning is set if the request was stored despite the problems.
+	Warning bool `json:"warning,omitempty"`
+}
+
+func (e RequestError) Error() string {
+	msg := fmt.Sprintf("request %d (%s %s)", e.Index, e.ID, e.DirectionID)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if len(e.Points) > 0 {
+		msg += fmt.Sprintf(" (%d invalid points, first: %s)", len(e.Points), e.Points[0])
+	}
+	return msg
+}
+
+// A BulkError is returned by Stream when some requests were not stored.
+type BulkError struct {
+	Requests []RequestError
+}
+
+func (e *BulkError) Error() string {
+	return fmt.Sprintf("%d requests not stored, first: %s", len(e.Requests), e.Requests[0])
+}
+
+// ServeBulk accepts a stream of newline-delimited JSON Requests, optionally
+// gzip-encoded. Requests are checked as they would be by ServeHTTP and
+// stored in batches of up to BatchPoints points. Points rejected by a
+// ConflictReject policy are only counted in the BulkResponse's Result.
+func (h *Handler) ServeBulk(w http.ResponseWriter, r *http.Request) {
+	tok, status, err := h.authenticate(r)
+	if err != nil {
+		h.logger().WarnContext(r.Context(), "submit not authenticated", "path", r.URL.Path, "status", status, "err", err)
+		writeResponse(w, status, BulkResponse{Error: err.Error()})
+		return
+	}
+
+	body := io.Reader(r.Body)
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeResponse(w, http.StatusBadRequest, BulkResponse{Error: "reading gzip body: " + err.Error()})
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	counters, err := h.counters(r.Context(), tok)
+	if err != nil {
+		h.logger().ErrorContext(r.Context(), "loading directory", "path", r.URL.Path, "err", err)
+		writeResponse(w, http.StatusInternalServerError, BulkResponse{Error: "loading directory: " + err.Error()})
+		return
+	}
+
+	batchPoints := h.BatchPoints
+	if batchPoints <= 0 {
+		batchPoints = DefaultBatchPoints
+	}
+
+	var (
+		resp     BulkResponse
+		batch    []Request
+		indexes  []int
+		warnings [][]PointError
+		points   int
+	)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		results, err := h.submitBatch(r.Context(), batch)
+		if err != nil {
+			h.logger().ErrorContext(r.Context(), "bulk submit failed", "requests", len(batch), "points", points, "err", err)
+		}
+		for i, res := range results {
+			resp.Result.Merge(res)
+			if ws := append(warnings[i], res.Warnings...); len(ws) > 0 {
+				resp.Errors = append(resp.Errors, RequestError{Index: indexes[i], ID: batch[i].ID, DirectionID: batch[i].DirectionID, Points: ws, Warning: true})
+			}
+		}
+
+		batch, indexes, warnings, points = batch[:0], indexes[:0], warnings[:0], 0
+		return err
+	}
+
+	dec := json.NewDecoder(body)
+	for {
+		var req Request
+		if err := dec.Decode(&req); err == io.EOF {
+			break
+		} else if err != nil {
+			resp.Error = fmt.Sprintf("decoding request %d: %s", resp.Requests, err)
+			status := http.StatusBadRequest
+			if err := flush(); err != nil {
+				resp.Error = err.Error()
+				status = http.StatusInternalServerError
+			}
+			writeResponse(w, status, resp)
+			return
+		}
+		idx := resp.Requests
+		resp.Requests++
+
+		ws, _, verr := h.check(tok, counters, req)
+		if verr != nil {
+			resp.Errors = append(resp.Errors, RequestError{Index: idx, ID: req.ID, DirectionID: req.DirectionID, Message: verr.Message, Points: verr.Points})
+			continue
+		}
+
+		batch = append(batch, req)
+		indexes = append(indexes, idx)
+		warnings = append(warnings, ws)
+		points += len(req.Points)
+
+		if points >= batchPoints {
+			if err := flush(); err != nil {
+				resp.Error = err.Error()
+				writeResponse(w, http.StatusInternalServerError, resp)
+				return
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		resp.Error = err.Error()
+		writeResponse(w, http.StatusInternalServerError, resp)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, resp)
+}
+
+func (h *Handler) submitBatch(ctx context.Context, reqs []Request) ([]Result, error) {
+	if bs, ok := h.Submitter.(BatchSubmitter); ok {
+		return bs.SubmitBatch(ctx, reqs)
+	}
+
+	results := make([]Result, 0, len(reqs))
+	for _, req := range reqs {
+		res, err := h.Submitter.Submit(ctx, req)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// A Stream sends Requests to a bulk endpoint, such as one served by
+// Handler.ServeBulk, in gzip-encoded batches. It's created by Client.Stream.
+type Stream struct {
+	c   *Client
+	ctx context.Context
+
+	buf    bytes.Buffer
+	gz     *gzip.Writer
+	n      int
+	points int
+
+	sent int
+	resp BulkResponse
+}
+
+// Stream returns a new Stream sending to c's bulk URL.
+func (c *Client) Stream(ctx context.Context) *Stream {
+	s := &Stream{c: c, ctx: ctx}
+	s.gz = gzip.NewWriter(&s.buf)
+	return s
+}
+
+// Add queues req, sending queued requests if there are at least
+// Client.BatchPoints points queued.
+func (s *Stream) Add(req Request) error {
+	if err := json.NewEncoder(s.gz).Encode(req); err != nil {
+		return err
+	}
+	s.n++
+	s.points += len(req.Points)
+
+	batchPoints := s.c.BatchPoints
+	if batchPoints <= 0 {
+		batchPoints = DefaultBatchPoints
+	}
+	if s.points >= batchPoints {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Flush sends any queued requests.
+func (s *Stream) Flush() error {
+	if s.n == 0 {
+		return nil
+	}
+
+	if err := s.gz.Close(); err != nil {
+		return err
+	}
+
+	body := s.buf.Bytes()
+	s.buf = bytes.Buffer{}
+	s.gz.Reset(&s.buf)
+
+	hreq, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.c.bulkURL(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/x-ndjson")
+	hreq.Header.Set("Content-Encoding", "gzip")
+	if s.c.Token != "" {
+		hreq.Header.Set("Authorization", "Bearer "+s.c.Token)
+	}
+
+	offset := s.sent
+	s.sent += s.n
+	s.n, s.points = 0, 0
+
+	resp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	rb, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var bresp BulkResponse
+	decodeErr := json.Unmarshal(rb, &bresp)
+
+	s.resp.Result.Merge(bresp.Result)
+	s.resp.Requests += bresp.Requests
+	for _, re := range bresp.Errors {
+		re.Index += offset
+		s.resp.Errors = append(s.resp.Errors, re)
+	}
+
+	if resp.StatusCode/100 != 2 {
+		rerr := &ResponseError{StatusCode: resp.StatusCode}
+		if decodeErr == nil {
+			rerr.Message = bresp.Error
+		} else if len(rb) > 0 {
+			if len(rb) > 100 {
+				rb = rb[:100]
+			}
+			rerr.Message = string(rb)
+		}
+		return rerr
+	}
+
+	if decodeErr != nil {
+		return fmt.Errorf("decoding response: %w", decodeErr)
+	}
+	return nil
+}
+
+// Close sends any queued requests and returns the combined response for
+// everything sent by the Stream. A *BulkError is returned if some
+// requests were not stored.
+func (s *Stream) Close() (BulkResponse, error) {
+	if err := s.Flush(); err != nil {
+		return s.resp, err
+	}
+
+	var errs []RequestError
+	for _, re := range s.resp.Errors {
+		if !re.Warning {
+			errs = append(errs, re)
+		}
+	}
+	if len(errs) > 0 {
+		return s.resp, &BulkError{Requests: errs}
+	}
+	return s.resp, nil
+}
+
+func (c *Client) bulkURL() string {
+	if c.BulkURL != "" {
+		return c.BulkURL
+	}
+	return strings.TrimSuffix(c.URL, "/") + "/bulk"
+}
@@ -4,15 +4,21 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"time"
+
+	"github.com/danp/counterbase/directory"
 )
 
 type Request struct {
-	ID          string  `json:"id"`
-	DirectionID string  `json:"direction_id"`
-	Points      []Point `json:"points"`
+	ID          string         `json:"id"`
+	DirectionID string         `json:"direction_id"`
+	Conflict    ConflictPolicy `json:"conflict,omitempty"`
+	Points      []Point        `json:"points"`
 }
 
 type Point struct {
@@ -29,60 +35,460 @@ const (
 	ResolutionDay    Resolution = 3
 )
 
+func (r Resolution) Valid() bool {
+	switch r {
+	case ResolutionMinute, ResolutionHour, ResolutionDay:
+		return true
+	}
+	return false
+}
+
+// A ConflictPolicy controls what happens when a submitted point has the same
+// counter, direction and time as a point that's already stored.
+//
+// Policies decide by value. A point with the stored value but a different
+// resolution loses nothing by being stored, so it updates the stored point
+// under every policy but ConflictKeep.
+type ConflictPolicy string
+
+const (
+	// ConflictReplace overwrites the stored point. It's used when a Request
+	// has no Conflict set.
+	ConflictReplace ConflictPolicy = "replace"
+	// ConflictKeep leaves the stored point as is.
+	ConflictKeep ConflictPolicy = "keep"
+	// ConflictMax stores whichever of the two values is larger.
+	ConflictMax ConflictPolicy = "max"
+	// ConflictReject refuses the submitted point if its value differs from
+	// the stored one.
+	ConflictReject ConflictPolicy = "reject"
+)
+
+func (c ConflictPolicy) Valid() bool {
+	switch c {
+	case "", ConflictReplace, ConflictKeep, ConflictMax, ConflictReject:
+		return true
+	}
+	return false
+}
+
+// An Outcome describes what happened to a single submitted point.
+type Outcome int
+
+const (
+	OutcomeInserted Outcome = iota
+	OutcomeUpdated
+	OutcomeUnchanged
+	OutcomeRejected
+)
+
+// Apply decides how incoming is handled when existing is already stored,
+// returning the point to store and the outcome. The returned point only
+// needs to be written for OutcomeUpdated.
+func (c ConflictPolicy) Apply(existing, incoming Point) (Point, Outcome) {
+	if existing.Value == incoming.Value {
+		if existing.Resolution == incoming.Resolution || c == ConflictKeep {
+			return existing, OutcomeUnchanged
+		}
+		return incoming, OutcomeUpdated
+	}
+
+	switch c {
+	case ConflictKeep:
+		return existing, OutcomeUnchanged
+	case ConflictMax:
+		if incoming.Value > existing.Value {
+			return incoming, OutcomeUpdated
+		}
+		return existing, OutcomeUnchanged
+	case ConflictReject:
+		return existing, OutcomeRejected
+	}
+
+	return incoming, OutcomeUpdated
+}
+
+// Result summarizes what a Submitter did with the points in a Request.
+type Result struct {
+	Inserted  int `json:"inserted"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Rejected  int `json:"rejected"`
+
+	// Start and End are the inclusive range of times of points that were
+	// inserted or updated. Both are zero if nothing was written.
+	Start int64 `json:"start,omitempty"`
+	End   int64 `json:"end,omitempty"`
+
+	// Warnings lists problems found with the request that didn't prevent
+	// it from being stored. Index is -1 for problems with the request as
+	// a whole.
+	Warnings []PointError `json:"warnings,omitempty"`
+}
+
+// Add counts pt with outcome o.
+func (r *Result) Add(pt Point, o Outcome) {
+	switch o {
+	case OutcomeInserted:
+		r.Inserted++
+	case OutcomeUpdated:
+		r.Updated++
+	case OutcomeUnchanged:
+		r.Unchanged++
+		return
+	case OutcomeRejected:
+		r.Rejected++
+		return
+	}
+
+	if r.Start == 0 || pt.Time < r.Start {
+		r.Start = pt.Time
+	}
+	if pt.Time > r.End {
+		r.End = pt.Time
+	}
+}
+
+// Merge adds the counts and range of o to r.
+func (r *Result) Merge(o Result) {
+	r.Inserted += o.Inserted
+	r.Updated += o.Updated
+	r.Unchanged += o.Unchanged
+	r.Rejected += o.Rejected
+	if o.Start != 0 && (r.Start == 0 || o.Start < r.Start) {
+		r.Start = o.Start
+	}
+	if o.End > r.End {
+		r.End = o.End
+	}
+}
+
+// Written returns how many points were inserted or updated.
+func (r Result) Written() int {
+	return r.Inserted + r.Updated
+}
+
+// A PointError describes a problem with a single point in a Request.
+type PointError struct {
+	// Index is the position of the point in Request.Points.
+	Index   int    `json:"index"`
+	Time    int64  `json:"time"`
+	Message string `json:"message"`
+}
+
+func (e PointError) Error() string {
+	return fmt.Sprintf("point %d (time %d): %s", e.Index, e.Time, e.Message)
+}
+
+// A ValidationError describes why a Request can't be stored.
+type ValidationError struct {
+	// Message describes a problem with the request as a whole.
+	Message string
+	// Points lists problems with individual points.
+	Points []PointError
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Points) == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("%d invalid points, first: %s", len(e.Points), e.Points[0])
+}
+
+// Validate checks req for problems that would prevent it from being stored,
+// returning a *ValidationError if there are any.
+func (r Request) Validate() error {
+	if r.ID == "" {
+		return &ValidationError{Message: "missing id"}
+	}
+	if r.DirectionID == "" {
+		return &ValidationError{Message: "missing direction_id"}
+	}
+	if !r.Conflict.Valid() {
+		return &ValidationError{Message: fmt.Sprintf("unknown conflict policy %q", r.Conflict)}
+	}
+
+	var perrs []PointError
+	for i, pt := range r.Points {
+		var msg string
+		switch {
+		case pt.Time <= 0:
+			msg = "time must be positive"
+		case !pt.Resolution.Valid():
+			msg = fmt.Sprintf("unknown resolution %d", pt.Resolution)
+		default:
+			continue
+		}
+		perrs = append(perrs, PointError{Index: i, Time: pt.Time, Message: msg})
+	}
+	if len(perrs) > 0 {
+		return &ValidationError{Message: "invalid points", Points: perrs}
+	}
+	return nil
+}
+
 type Submitter interface {
-	Submit(context.Context, Request) error
+	Submit(context.Context, Request) (Result, error)
 }
 
 type Handler struct {
 	Submitter Submitter
+
+	// Directory is used to check requests when Validation is not
+	// ValidationOff.
+	Directory  Directory
+	Validation ValidationMode
+
+	// Tokens, if set, requires requests to carry a bearer token allowed
+	// to submit for the request's counter. Checking a Token's Tags
+	// requires Directory.
+	Tokens TokenStore
+
+	// BatchPoints is roughly how many points ServeBulk stores at once.
+	// If zero, DefaultBatchPoints is used.
+	BatchPoints int
+
+	// Logger is used to log failed requests. If nil, slog.Default is used.
+	Logger *slog.Logger
 }
 
+func (h *Handler) logger() *slog.Logger {
+	if h.Logger != nil {
+		return h.Logger
+	}
+	return slog.Default()
+}
+
+// Response is the body of every response from Handler.
+type Response struct {
+	Result
+
+	// Error describes why the request failed, if it did.
+	Error string `json:"error,omitempty"`
+
+	// Errors lists problems with individual points. If any are present
+	// none of the request's points were stored.
+	Errors []PointError `json:"errors,omitempty"`
+}
+
+// ServeHTTP stores the Request in r's body. If a ConflictReject request has
+// every point rejected it responds with 409 Conflict. If only some are, it
+// responds with 200 OK as usual, and the Response's Rejected count must be
+// checked to find out.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tok, status, err := h.authenticate(r)
+	if err != nil {
+		h.logger().WarnContext(r.Context(), "submit not authenticated", "path", r.URL.Path, "status", status, "err", err)
+		writeResponse(w, status, Response{Error: err.Error()})
+		return
+	}
+
 	var req Request
 
 	b, err := io.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeResponse(w, http.StatusBadRequest, Response{Error: "reading body: " + err.Error()})
 		return
 	}
 
 	if err := json.Unmarshal(b, &req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeResponse(w, http.StatusBadRequest, Response{Error: "decoding body: " + err.Error()})
+		return
+	}
+
+	counters, err := h.counters(r.Context(), tok)
+	if err != nil {
+		h.logger().ErrorContext(r.Context(), "loading directory", "path", r.URL.Path, "err", err)
+		writeResponse(w, http.StatusInternalServerError, Response{Error: "loading directory: " + err.Error()})
+		return
+	}
+
+	warnings, status, verr := h.check(tok, counters, req)
+	if verr != nil {
+		writeResponse(w, status, Response{Error: verr.Message, Errors: verr.Points})
 		return
 	}
 
-	if err := h.Submitter.Submit(r.Context(), req); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	res, err := h.Submitter.Submit(r.Context(), req)
+	res.Warnings = append(warnings, res.Warnings...)
+	if err != nil {
+		h.logger().ErrorContext(r.Context(), "submit failed", "counter_id", req.ID, "direction_id", req.DirectionID, "points", len(req.Points), "err", err)
+		writeResponse(w, http.StatusInternalServerError, Response{Result: res, Error: err.Error()})
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	status = http.StatusOK
+	if res.Rejected > 0 && res.Rejected == len(req.Points) {
+		status = http.StatusConflict
+	}
+	writeResponse(w, status, Response{Result: res})
+}
+
+// authenticate returns the Token used for r when Tokens is set.
+// If r isn't allowed it returns an error and the status to respond with.
+func (h *Handler) authenticate(r *http.Request) (*Token, int, error) {
+	if h.Tokens == nil {
+		return nil, 0, nil
+	}
+
+	bt := bearerToken(r.Header.Get("Authorization"))
+	if bt == "" {
+		return nil, http.StatusUnauthorized, errors.New("missing bearer token")
+	}
+
+	t, err := h.Tokens.LookupToken(r.Context(), HashToken(bt))
+	if errors.Is(err, ErrUnknownToken) {
+		return nil, http.StatusUnauthorized, errors.New("unknown bearer token")
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("looking up token: %w", err)
+	}
+	return &t, 0, nil
+}
+
+// counters returns the directory's counters if they're needed to check
+// requests made with tok.
+func (h *Handler) counters(ctx context.Context, tok *Token) ([]directory.Counter, error) {
+	if h.Directory == nil || (h.Validation == ValidationOff && (tok == nil || len(tok.Tags) == 0)) {
+		return nil, nil
+	}
+	return h.Directory.Counters(ctx)
+}
+
+// check returns any warnings about req, or a *ValidationError and the status
+// to respond with if req can't be stored.
+func (h *Handler) check(tok *Token, counters []directory.Counter, req Request) ([]PointError, int, *ValidationError) {
+	if err := req.Validate(); err != nil {
+		return nil, validationStatus(err.(*ValidationError)), err.(*ValidationError)
+	}
+
+	if tok != nil {
+		ctr, ok := findCounter(counters, req.ID)
+		if !ok {
+			ctr = directory.Counter{ID: req.ID}
+		}
+		if !tok.Allows(ctr) {
+			return nil, http.StatusForbidden, &ValidationError{Message: fmt.Sprintf("token %q may not submit for counter %q", tok.Name, req.ID)}
+		}
+	}
+
+	if h.Validation == ValidationOff || h.Directory == nil {
+		return nil, 0, nil
+	}
+
+	err := CheckDirectory(counters, req, time.Now())
+	if err == nil {
+		return nil, 0, nil
+	}
+
+	verr := err.(*ValidationError)
+	if h.Validation == ValidationStrict {
+		return nil, validationStatus(verr), verr
+	}
+
+	var warnings []PointError
+	if len(verr.Points) == 0 {
+		warnings = append(warnings, PointError{Index: -1, Message: verr.Message})
+	}
+	return append(warnings, verr.Points...), 0, nil
+}
+
+func validationStatus(verr *ValidationError) int {
+	if len(verr.Points) > 0 {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadRequest
+}
+
+func writeResponse(w http.ResponseWriter, status int, resp any) {
+	w.Header().Set("Content-Type", "application/json")
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// A ResponseError is returned by Client when the API responds with a
+// non-2xx status.
+type ResponseError struct {
+	StatusCode int
+	Message    string
+	Points     []PointError
+}
+
+func (e *ResponseError) Error() string {
+	msg := fmt.Sprintf("bad status %d", e.StatusCode)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if len(e.Points) > 0 {
+		msg += fmt.Sprintf(" (%d invalid points, first: %s)", len(e.Points), e.Points[0])
+	}
+	return msg
 }
 
 type Client struct {
 	URL string
+
+	// Token, if set, is sent as a bearer token with each request.
+	Token string
+
+	// BulkURL is where Streams send requests.
+	// If blank, URL with /bulk appended is used.
+	BulkURL string
+
+	// BatchPoints is roughly how many points a Stream sends at once.
+	// If zero, DefaultBatchPoints is used.
+	BatchPoints int
 }
 
-func (c *Client) Submit(ctx context.Context, req Request) error {
+func (c *Client) Submit(ctx context.Context, req Request) (Result, error) {
 	b, err := json.Marshal(req)
 	if err != nil {
-		return err
+		return Result{}, err
 	}
 
-	resp, err := http.Post(c.URL, "application/json", bytes.NewReader(b))
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(b))
 	if err != nil {
-		return err
+		return Result{}, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		hreq.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		return Result{}, err
 	}
 	defer resp.Body.Close()
 
-	_, err = io.ReadAll(resp.Body)
+	rb, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return Result{}, err
 	}
 
+	var sresp Response
+	decodeErr := json.Unmarshal(rb, &sresp)
+
 	if resp.StatusCode/100 != 2 {
-		return fmt.Errorf("bad status %d", resp.StatusCode)
+		rerr := &ResponseError{StatusCode: resp.StatusCode}
+		if decodeErr == nil {
+			rerr.Message = sresp.Error
+			rerr.Points = sresp.Errors
+		} else if len(rb) > 0 {
+			if len(rb) > 100 {
+				rb = rb[:100]
+			}
+			rerr.Message = string(rb)
+		}
+		return sresp.Result, rerr
 	}
 
-	return nil
+	if len(rb) > 0 && decodeErr != nil {
+		return Result{}, fmt.Errorf("decoding response: %w", decodeErr)
+	}
+
+	return sresp.Result, nil
 }
@@ -2,6 +2,7 @@ package submit_test
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
@@ -10,7 +11,9 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/danp/counterbase/directory"
 	"github.com/danp/counterbase/submit"
 	"github.com/google/go-cmp/cmp"
 )
@@ -44,15 +47,49 @@ func TestHandler(t *testing.T) {
 	}
 	defer resp.Body.Close()
 
-	if got, want := resp.StatusCode, http.StatusNoContent; got != want {
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
 		t.Fatalf("got status %d, want %d", got, want)
 	}
 
+	var res submit.Result
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := cmp.Diff(submit.Result{Inserted: 1}, res); d != "" {
+		t.Error(d)
+	}
+
 	if d := cmp.Diff([]submit.Request{req}, fs.submits); d != "" {
 		t.Error(d)
 	}
 }
 
+func TestHandlerBadConflict(t *testing.T) {
+	fs := &fakeSubmitter{}
+
+	he := &submit.Handler{
+		Submitter: fs,
+	}
+
+	srv := httptest.NewServer(he)
+	defer srv.Close()
+
+	resp, err := srv.Client().Post(srv.URL, "application/json", strings.NewReader(`{"id":"first","direction_id":"one","conflict":"sometimes"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+		t.Fatalf("got status %d, want %d", got, want)
+	}
+
+	if len(fs.submits) != 0 {
+		t.Errorf("got %d submits, wanted 0", len(fs.submits))
+	}
+}
+
 func TestHandlerBadData(t *testing.T) {
 	fs := &fakeSubmitter{}
 
@@ -112,6 +149,253 @@ func TestHandlerSubmitError(t *testing.T) {
 	}
 }
 
+func TestHandlerRejected(t *testing.T) {
+	req := submit.Request{
+		ID:          "first",
+		DirectionID: "one",
+		Conflict:    submit.ConflictReject,
+		Points: []submit.Point{
+			{Time: 1, Value: 2, Resolution: submit.ResolutionHour},
+			{Time: 2, Value: 3, Resolution: submit.ResolutionHour},
+		},
+	}
+
+	cases := []struct {
+		rejected   int
+		wantStatus int
+	}{
+		{0, http.StatusOK},
+		{1, http.StatusOK},
+		{2, http.StatusConflict},
+	}
+
+	for _, tc := range cases {
+		srv := httptest.NewServer(&submit.Handler{Submitter: &fakeSubmitter{rejected: tc.rejected}})
+		defer srv.Close()
+
+		cl := &submit.Client{URL: srv.URL}
+		res, err := cl.Submit(context.Background(), req)
+
+		var rerr *submit.ResponseError
+		if tc.wantStatus == http.StatusOK && err != nil {
+			t.Errorf("%d rejected: got error %v, want none", tc.rejected, err)
+		} else if tc.wantStatus != http.StatusOK && (!errors.As(err, &rerr) || rerr.StatusCode != tc.wantStatus) {
+			t.Errorf("%d rejected: got error %v, want status %d", tc.rejected, err, tc.wantStatus)
+		}
+		if res.Rejected != tc.rejected {
+			t.Errorf("%d rejected: got result %+v", tc.rejected, res)
+		}
+	}
+}
+
+func TestHandlerValidation(t *testing.T) {
+	dir := fakeDirectory{
+		C: []directory.Counter{
+			{
+				ID:            "first",
+				ServiceRanges: []directory.ServiceRange{{Start: directory.SD(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))}},
+				Directions:    []directory.Direction{{ID: "one", Resolution: "hour"}},
+			},
+		},
+	}
+
+	req := submit.Request{
+		ID:          "first",
+		DirectionID: "one",
+		Points: []submit.Point{
+			{Time: time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC).Unix(), Value: 2, Resolution: submit.ResolutionHour},
+			{Time: time.Date(2021, 1, 1, 13, 0, 0, 0, time.UTC).Unix(), Value: 2, Resolution: submit.ResolutionDay},
+		},
+	}
+
+	reqb, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantErrors := []submit.PointError{
+		{Index: 1, Time: req.Points[1].Time, Message: "resolution day does not match expected hour"},
+	}
+
+	for _, mode := range []submit.ValidationMode{submit.ValidationWarn, submit.ValidationStrict} {
+		t.Run(string(mode), func(t *testing.T) {
+			fs := &fakeSubmitter{}
+
+			he := &submit.Handler{
+				Submitter:  fs,
+				Directory:  dir,
+				Validation: mode,
+			}
+
+			srv := httptest.NewServer(he)
+			defer srv.Close()
+
+			resp, err := srv.Client().Post(srv.URL, "application/json", bytes.NewReader(reqb))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			var sresp submit.Response
+			if err := json.NewDecoder(resp.Body).Decode(&sresp); err != nil {
+				t.Fatal(err)
+			}
+
+			if mode == submit.ValidationStrict {
+				if got, want := resp.StatusCode, http.StatusUnprocessableEntity; got != want {
+					t.Fatalf("got status %d, want %d", got, want)
+				}
+				if d := cmp.Diff(wantErrors, sresp.Errors); d != "" {
+					t.Error(d)
+				}
+				if len(fs.submits) != 0 {
+					t.Errorf("got %d submits, wanted 0", len(fs.submits))
+				}
+				return
+			}
+
+			if got, want := resp.StatusCode, http.StatusOK; got != want {
+				t.Fatalf("got status %d, want %d", got, want)
+			}
+			if d := cmp.Diff(wantErrors, sresp.Warnings); d != "" {
+				t.Error(d)
+			}
+			if len(fs.submits) != 1 {
+				t.Errorf("got %d submits, wanted 1", len(fs.submits))
+			}
+		})
+	}
+}
+
+func TestCheckDirectory(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	hour := func(d, h int) int64 { return time.Date(2021, 5, d, h, 0, 0, 0, time.UTC).Unix() }
+
+	counters := []directory.Counter{
+		{
+			ID: "first",
+			ServiceRanges: []directory.ServiceRange{
+				{Start: directory.SD(time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)), End: directory.SD(time.Date(2021, 5, 10, 0, 0, 0, 0, time.UTC))},
+				{Start: directory.SD(time.Date(2021, 5, 20, 0, 0, 0, 0, time.UTC))},
+			},
+			Directions: []directory.Direction{{ID: "one", Resolution: "hour"}, {ID: "two"}},
+		},
+	}
+
+	if err := submit.CheckDirectory(counters, submit.Request{ID: "second", DirectionID: "one"}, now); err == nil {
+		t.Error("wanted error for unknown counter")
+	}
+
+	if err := submit.CheckDirectory(counters, submit.Request{ID: "first", DirectionID: "three"}, now); err == nil {
+		t.Error("wanted error for unknown direction")
+	}
+
+	req := submit.Request{
+		ID:          "first",
+		DirectionID: "one",
+		Points: []submit.Point{
+			{Time: hour(2, 12), Resolution: submit.ResolutionHour, Value: 1},
+			{Time: hour(10, 23), Resolution: submit.ResolutionHour, Value: 1},
+			{Time: hour(15, 12), Resolution: submit.ResolutionHour, Value: 1},
+			{Time: hour(21, 12), Resolution: submit.ResolutionHour, Value: -1},
+			{Time: hour(21, 13), Resolution: submit.ResolutionHour, Value: 1.5},
+			{Time: hour(21, 14), Resolution: submit.ResolutionDay, Value: 1},
+			{Time: now.Add(time.Hour).Unix(), Resolution: submit.ResolutionHour, Value: 1},
+		},
+	}
+
+	err := submit.CheckDirectory(counters, req, now)
+
+	var verr *submit.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("got error %v, want *submit.ValidationError", err)
+	}
+
+	want := []submit.PointError{
+		{Index: 2, Time: req.Points[2].Time, Message: "time is outside counter service ranges"},
+		{Index: 3, Time: req.Points[3].Time, Message: "negative value"},
+		{Index: 4, Time: req.Points[4].Time, Message: "non-integer value"},
+		{Index: 5, Time: req.Points[5].Time, Message: "resolution day does not match expected hour"},
+		{Index: 6, Time: req.Points[6].Time, Message: "time is in the future"},
+	}
+	if d := cmp.Diff(want, verr.Points); d != "" {
+		t.Error(d)
+	}
+
+	req.DirectionID = "two"
+	req.Points = req.Points[5:6]
+	if err := submit.CheckDirectory(counters, req, now); err != nil {
+		t.Errorf("got error %v for direction without resolution", err)
+	}
+}
+
+func TestHandlerTokens(t *testing.T) {
+	dir := fakeDirectory{
+		C: []directory.Counter{
+			{ID: "first", Tags: []string{"bridge"}},
+			{ID: "second"},
+		},
+	}
+
+	toks := submit.FileTokens{
+		{Name: "bridge", Hash: submit.HashToken("s3cret"), Tags: []string{"bridge"}},
+	}
+
+	cases := []struct {
+		name       string
+		token      string
+		counter    string
+		wantStatus int
+	}{
+		{"missing", "", "first", http.StatusUnauthorized},
+		{"unknown", "other", "first", http.StatusUnauthorized},
+		{"allowed", "s3cret", "first", http.StatusOK},
+		{"forbidden", "s3cret", "second", http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fs := &fakeSubmitter{}
+
+			he := &submit.Handler{
+				Submitter: fs,
+				Directory: dir,
+				Tokens:    toks,
+			}
+
+			srv := httptest.NewServer(he)
+			defer srv.Close()
+
+			cl := &submit.Client{
+				URL:   srv.URL,
+				Token: c.token,
+			}
+
+			_, err := cl.Submit(context.Background(), submit.Request{ID: c.counter, DirectionID: "one"})
+
+			status := http.StatusOK
+			var rerr *submit.ResponseError
+			if errors.As(err, &rerr) {
+				status = rerr.StatusCode
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if status != c.wantStatus {
+				t.Errorf("got status %d, want %d", status, c.wantStatus)
+			}
+
+			wantSubmits := 0
+			if c.wantStatus == http.StatusOK {
+				wantSubmits = 1
+			}
+			if len(fs.submits) != wantSubmits {
+				t.Errorf("got %d submits, wanted %d", len(fs.submits), wantSubmits)
+			}
+		})
+	}
+}
+
 func TestClient(t *testing.T) {
 	var gotReq submit.Request
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -128,7 +412,7 @@ func TestClient(t *testing.T) {
 			t.Error(err)
 		}
 
-		w.WriteHeader(http.StatusNoContent)
+		w.Write([]byte(`{"inserted":1,"updated":2,"unchanged":3,"rejected":4}`))
 	}))
 	defer srv.Close()
 
@@ -139,26 +423,265 @@ func TestClient(t *testing.T) {
 	req := submit.Request{
 		ID:          "first",
 		DirectionID: "one",
+		Conflict:    submit.ConflictMax,
 		Points: []submit.Point{
 			{Time: 1, Value: 2, Resolution: submit.ResolutionHour},
 		},
 	}
 
-	if err := cl.Submit(context.Background(), req); err != nil {
+	res, err := cl.Submit(context.Background(), req)
+	if err != nil {
 		t.Fatal(err)
 	}
 
 	if d := cmp.Diff(req, gotReq); d != "" {
 		t.Error(d)
 	}
+
+	if d := cmp.Diff(submit.Result{Inserted: 1, Updated: 2, Unchanged: 3, Rejected: 4}, res); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestConflictPolicyApply(t *testing.T) {
+	existing := submit.Point{Time: 1, Resolution: submit.ResolutionHour, Value: 5}
+	lower := submit.Point{Time: 1, Resolution: submit.ResolutionHour, Value: 3}
+	higher := submit.Point{Time: 1, Resolution: submit.ResolutionHour, Value: 8}
+	daily := submit.Point{Time: 1, Resolution: submit.ResolutionDay, Value: 5}
+
+	cases := []struct {
+		policy      submit.ConflictPolicy
+		incoming    submit.Point
+		wantPoint   submit.Point
+		wantOutcome submit.Outcome
+	}{
+		{"", existing, existing, submit.OutcomeUnchanged},
+		{"", lower, lower, submit.OutcomeUpdated},
+		{submit.ConflictReplace, higher, higher, submit.OutcomeUpdated},
+		{submit.ConflictKeep, higher, existing, submit.OutcomeUnchanged},
+		{submit.ConflictMax, lower, existing, submit.OutcomeUnchanged},
+		{submit.ConflictMax, higher, higher, submit.OutcomeUpdated},
+		{submit.ConflictReject, existing, existing, submit.OutcomeUnchanged},
+		{submit.ConflictReject, higher, existing, submit.OutcomeRejected},
+		{submit.ConflictReject, daily, daily, submit.OutcomeUpdated},
+		{submit.ConflictKeep, daily, existing, submit.OutcomeUnchanged},
+		{submit.ConflictMax, daily, daily, submit.OutcomeUpdated},
+		{"", daily, daily, submit.OutcomeUpdated},
+	}
+
+	for _, c := range cases {
+		gotPoint, gotOutcome := c.policy.Apply(existing, c.incoming)
+		if gotPoint != c.wantPoint || gotOutcome != c.wantOutcome {
+			t.Errorf("%q.Apply(%v, %v) = %v, %v, want %v, %v", c.policy, existing, c.incoming, gotPoint, gotOutcome, c.wantPoint, c.wantOutcome)
+		}
+	}
+}
+
+func TestClientError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"inserted":0,"updated":0,"unchanged":0,"rejected":0,"error":"invalid points","errors":[{"index":0,"time":1,"message":"nope"}]}`))
+	}))
+	defer srv.Close()
+
+	cl := &submit.Client{
+		URL: srv.URL,
+	}
+
+	_, err := cl.Submit(context.Background(), submit.Request{ID: "first", DirectionID: "one"})
+
+	var rerr *submit.ResponseError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("got error %v, want *submit.ResponseError", err)
+	}
+
+	want := &submit.ResponseError{
+		StatusCode: http.StatusUnprocessableEntity,
+		Message:    "invalid points",
+		Points:     []submit.PointError{{Index: 0, Time: 1, Message: "nope"}},
+	}
+	if d := cmp.Diff(want, rerr); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestHandlerBulk(t *testing.T) {
+	fs := &fakeBatchSubmitter{}
+
+	he := &submit.Handler{
+		Submitter:   fs,
+		BatchPoints: 2,
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(he.ServeBulk))
+	defer srv.Close()
+
+	reqs := []submit.Request{
+		{ID: "first", DirectionID: "one", Points: []submit.Point{{Time: 1, Value: 1, Resolution: submit.ResolutionHour}}},
+		{ID: "first", DirectionID: "two", Points: []submit.Point{{Time: 1, Value: 2, Resolution: submit.ResolutionHour}}},
+		{ID: "first", DirectionID: "one", Points: []submit.Point{{Time: 2, Value: 3, Resolution: 9}}},
+		{ID: "second", DirectionID: "one", Points: []submit.Point{{Time: 3, Value: 4, Resolution: submit.ResolutionHour}}},
+	}
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	enc := json.NewEncoder(gz)
+	for _, req := range reqs {
+		if err := enc.Encode(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	hreq, err := http.NewRequest(http.MethodPost, srv.URL, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hreq.Header.Set("Content-Encoding", "gzip")
+
+	resp, err := srv.Client().Do(hreq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("got status %d, want %d", got, want)
+	}
+
+	var bresp submit.BulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&bresp); err != nil {
+		t.Fatal(err)
+	}
+
+	want := submit.BulkResponse{
+		Result:   submit.Result{Inserted: 3},
+		Requests: 4,
+		Errors: []submit.RequestError{
+			{Index: 2, ID: "first", DirectionID: "one", Message: "invalid points", Points: []submit.PointError{{Index: 0, Time: 2, Message: "unknown resolution 9"}}},
+		},
+	}
+	if d := cmp.Diff(want, bresp); d != "" {
+		t.Error(d)
+	}
+
+	wantBatches := [][]submit.Request{
+		{reqs[0], reqs[1]},
+		{reqs[3]},
+	}
+	if d := cmp.Diff(wantBatches, fs.batches); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestClientStream(t *testing.T) {
+	fs := &fakeSubmitter{}
+
+	he := &submit.Handler{
+		Submitter: fs,
+	}
+
+	var posts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.Path, "/submit/bulk"; got != want {
+			t.Errorf("got path %q, want %q", got, want)
+		}
+		if got, want := r.Header.Get("Authorization"), "Bearer tok"; got != want {
+			t.Errorf("got Authorization %q, want %q", got, want)
+		}
+		posts++
+		he.ServeBulk(w, r)
+	}))
+	defer srv.Close()
+
+	cl := &submit.Client{
+		URL:         srv.URL + "/submit",
+		Token:       "tok",
+		BatchPoints: 2,
+	}
+
+	st := cl.Stream(context.Background())
+
+	reqs := []submit.Request{
+		{ID: "first", DirectionID: "one", Points: []submit.Point{{Time: 1, Value: 1, Resolution: submit.ResolutionHour}}},
+		{ID: "first", DirectionID: "two", Points: []submit.Point{{Time: 1, Value: 2, Resolution: submit.ResolutionHour}}},
+		{ID: "", DirectionID: "one", Points: []submit.Point{{Time: 3, Value: 4, Resolution: submit.ResolutionHour}}},
+	}
+	for _, req := range reqs {
+		if err := st.Add(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bresp, err := st.Close()
+
+	var berr *submit.BulkError
+	if !errors.As(err, &berr) {
+		t.Fatalf("got error %v, want *submit.BulkError", err)
+	}
+
+	wantErrors := []submit.RequestError{{Index: 2, DirectionID: "one", Message: "missing id"}}
+	if d := cmp.Diff(wantErrors, berr.Requests); d != "" {
+		t.Error(d)
+	}
+
+	if got, want := bresp.Requests, 3; got != want {
+		t.Errorf("got %d requests, want %d", got, want)
+	}
+
+	if got, want := bresp.Inserted, 2; got != want {
+		t.Errorf("got %d inserted, want %d", got, want)
+	}
+
+	if got, want := posts, 2; got != want {
+		t.Errorf("got %d posts, want %d", got, want)
+	}
+
+	if d := cmp.Diff(reqs[:2], fs.submits); d != "" {
+		t.Error(d)
+	}
+}
+
+type fakeDirectory struct {
+	C []directory.Counter
+}
+
+func (f fakeDirectory) Counters(context.Context) ([]directory.Counter, error) {
+	return f.C, nil
 }
 
 type fakeSubmitter struct {
 	err     error
 	submits []submit.Request
+	// rejected is how many points of each request to report rejected.
+	rejected int
 }
 
-func (f *fakeSubmitter) Submit(ctx context.Context, req submit.Request) error {
+func (f *fakeSubmitter) Submit(ctx context.Context, req submit.Request) (submit.Result, error) {
 	f.submits = append(f.submits, req)
-	return f.err
+	if f.err != nil {
+		return submit.Result{}, f.err
+	}
+	return submit.Result{Inserted: len(req.Points) - f.rejected, Rejected: f.rejected}, nil
+}
+
+type fakeBatchSubmitter struct {
+	fakeSubmitter
+	batches [][]submit.Request
+}
+
+func (f *fakeBatchSubmitter) SubmitBatch(ctx context.Context, reqs []submit.Request) ([]submit.Result, error) {
+	f.batches = append(f.batches, append([]submit.Request(nil), reqs...))
+
+	var results []submit.Result
+	for _, req := range reqs {
+		res, err := f.Submit(ctx, req)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, res)
+	}
+	return results, nil
 }
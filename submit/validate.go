@@ -0,0 +1,104 @@
+package submit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/danp/counterbase/directory"
+)
+
+type Directory interface {
+	Counters(context.Context) ([]directory.Counter, error)
+}
+
+// A ValidationMode controls how Handler treats requests that don't match
+// the directory.
+type ValidationMode string
+
+const (
+	// ValidationOff skips checking requests against the directory.
+	ValidationOff ValidationMode = ""
+	// ValidationWarn stores requests that don't match the directory,
+	// reporting problems in Result.Warnings.
+	ValidationWarn ValidationMode = "warn"
+	// ValidationStrict refuses requests that don't match the directory.
+	ValidationStrict ValidationMode = "strict"
+)
+
+func (m ValidationMode) Valid() bool {
+	switch m {
+	case ValidationOff, ValidationWarn, ValidationStrict:
+		return true
+	}
+	return false
+}
+
+func (r Resolution) String() string {
+	switch r {
+	case ResolutionMinute:
+		return "minute"
+	case ResolutionHour:
+		return "hour"
+	case ResolutionDay:
+		return "day"
+	}
+	return fmt.Sprintf("Resolution(%d)", int(r))
+}
+
+// CheckDirectory checks req against counters, returning a *ValidationError if
+// req's counter or direction is unknown, or if any of its points are outside
+// the counter's service ranges, have negative or non-integer values, are after
+// now, or don't have the direction's expected resolution.
+func CheckDirectory(counters []directory.Counter, req Request, now time.Time) error {
+	ctr, ok := findCounter(counters, req.ID)
+	if !ok {
+		return &ValidationError{Message: fmt.Sprintf("unknown counter %q", req.ID)}
+	}
+
+	dir, ok := ctr.Direction(req.DirectionID)
+	if !ok {
+		return &ValidationError{Message: fmt.Sprintf("unknown direction %q for counter %q", req.DirectionID, req.ID)}
+	}
+
+	loc, err := ctr.TimeZone()
+	if err != nil {
+		return &ValidationError{Message: fmt.Sprintf("counter %q zone: %s", req.ID, err)}
+	}
+
+	var perrs []PointError
+	for i, pt := range req.Points {
+		t := time.Unix(pt.Time, 0)
+
+		var msg string
+		switch {
+		case pt.Value < 0:
+			msg = "negative value"
+		case pt.Value != math.Trunc(pt.Value):
+			msg = "non-integer value"
+		case t.After(now):
+			msg = "time is in the future"
+		case !ctr.InService(t, loc):
+			msg = "time is outside counter service ranges"
+		case dir.Resolution != "" && pt.Resolution.String() != dir.Resolution:
+			msg = fmt.Sprintf("resolution %s does not match expected %s", pt.Resolution, dir.Resolution)
+		default:
+			continue
+		}
+		perrs = append(perrs, PointError{Index: i, Time: pt.Time, Message: msg})
+	}
+	if len(perrs) > 0 {
+		return &ValidationError{Message: "points do not match directory", Points: perrs}
+	}
+	return nil
+}
+
+func findCounter(counters []directory.Counter, id string) (directory.Counter, bool) {
+	for _, c := range counters {
+		if c.ID == id {
+			return c, true
+		}
+	}
+	return directory.Counter{}, false
+}